@@ -0,0 +1,175 @@
+package gta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// archiveInsertBatchSize keeps the variables of a multi-row insert within the limit of sqlite
+const archiveInsertBatchSize = 50
+
+// Archiver receives the tasks cleaned from the task table before they are deleted, i.e. the succeeded and canceled ones
+// after StorageTimeout, the failed ones after FailedStorageTimeout, and the succeeded ones of CleanSucceeded
+// definitions. The tasks are deleted only if Archive returns nil. A task may be archived more than once if the
+// deletion fails afterwards, the ID of the task can be used to dedup.
+type Archiver interface {
+	Archive(ctx context.Context, tasks []Task) error
+}
+
+// NewJSONLinesArchiver returns an Archiver writing each task as a line of JSON to w, e.g. an opened file. The tasks
+// archived at a time are written by a single call of w.Write.
+func NewJSONLinesArchiver(w io.Writer) Archiver {
+	return &jsonLinesArchiver{w: w}
+}
+
+type jsonLinesArchiver struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (a *jsonLinesArchiver) Archive(ctx context.Context, tasks []Task) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for i := range tasks {
+		if err := encoder.Encode(&tasks[i]); err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := a.w.Write(buf.Bytes())
+	return err
+}
+
+// CleanUpProgress is the progress of a round of the builtin clean up task, which is reported to CleanUpCallback after
+// each batch of tasks cleaned.
+type CleanUpProgress struct {
+	// statuses of the tasks cleaned in the round
+	Statuses []TaskStatus
+	// number of the batches cleaned so far
+	Batches int
+	// number of the tasks cleaned in the latest batch
+	Cleaned int64
+	// number of the tasks cleaned so far
+	TotalCleaned int64
+	// whether the tasks are archived before deleted
+	Archived bool
+	// time elapsed since the round started
+	Elapsed time.Duration
+}
+
+type taskArchiver interface {
+	Enabled() bool
+	Archive(tx StoreTx, tasks []Task) error
+	CleanUp(offset time.Duration, statuses []TaskStatus, excludeKeys []TaskKey) (int64, error)
+}
+
+type taskArchiverImp struct {
+	*options
+	dal Store
+}
+
+// Enabled returns whether the tasks should be archived before deleted.
+func (s *taskArchiverImp) Enabled() bool {
+	return s.archiveTable != "" || s.archiver != nil
+}
+
+// Archive writes the tasks to the archive table and the Archiver in the transaction deleting them.
+func (s *taskArchiverImp) Archive(tx StoreTx, tasks []Task) error {
+	if s.archiveTable != "" {
+		if err := s.dal.CreateArchives(tx, tasks); err != nil {
+			return err
+		}
+	}
+	if s.archiver != nil {
+		if err := s.archiver.Archive(s.context, tasks); err != nil {
+			return fmt.Errorf("archive tasks err: %w", err)
+		}
+	}
+	return nil
+}
+
+// CleanUp deletes the tasks of the statuses which are not updated within offset, and returns the number of tasks
+// deleted. The tasks are deleted in batches of cleanUpBatchSize with cleanUpBatchInterval between them, and the
+// remaining ones are left to the next round if the TaskManager is stopped. If archive enabled, each batch is archived
+// and deleted in a transaction.
+func (s *taskArchiverImp) CleanUp(offset time.Duration, statuses []TaskStatus, excludeKeys []TaskKey) (int64,
+	error) {
+	startTime := time.Now()
+	progress := CleanUpProgress{Statuses: statuses, Archived: s.Enabled()}
+	var afterID uint64
+	for {
+		select {
+		case <-s.done():
+			return progress.TotalCleaned, nil
+		default:
+		}
+		var cleaned int64
+		var finished bool
+		var err error
+		if progress.Archived {
+			cleaned, finished, err = s.archiveBatch(offset, statuses, excludeKeys)
+		} else {
+			afterID, cleaned, err = s.dal.DeleteByOffsetAndStatuses(s.getDB(), offset, statuses, excludeKeys, afterID,
+				s.cleanUpBatchSize)
+			finished = afterID == 0
+		}
+		if err != nil {
+			return progress.TotalCleaned, err
+		}
+		if cleaned > 0 {
+			progress.Batches++
+			progress.Cleaned = cleaned
+			progress.TotalCleaned += cleaned
+			progress.Elapsed = time.Since(startTime)
+			s.cleanUpCallback(s.logger(), progress)
+		}
+		if finished || !s.wait(s.cleanUpBatchInterval) {
+			return progress.TotalCleaned, nil
+		}
+	}
+}
+
+// archiveBatch archives and deletes a batch of tasks in a transaction, and returns whether no more tasks remain.
+func (s *taskArchiverImp) archiveBatch(offset time.Duration, statuses []TaskStatus, excludeKeys []TaskKey) (int64,
+	bool, error) {
+	var batch int
+	if err := s.dal.Transaction(s.getDB(), func(tx StoreTx) error {
+		tasks, err := s.dal.GetSliceByOffsetAndStatusesForUpdate(tx, offset, statuses, excludeKeys, s.cleanUpBatchSize)
+		if err != nil {
+			return err
+		} else if batch = len(tasks); batch == 0 {
+			return nil
+		}
+		if err := s.Archive(tx, tasks); err != nil {
+			return err
+		}
+		if rowsAffected, err := s.dal.DeleteByIDsAndStatuses(tx, taskIDsOf(tasks), statuses); err != nil {
+			return err
+		} else if rowsAffected != int64(batch) {
+			// the tasks are changed by others in the meantime, archive them next time
+			return ErrZeroRowsAffected
+		}
+		return nil
+	}); err != nil {
+		return 0, false, err
+	}
+	return int64(batch), batch < s.cleanUpBatchSize, nil
+}
+
+// wait sleeps for d between batches, and returns false if the TaskManager is stopped in the meantime.
+func (s *taskArchiverImp) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
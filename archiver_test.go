@@ -0,0 +1,190 @@
+package gta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+type testArchiverFunc func(ctx context.Context, tasks []Task) error
+
+func (f testArchiverFunc) Archive(ctx context.Context, tasks []Task) error {
+	return f(ctx, tasks)
+}
+
+func TestNewJSONLinesArchiver(t *testing.T) {
+	convey.Convey("TestNewJSONLinesArchiver", t, func() {
+		var buf bytes.Buffer
+		archiver := NewJSONLinesArchiver(&buf)
+		err := archiver.Archive(context.TODO(), []Task{{ID: 1, TaskKey: "t1"}, {ID: 2, TaskKey: "t2"}})
+		convey.So(err, convey.ShouldBeNil)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		convey.So(lines, convey.ShouldHaveLength, 2)
+		var task Task
+		convey.So(json.Unmarshal([]byte(lines[1]), &task), convey.ShouldBeNil)
+		convey.So(task.ID, convey.ShouldEqual, 2)
+		convey.So(task.TaskKey, convey.ShouldEqual, "t2")
+	})
+}
+
+func Test_taskArchiverImp_CleanUp(t *testing.T) {
+	convey.Convey("Test_taskArchiverImp_CleanUp", t, func() {
+		db := testDB("Test_taskArchiverImp_CleanUp")
+		convey.So(Migrate(db, "tasks_archive"), convey.ShouldBeNil)
+		opts, _ := newOptions(db, "tasks")
+		tdal := &taskDALImp{options: opts}
+		tarc := &taskArchiverImp{options: opts, dal: tdal}
+		opts.cleanUpBatchSize, opts.cleanUpBatchInterval = 10, time.Millisecond
+		var progresses []CleanUpProgress
+		opts.cleanUpCallback = func(logger Logger, progress CleanUpProgress) {
+			progresses = append(progresses, progress)
+		}
+		expired := 2*opts.cleanUpBatchSize + 1
+
+		expiredAt := time.Now().Add(-time.Hour)
+		tasks := make([]*Task, 0, expired+2)
+		for i := 0; i < expired; i++ {
+			tasks = append(tasks, &Task{TaskKey: "t1", TaskStatus: TaskStatusSucceeded, UpdatedAt: expiredAt})
+		}
+		tasks = append(tasks, &Task{TaskKey: "t1", TaskStatus: TaskStatusFailed, UpdatedAt: expiredAt},
+			&Task{TaskKey: "t1", TaskStatus: TaskStatusSucceeded})
+		convey.So(tdal.CreateInBatches(db, tasks, archiveInsertBatchSize), convey.ShouldBeNil)
+		countTasks := func(table string) int64 {
+			var count int64
+			db.Table(table).Count(&count)
+			return count
+		}
+
+		convey.Convey("delete", func() {
+			cleaned, err := tarc.CleanUp(time.Minute, []TaskStatus{TaskStatusSucceeded}, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(cleaned, convey.ShouldEqual, expired)
+			convey.So(countTasks("tasks"), convey.ShouldEqual, 2)
+			convey.So(countTasks("tasks_archive"), convey.ShouldEqual, 0)
+			convey.So(progresses, convey.ShouldHaveLength, 3)
+			convey.So(progresses[0].Cleaned, convey.ShouldEqual, 10)
+			convey.So(progresses[2].Batches, convey.ShouldEqual, 3)
+			convey.So(progresses[2].Cleaned, convey.ShouldEqual, 1)
+			convey.So(progresses[2].TotalCleaned, convey.ShouldEqual, expired)
+			convey.So(progresses[2].Archived, convey.ShouldBeFalse)
+			convey.So(progresses[2].Statuses, convey.ShouldResemble, []TaskStatus{TaskStatusSucceeded})
+		})
+
+		convey.Convey("delete in full batches", func() {
+			opts.cleanUpBatchSize = 11
+			cleaned, err := tarc.CleanUp(time.Minute, []TaskStatus{TaskStatusFailed, TaskStatusSucceeded}, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(cleaned, convey.ShouldEqual, expired+1)
+			convey.So(countTasks("tasks"), convey.ShouldEqual, 1)
+			convey.So(progresses, convey.ShouldHaveLength, 2)
+			convey.So(progresses[1].Cleaned, convey.ShouldEqual, 11)
+		})
+
+		convey.Convey("stopped", func() {
+			opts.cleanUpBatchInterval = time.Hour
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				opts.cancelFunc()
+			}()
+			cleaned, err := tarc.CleanUp(time.Minute, []TaskStatus{TaskStatusSucceeded}, nil)
+			convey.So(err, convey.ShouldBeNil)
+			// the remaining tasks are left to the next clean up
+			convey.So(cleaned, convey.ShouldEqual, 10)
+			convey.So(countTasks("tasks"), convey.ShouldEqual, expired+2-10)
+		})
+
+		convey.Convey("archive in batches", func() {
+			var buf bytes.Buffer
+			opts.archiveTable, opts.archiver = "tasks_archive", NewJSONLinesArchiver(&buf)
+			cleaned, err := tarc.CleanUp(time.Minute, []TaskStatus{TaskStatusSucceeded}, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(cleaned, convey.ShouldEqual, expired)
+			convey.So(countTasks("tasks"), convey.ShouldEqual, 2)
+			convey.So(countTasks("tasks_archive"), convey.ShouldEqual, expired)
+			convey.So(strings.Count(buf.String(), "\n"), convey.ShouldEqual, expired)
+			convey.So(progresses, convey.ShouldHaveLength, 3)
+			convey.So(progresses[2].Archived, convey.ShouldBeTrue)
+
+			cleaned, err = tarc.CleanUp(time.Minute, []TaskStatus{TaskStatusFailed}, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(cleaned, convey.ShouldEqual, 1)
+			archived, err := tdal.GetArchiveSlice(db, 1, expired)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(archived, convey.ShouldHaveLength, 1)
+			convey.So(archived[0].ID, convey.ShouldEqual, tasks[expired].ID)
+			convey.So(archived[0].TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+		})
+
+		convey.Convey("archiver error", func() {
+			opts.archiveTable = "tasks_archive"
+			opts.archiver = testArchiverFunc(func(ctx context.Context, tasks []Task) error { return ErrUnexpected })
+			cleaned, err := tarc.CleanUp(time.Minute, []TaskStatus{TaskStatusSucceeded}, nil)
+			convey.So(errors.Is(err, ErrUnexpected), convey.ShouldBeTrue)
+			convey.So(cleaned, convey.ShouldEqual, 0)
+			// nothing is deleted or archived
+			convey.So(countTasks("tasks"), convey.ShouldEqual, expired+2)
+			convey.So(countTasks("tasks_archive"), convey.ShouldEqual, 0)
+		})
+	})
+}
+
+func TestTaskManager_Archive(t *testing.T) {
+	convey.Convey("TestTaskManager_Archive", t, func() {
+		db := testDB("TestTaskManager_Archive")
+		convey.So(Migrate(db, "tasks_archive"), convey.ShouldBeNil)
+
+		convey.Convey("without archive table", func() {
+			m := NewTaskManager(db, "tasks")
+			_, err := m.QueryArchivedTasks(10, 0)
+			convey.So(errors.Is(err, ErrOption), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("clean succeeded", func() {
+			var buf bytes.Buffer
+			m := NewTaskManager(db, "tasks", WithArchiveTable("tasks_archive"), WithArchiver(NewJSONLinesArchiver(&buf)))
+			var t1Run int64
+			m.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run), CleanSucceeded: true})
+			m.Start()
+			err := m.Run(context.TODO(), "t1", nil)
+			convey.So(err, convey.ShouldBeNil)
+			m.Stop(true)
+			convey.So(t1Run, convey.ShouldEqual, 1)
+			_, err = m.GetTask(10001)
+			convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+			archived, err := m.QueryArchivedTasks(10, 0)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(archived, convey.ShouldHaveLength, 1)
+			convey.So(archived[0].ID, convey.ShouldEqual, 10001)
+			convey.So(archived[0].TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+			convey.So(archived[0].Extra.Attempts, convey.ShouldEqual, 1)
+			convey.So(strings.Count(buf.String(), "\n"), convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("clean canceled", func() {
+			updatedAt := time.Now().Add(-time.Hour)
+			_ = db.Table("tasks").Create(&Task{ID: 1, TaskKey: "t1", TaskStatus: TaskStatusSucceeded, UpdatedAt: updatedAt})
+			_ = db.Table("tasks").Create(&Task{ID: 2, TaskKey: "t1", TaskStatus: TaskStatusCanceled, UpdatedAt: updatedAt})
+
+			m := NewTaskManager(db, "tasks")
+			err := cleanUpHandler(m)(context.TODO(), cleanUpReq{StorageTimeout: time.Minute})
+			convey.So(err, convey.ShouldBeNil)
+			_, err = m.GetTask(1)
+			convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+			// canceled tasks are kept by default
+			_, err = m.GetTask(2)
+			convey.So(err, convey.ShouldBeNil)
+
+			m = NewTaskManager(db, "tasks", WithCleanCanceled(true))
+			err = cleanUpHandler(m)(context.TODO(), cleanUpReq{StorageTimeout: time.Minute, CleanCanceled: m.cleanCanceled})
+			convey.So(err, convey.ShouldBeNil)
+			_, err = m.GetTask(2)
+			convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+		})
+	})
+}
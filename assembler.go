@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"time"
 )
 
 type taskAssembler interface {
@@ -29,6 +30,8 @@ func (s *taskAssemblerImp) AssembleTask(ctxIn context.Context, taskDef *TaskDefi
 		ID:         taskDef.taskID,
 		TaskKey:    taskDef.key,
 		TaskStatus: TaskStatusUnKnown,
+		RunAt:      time.Now(),
+		Priority:   taskDef.Priority,
 	}
 
 	if arg != nil {
@@ -1,41 +1,62 @@
 package gta
 
 import (
+	"fmt"
 	"time"
 
+	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
-type taskDAL interface {
-	Create(tx *gorm.DB, task *Task) error
+// taskDALImp is the Store backed by gorm, which is used unless another one is set by WithStore.
+type taskDALImp struct {
+	*options
+}
+
+func (s *taskDALImp) Transaction(db StoreTx, fc func(tx StoreTx) error) error {
+	return gormDB(db).Transaction(func(tx *gorm.DB) error { return fc(tx) })
+}
 
-	Get(tx *gorm.DB, id uint64) (*Task, error)
-	GetForUpdate(tx *gorm.DB, id uint64) (*Task, error)
-	GetInitialized(tx *gorm.DB, sensitiveKeys []TaskKey, offset time.Duration, insensitiveKeys []TaskKey) (*Task, error)
-	GetSliceByOffsetsAndStatus(tx *gorm.DB, startOffset, endOffset time.Duration, status TaskStatus) ([]Task, error)
-	GetSliceExcludeSucceeded(tx *gorm.DB, excludeKeys []TaskKey, limit, offset int) ([]Task, error)
+// gormDB returns the db or transaction of the handle, which is always a *gorm.DB for the builtin store.
+func gormDB(tx StoreTx) *gorm.DB {
+	db, _ := tx.(*gorm.DB)
+	return db
+}
 
-	Update(tx *gorm.DB, task *Task) (int64, error)
-	UpdateStatusByIDs(tx *gorm.DB, taskIDs []uint64, ori TaskStatus, new TaskStatus) (int64, error)
+func (s *taskDALImp) tabledDB(tx StoreTx) *gorm.DB {
+	return gormDB(tx).Table(s.table)
+}
 
-	DeleteSucceededByOffset(tx *gorm.DB, offset time.Duration, excludeKeys []TaskKey) (int64, error)
-	DeleteByIDAndStatus(tx *gorm.DB, id uint64, status TaskStatus) (int64, error)
+func (s *taskDALImp) deadLetterDB(tx StoreTx) *gorm.DB {
+	return gormDB(tx).Table(s.deadLetterTable)
 }
 
-type taskDALImp struct {
-	*options
+func (s *taskDALImp) archiveDB(tx StoreTx) *gorm.DB {
+	return gormDB(tx).Table(s.archiveTable)
 }
 
-func (s *taskDALImp) tabledDB(tx *gorm.DB) *gorm.DB {
-	return tx.Table(s.table)
+func (s *taskDALImp) rateLimitDB(tx StoreTx) *gorm.DB {
+	return gormDB(tx).Table(s.rateLimitTable)
 }
 
-func (s *taskDALImp) Create(tx *gorm.DB, task *Task) error {
+func (s *taskDALImp) Create(tx StoreTx, task *Task) error {
 	return s.tabledDB(tx).Create(&task).Error
 }
 
-func (s *taskDALImp) Get(tx *gorm.DB, id uint64) (*Task, error) {
+func (s *taskDALImp) CreateInBatches(tx StoreTx, tasks []*Task, batchSize int) error {
+	return s.tabledDB(tx).CreateInBatches(tasks, batchSize).Error
+}
+
+func (s *taskDALImp) CreateDeadLetter(tx StoreTx, task *Task) error {
+	return s.deadLetterDB(tx).Create(&task).Error
+}
+
+func (s *taskDALImp) CreateArchives(tx StoreTx, tasks []Task) error {
+	return s.archiveDB(tx).CreateInBatches(tasks, archiveInsertBatchSize).Error
+}
+
+func (s *taskDALImp) Get(tx StoreTx, id uint64) (*Task, error) {
 	var rule Task
 	if err := s.tabledDB(tx).Where("id = ?", id).Take(&rule).Error; err == gorm.ErrRecordNotFound {
 		return nil, nil
@@ -45,7 +66,7 @@ func (s *taskDALImp) Get(tx *gorm.DB, id uint64) (*Task, error) {
 	return &rule, nil
 }
 
-func (s *taskDALImp) GetForUpdate(tx *gorm.DB, id uint64) (*Task, error) {
+func (s *taskDALImp) GetForUpdate(tx StoreTx, id uint64) (*Task, error) {
 	var rule Task
 	if err := s.tabledDB(tx).Where("id = ?", id).Clauses(clause.Locking{Strength: "UPDATE"}).Take(&rule).
 		Error; err == gorm.ErrRecordNotFound {
@@ -56,39 +77,90 @@ func (s *taskDALImp) GetForUpdate(tx *gorm.DB, id uint64) (*Task, error) {
 	return &rule, nil
 }
 
-func (s *taskDALImp) GetInitialized(tx *gorm.DB, sensitiveKeys []TaskKey, offset time.Duration,
-	insensitiveKeys []TaskKey) (*Task, error) {
-	var rule Task
+func (s *taskDALImp) GetInitializedSlice(tx StoreTx, sensitiveKeys []TaskKey, offset time.Duration,
+	insensitiveKeys []TaskKey, minPriority int, limit int) ([]Task, error) {
+	var res []Task
+	err := s.initializedDB(tx, sensitiveKeys, offset, insensitiveKeys, minPriority, limit).Find(&res).Error
+	return res, err
+}
 
-	db := s.tabledDB(tx).Where("task_status = ?", TaskStatusInitialized)
+// GetInitializedSliceForUpdate is like GetInitializedSlice, but the tasks are locked in the transaction, and the ones
+// locked by others are skipped if the dialect supports it.
+func (s *taskDALImp) GetInitializedSliceForUpdate(tx StoreTx, sensitiveKeys []TaskKey, offset time.Duration,
+	insensitiveKeys []TaskKey, minPriority int, limit int) ([]Task, error) {
+	var res []Task
+	locking := clause.Locking{Strength: "UPDATE"}
+	if s.SupportsSkipLocked(tx) {
+		// only the rows of the task table are locked, not the ones read by the subquery of the ordering keys
+		locking.Table, locking.Options = clause.Table{Name: s.table}, "SKIP LOCKED"
+	}
+	err := s.initializedDB(tx, sensitiveKeys, offset, insensitiveKeys, minPriority, limit).Clauses(locking).Find(&res).
+		Error
+	return res, err
+}
+
+// SupportsSkipLocked returns whether the dialect supports 'SELECT ... FOR UPDATE SKIP LOCKED', i.e. PostgreSQL and
+// MySQL 8. The version of MySQL is detected by the driver when the db is opened, and it is assumed to be 8 if the
+// detection is skipped.
+func (s *taskDALImp) SupportsSkipLocked(tx StoreTx) bool {
+	db := gormDB(tx)
+	switch dialector := db.Dialector.(type) {
+	case *mysql.Dialector:
+		return !dialector.DontSupportForShareClause
+	case mysql.Dialector:
+		return !dialector.DontSupportForShareClause
+	}
+	return db.Dialector.Name() == "postgres"
+}
+
+// initializedDB returns the query of the initialized tasks which can be claimed, in the order they should be claimed.
+func (s *taskDALImp) initializedDB(tx StoreTx, sensitiveKeys []TaskKey, offset time.Duration,
+	insensitiveKeys []TaskKey, minPriority int, limit int) *gorm.DB {
+	timeNow := time.Now()
+	db := s.tabledDB(tx).Where("task_status = ? AND run_at <= ? AND priority >= ?", TaskStatusInitialized, timeNow,
+		minPriority)
+	// only the first unfinished task of an ordering key can be claimed, and only when no task of the key is running
+	db = db.Where(fmt.Sprintf("ordering_key IS NULL OR NOT EXISTS (SELECT 1 FROM %[1]s AS o WHERE o.ordering_key = "+
+		"%[1]s.ordering_key AND (o.task_status = ? OR (o.task_status = ? AND o.id < %[1]s.id)))", s.table),
+		TaskStatusRunning, TaskStatusInitialized)
 	if len(sensitiveKeys) > 0 && len(insensitiveKeys) > 0 {
-		db = db.Where("(updated_at >= ? AND task_key IN (?)) OR (task_key IN (?))", time.Now().Add(-offset),
-			sensitiveKeys, insensitiveKeys)
+		db = db.Where("((updated_at >= ? OR run_at >= ?) AND task_key IN (?)) OR (task_key IN (?))",
+			timeNow.Add(-offset), timeNow.Add(-offset), sensitiveKeys, insensitiveKeys)
 	} else if len(sensitiveKeys) > 0 {
-		db = db.Where("updated_at >= ? AND task_key IN (?)", time.Now().Add(-offset), sensitiveKeys)
+		db = db.Where("(updated_at >= ? OR run_at >= ?) AND task_key IN (?)", timeNow.Add(-offset),
+			timeNow.Add(-offset), sensitiveKeys)
 	} else if len(insensitiveKeys) > 0 {
 		db = db.Where("task_key IN (?)", insensitiveKeys)
 	}
 
-	if err := db.Take(&rule).Error; err == gorm.ErrRecordNotFound {
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	}
-
-	return &rule, nil
+	// higher priority first, then the earlier one
+	return db.Order("priority DESC, run_at, id").Limit(limit)
 }
 
-func (s *taskDALImp) GetSliceByOffsetsAndStatus(tx *gorm.DB, startOffset, endOffset time.Duration,
+func (s *taskDALImp) GetSliceByOffsetsAndStatus(tx StoreTx, startOffset, endOffset time.Duration,
 	status TaskStatus) ([]Task, error) {
 	timeNow := time.Now()
+	start, end := timeNow.Add(-startOffset), timeNow.Add(-endOffset)
 	var res []Task
-	err := s.tabledDB(tx).Where("task_status = ? AND updated_at BETWEEN ? AND ?",
-		status, timeNow.Add(-startOffset), timeNow.Add(-endOffset)).Find(&res).Error
+	// the greater one of updated_at and run_at is between start and end, so that a delayed task is measured from the
+	// time it's due
+	err := s.tabledDB(tx).Where("task_status = ? AND updated_at <= ? AND run_at <= ? AND (updated_at >= ? OR run_at >= ?)",
+		status, end, end, start, start).Find(&res).Error
 	return res, err
 }
 
-func (s *taskDALImp) GetSliceExcludeSucceeded(tx *gorm.DB, excludeKeys []TaskKey, limit, offset int) ([]Task, error) {
+func (s *taskDALImp) GetSliceByOffsetAndStatusesForUpdate(tx StoreTx, offset time.Duration, statuses []TaskStatus,
+	excludeKeys []TaskKey, limit int) ([]Task, error) {
+	var res []Task
+	db := s.tabledDB(tx).Where("task_status IN (?) AND updated_at < ?", statuses, time.Now().Add(-offset))
+	if len(excludeKeys) > 0 {
+		db = db.Where("task_key NOT IN (?)", excludeKeys)
+	}
+	err := db.Clauses(clause.Locking{Strength: "UPDATE"}).Order("id").Limit(limit).Find(&res).Error
+	return res, err
+}
+
+func (s *taskDALImp) GetSliceExcludeSucceeded(tx StoreTx, excludeKeys []TaskKey, limit, offset int) ([]Task, error) {
 	var res []Task
 	db := s.tabledDB(tx).Where("task_status <> ?", TaskStatusSucceeded)
 	if len(excludeKeys) > 0 {
@@ -98,29 +170,274 @@ func (s *taskDALImp) GetSliceExcludeSucceeded(tx *gorm.DB, excludeKeys []TaskKey
 	return res, err
 }
 
-func (s *taskDALImp) Update(tx *gorm.DB, task *Task) (int64, error) {
+func (s *taskDALImp) GetLeaseExpiredSlice(tx StoreTx, keys []TaskKey, minPriority int, limit int) ([]Task, error) {
+	var res []Task
+	db := s.tabledDB(tx).Where("task_status = ? AND lease_expire_at < ? AND priority >= ?", TaskStatusRunning,
+		time.Now(), minPriority)
+	if len(keys) > 0 {
+		db = db.Where("task_key IN (?)", keys)
+	}
+	err := db.Order("lease_expire_at, id").Limit(limit).Find(&res).Error
+	return res, err
+}
+
+func (s *taskDALImp) GetByDedupKey(tx StoreTx, key TaskKey, dedupKey string) (*Task, error) {
+	var rule Task
+	if err := s.tabledDB(tx).Where("task_key = ? AND dedup_key = ?", key, dedupKey).Take(&rule).
+		Error; err == gorm.ErrRecordNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func (s *taskDALImp) GetCancelRequestedIDs(tx StoreTx, ids []uint64) ([]uint64, error) {
+	var res []uint64
+	err := s.tabledDB(tx).Where("id IN (?) AND task_status = ? AND cancel_requested = ?", ids, TaskStatusRunning, true).
+		Pluck("id", &res).Error
+	return res, err
+}
+
+func (s *taskDALImp) GetDeadLetter(tx StoreTx, id uint64) (*Task, error) {
+	var rule Task
+	if err := s.deadLetterDB(tx).Where("id = ?", id).Take(&rule).Error; err == gorm.ErrRecordNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func (s *taskDALImp) GetDeadLetterSlice(tx StoreTx, limit, offset int) ([]Task, error) {
+	var res []Task
+	err := s.deadLetterDB(tx).Order("id").Limit(limit).Offset(offset).Find(&res).Error
+	return res, err
+}
+
+func (s *taskDALImp) GetArchiveSlice(tx StoreTx, limit, offset int) ([]Task, error) {
+	var res []Task
+	err := s.archiveDB(tx).Order("id").Limit(limit).Offset(offset).Find(&res).Error
+	return res, err
+}
+
+func (s *taskDALImp) GetSliceByWorkflowID(tx StoreTx, workflowID uint64) ([]Task, error) {
+	var res []Task
+	err := s.tabledDB(tx).Where("workflow_id = ?", workflowID).Order("id").Find(&res).Error
+	return res, err
+}
+
+func (s *taskDALImp) GetPendingWorkflowIDs(tx StoreTx, offset time.Duration) ([]uint64, error) {
+	var res []uint64
+	err := s.tabledDB(tx).Where("task_status = ? AND updated_at <= ?", TaskStatusPending, time.Now().Add(-offset)).
+		Distinct().Pluck("workflow_id", &res).Error
+	return res, err
+}
+
+func (s *taskDALImp) CountRunningByKeyForUpdate(tx StoreTx, key TaskKey) (int64, error) {
+	// the IDs are selected rather than counted, since PostgreSQL rejects an aggregate with FOR UPDATE
+	var ids []uint64
+	if err := s.tabledDB(tx).Where("task_key = ? AND task_status = ?", key, TaskStatusRunning).
+		Clauses(clause.Locking{Strength: "UPDATE"}).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
+func (s *taskDALImp) GetRateLimitToken(tx StoreTx, key TaskKey) (*RateLimitToken, error) {
+	var token RateLimitToken
+	if err := s.rateLimitDB(tx).Where("task_key = ?", key).Take(&token).Error; err == gorm.ErrRecordNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s *taskDALImp) LockRateLimitToken(tx StoreTx, key TaskKey) (*RateLimitToken, error) {
+	if token, err := s.getRateLimitTokenForUpdate(tx, key); err != nil || token != nil {
+		return token, err
+	}
+	// the token may be created by others in the meantime, which is waited for and then locked
+	if err := s.rateLimitDB(tx).Clauses(clause.OnConflict{DoNothing: true}).Create(&RateLimitToken{TaskKey: key}).
+		Error; err != nil {
+		return nil, err
+	}
+	token, err := s.getRateLimitTokenForUpdate(tx, key)
+	if err == nil && token == nil {
+		return nil, ErrZeroRowsAffected
+	}
+	return token, err
+}
+
+func (s *taskDALImp) getRateLimitTokenForUpdate(tx StoreTx, key TaskKey) (*RateLimitToken, error) {
+	var token RateLimitToken
+	if err := s.rateLimitDB(tx).Where("task_key = ?", key).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Take(&token).Error; err == gorm.ErrRecordNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s *taskDALImp) UpdateRateLimitToken(tx StoreTx, token *RateLimitToken) (int64, error) {
+	db := s.rateLimitDB(tx).Where("task_key = ?", token.TaskKey).
+		Updates(map[string]interface{}{"tokens": token.Tokens, "refilled_at": token.RefilledAt})
+	return db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) Update(tx StoreTx, task *Task) (int64, error) {
 	db := s.tabledDB(tx).Updates(task)
 	return db.RowsAffected, db.Error
 }
 
-func (s *taskDALImp) UpdateStatusByIDs(tx *gorm.DB, ids []uint64, oriStatus TaskStatus, newStatus TaskStatus) (int64, error) {
-	db := s.tabledDB(tx).Where("id IN (?) AND task_status = ?", ids, oriStatus).Updates(&Task{TaskStatus: newStatus})
+func (s *taskDALImp) UpdateStatusByIDs(tx StoreTx, ids []uint64, oriStatus TaskStatus, newStatus TaskStatus) (int64, error) {
+	db := s.tabledDB(tx).Where("id IN (?) AND task_status = ?", ids, oriStatus).
+		Select("task_status", "cancel_requested", "updated_at").Updates(&Task{TaskStatus: newStatus})
+	return db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) UpdateStatusAndExtraByID(tx StoreTx, id uint64, oriStatus TaskStatus, newStatus TaskStatus,
+	extra TaskExtra) (int64, error) {
+	db := s.tabledDB(tx).Where("id = ? AND task_status = ?", id, oriStatus).Select("task_status", "extra", "updated_at").
+		Updates(&Task{TaskStatus: newStatus, Extra: extra})
+	return db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) UpdateStatusAndArgumentByID(tx StoreTx, id uint64, oriStatus TaskStatus,
+	newStatus TaskStatus, argument []byte) (int64, error) {
+	db := s.tabledDB(tx).Where("id = ? AND task_status = ?", id, oriStatus).Select("task_status", "argument", "updated_at").
+		Updates(&Task{TaskStatus: newStatus, Argument: argument})
+	return db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) UpdateRunningByLeaseOwner(tx StoreTx, id uint64, leaseOwner string, newStatus TaskStatus,
+	extra TaskExtra) (int64, error) {
+	db := s.tabledDB(tx).Where("id = ? AND task_status = ? AND lease_owner = ?", id, TaskStatusRunning, leaseOwner).
+		Select("task_status", "extra", "updated_at").Updates(&Task{TaskStatus: newStatus, Extra: extra})
+	return db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) UpdateRunningToRetry(tx StoreTx, id uint64, leaseOwner string, runAt time.Time,
+	extra TaskExtra) (int64, error) {
+	db := s.tabledDB(tx).Where("id = ? AND task_status = ? AND lease_owner = ?", id, TaskStatusRunning, leaseOwner).
+		Select("task_status", "run_at", "extra", "cancel_requested", "updated_at").
+		Updates(&Task{TaskStatus: TaskStatusInitialized, RunAt: runAt, Extra: extra})
 	return db.RowsAffected, db.Error
 }
 
-func (s *taskDALImp) DeleteSucceededByOffset(tx *gorm.DB, offset time.Duration, excludeKeys []TaskKey) (int64,
+func (s *taskDALImp) UpdateRunningToInitializedByLeaseOwner(tx StoreTx, ids []uint64, leaseOwner string) (int64,
 	error) {
+	db := s.tabledDB(tx).Where("id IN (?) AND task_status = ? AND lease_owner = ?", ids, TaskStatusRunning, leaseOwner).
+		Select("task_status", "lease_owner", "lease_expire_at", "cancel_requested", "updated_at").
+		Updates(&Task{TaskStatus: TaskStatusInitialized})
+	return db.RowsAffected, db.Error
+}
+
+// UpdateInitializedToRunningByIDs claims the initialized ones of the tasks, and returns the IDs of the tasks claimed.
+// If the dialect supports SKIP LOCKED, the tasks are locked before updated and the ones locked by others are skipped.
+// Otherwise, e.g. for sqlite and MySQL 5.7, ErrZeroRowsAffected is returned if any of the tasks is claimed by others.
+func (s *taskDALImp) UpdateInitializedToRunningByIDs(tx StoreTx, ids []uint64, leaseOwner string,
+	leaseExpireAt *time.Time) ([]uint64, error) {
+	claimedIDs := ids
+	if s.SupportsSkipLocked(tx) {
+		var lockedIDs []uint64
+		if err := s.tabledDB(tx).Where("id IN (?) AND task_status = ?", ids, TaskStatusInitialized).
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).Pluck("id", &lockedIDs).
+			Error; err != nil || len(lockedIDs) == 0 {
+			return nil, err
+		}
+		claimedIDs = lockedIDs
+	}
+	db := s.tabledDB(tx).Where("id IN (?) AND task_status = ?", claimedIDs, TaskStatusInitialized).
+		Select("task_status", "lease_owner", "lease_expire_at", "cancel_requested", "updated_at").
+		Updates(&Task{TaskStatus: TaskStatusRunning, LeaseOwner: leaseOwner, LeaseExpireAt: leaseExpireAt})
+	if db.Error != nil {
+		return nil, db.Error
+	} else if db.RowsAffected != int64(len(claimedIDs)) {
+		return nil, ErrZeroRowsAffected
+	}
+	return claimedIDs, nil
+}
+
+func (s *taskDALImp) UpdateLeaseExpired(tx StoreTx, oriLeaseOwner string, task *Task) (int64, error) {
+	db := s.tabledDB(tx).Where("id = ? AND task_status = ? AND lease_owner = ? AND lease_expire_at < ?", task.ID,
+		TaskStatusRunning, oriLeaseOwner, time.Now()).
+		Select("task_status", "lease_owner", "lease_expire_at", "extra", "updated_at").
+		Updates(&Task{TaskStatus: task.TaskStatus, LeaseOwner: task.LeaseOwner, LeaseExpireAt: task.LeaseExpireAt,
+			Extra: task.Extra})
+	return db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) UpdateLeaseByIDs(tx StoreTx, ids []uint64, leaseOwner string, leaseExpireAt time.Time) (int64,
+	error) {
+	// updated_at is not touched, so that a running task can still be detected as abnormal by its running timeout
+	db := s.tabledDB(tx).Where("id IN (?) AND task_status = ? AND lease_owner = ?", ids, TaskStatusRunning, leaseOwner).
+		UpdateColumn("lease_expire_at", leaseExpireAt)
+	return db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) UpdateDedupKeyToNull(tx StoreTx, id uint64) (int64, error) {
+	db := s.tabledDB(tx).Where("id = ?", id).UpdateColumn("dedup_key", nil)
+	return db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) UpdateCancelRequested(tx StoreTx, id uint64) (int64, error) {
+	db := s.tabledDB(tx).Where("id = ? AND task_status = ?", id, TaskStatusRunning).Update("cancel_requested", true)
+	return db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) UpdateWorkflowID(tx StoreTx, id uint64, workflowID uint64) (int64, error) {
+	db := s.tabledDB(tx).Where("id = ?", id).UpdateColumn("workflow_id", workflowID)
+	return db.RowsAffected, db.Error
+}
+
+// DeleteByOffsetAndStatuses deletes at most limit tasks of the statuses not updated within offset, whose IDs are
+// greater than afterID. The tasks are deleted by an ID range rather than DELETE with LIMIT which is not supported by
+// all dialects, and the end of the range is returned, 0 if no more tasks remain after the range.
+func (s *taskDALImp) DeleteByOffsetAndStatuses(tx StoreTx, offset time.Duration, statuses []TaskStatus,
+	excludeKeys []TaskKey, afterID uint64, limit int) (uint64, int64, error) {
+	deadline := time.Now().Add(-offset)
+	var lastIDs []uint64
+	if err := s.cleanUpDB(tx, deadline, statuses, excludeKeys, afterID).Order("id").Offset(limit-1).Limit(1).
+		Pluck("id", &lastIDs).Error; err != nil {
+		return 0, 0, err
+	}
 	var rule Task
-	db := s.tabledDB(tx).Where("task_status = ? AND updated_at < ?", TaskStatusSucceeded, time.Now().Add(-offset))
+	var lastID uint64
+	db := s.cleanUpDB(tx, deadline, statuses, excludeKeys, afterID)
+	if len(lastIDs) > 0 {
+		lastID = lastIDs[0]
+		db = db.Where("id <= ?", lastID)
+	}
+	db = db.Delete(&rule)
+	return lastID, db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) cleanUpDB(tx StoreTx, deadline time.Time, statuses []TaskStatus, excludeKeys []TaskKey,
+	afterID uint64) *gorm.DB {
+	db := s.tabledDB(tx).Where("task_status IN (?) AND updated_at < ? AND id > ?", statuses, deadline, afterID)
 	if len(excludeKeys) > 0 {
 		db = db.Where("task_key NOT IN (?)", excludeKeys)
 	}
-	db.Delete(&rule)
-	return db.RowsAffected, db.Error
+	return db
 }
 
-func (s *taskDALImp) DeleteByIDAndStatus(tx *gorm.DB, id uint64, status TaskStatus) (int64, error) {
+func (s *taskDALImp) DeleteByIDAndStatus(tx StoreTx, id uint64, status TaskStatus) (int64, error) {
 	var rule Task
 	db := s.tabledDB(tx).Where("task_status = ? AND id = ?", status, id).Delete(&rule)
 	return db.RowsAffected, db.Error
 }
+
+func (s *taskDALImp) DeleteByIDsAndStatuses(tx StoreTx, ids []uint64, statuses []TaskStatus) (int64, error) {
+	var rule Task
+	db := s.tabledDB(tx).Where("task_status IN (?) AND id IN (?)", statuses, ids).Delete(&rule)
+	return db.RowsAffected, db.Error
+}
+
+func (s *taskDALImp) DeleteDeadLetterByID(tx StoreTx, id uint64) (int64, error) {
+	var rule Task
+	db := s.deadLetterDB(tx).Where("id = ?", id).Delete(&rule)
+	return db.RowsAffected, db.Error
+}
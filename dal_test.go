@@ -1,35 +1,95 @@
 package gta
 
 import (
+	"context"
+	"math"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
-func Test_taskDALImp_GetInitialized(t *testing.T) {
-	convey.Convey("Test_taskDALImp_GetInitialized", t, func() {
-		db := testDB("Test_taskDALImp_GetInitialized")
+func Test_taskDALImp_GetInitializedSlice(t *testing.T) {
+	convey.Convey("Test_taskDALImp_GetInitializedSlice", t, func() {
+		db := testDB("Test_taskDALImp_GetInitializedSlice")
+		// the first task to be claimed
+		firstOf := func(tasks []Task, err error) (*Task, error) {
+			if err != nil || len(tasks) == 0 {
+				return nil, err
+			}
+			return &tasks[0], nil
+		}
 		convey.Convey("normal", func() {
 			tdal := taskDALImp{options: &options{db: db, table: "tasks"}}
 			convey.Convey("only has sensitive keys", func() {
 				convey.Convey("normal time", func() {
 					_ = tdal.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized, CreatedAt: time.Now(), UpdatedAt: time.Now()})
-					task, err := tdal.GetInitialized(db, []TaskKey{"t1"}, time.Second, nil)
+					task, err := firstOf(tdal.GetInitializedSlice(db, []TaskKey{"t1"}, time.Second, nil, math.MinInt32, 1))
 					convey.So(err, convey.ShouldBeNil)
 					convey.So(task, convey.ShouldNotBeNil)
 				})
+				convey.Convey("delayed task", func() {
+					_ = tdal.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized, RunAt: time.Now().Add(time.Hour), CreatedAt: time.Now(), UpdatedAt: time.Now()})
+					task, err := firstOf(tdal.GetInitializedSlice(db, []TaskKey{"t1"}, time.Second, nil, math.MinInt32, 1))
+					convey.So(err, convey.ShouldBeNil)
+					convey.So(task, convey.ShouldBeNil)
+				})
 				convey.Convey("invalid time", func() {
 					_ = tdal.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized, CreatedAt: time.Now(), UpdatedAt: time.Now()})
-					task, err := tdal.GetInitialized(db, []TaskKey{"t1"}, -time.Second, nil)
+					task, err := firstOf(tdal.GetInitializedSlice(db, []TaskKey{"t1"}, -time.Second, nil, math.MinInt32, 1))
 					convey.So(err, convey.ShouldBeNil)
 					convey.So(task, convey.ShouldBeNil)
 				})
 			})
+			convey.Convey("priority", func() {
+				now := time.Now()
+				_ = tdal.Create(db, &Task{TaskKey: "t2", TaskStatus: TaskStatusInitialized, RunAt: now.Add(-2 * time.Second), Priority: 0})
+				_ = tdal.Create(db, &Task{TaskKey: "t2", TaskStatus: TaskStatusInitialized, RunAt: now.Add(-time.Second), Priority: 1})
+				_ = tdal.Create(db, &Task{TaskKey: "t2", TaskStatus: TaskStatusInitialized, RunAt: now, Priority: 1})
+				task, err := firstOf(tdal.GetInitializedSlice(db, nil, time.Second, []TaskKey{"t2"}, math.MinInt32, 1))
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(task.Priority, convey.ShouldEqual, 1)
+				convey.So(task.RunAt.Unix(), convey.ShouldEqual, now.Add(-time.Second).Unix())
+
+				_, _ = tdal.UpdateStatusByIDs(db, []uint64{task.ID}, TaskStatusInitialized, TaskStatusRunning)
+				task, err = firstOf(tdal.GetInitializedSlice(db, nil, time.Second, []TaskKey{"t2"}, 1, 1))
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(task.Priority, convey.ShouldEqual, 1)
+				_, _ = tdal.UpdateStatusByIDs(db, []uint64{task.ID}, TaskStatusInitialized, TaskStatusRunning)
+				task, err = firstOf(tdal.GetInitializedSlice(db, nil, time.Second, []TaskKey{"t2"}, 1, 1))
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(task, convey.ShouldBeNil)
+			})
+			convey.Convey("ordering key", func() {
+				k1, k2 := "order_1", "order_2"
+				_ = tdal.Create(db, &Task{TaskKey: "t3", TaskStatus: TaskStatusInitialized, RunAt: time.Now(), OrderingKey: &k1})
+				_ = tdal.Create(db, &Task{TaskKey: "t3", TaskStatus: TaskStatusInitialized, RunAt: time.Now().Add(-time.Second), OrderingKey: &k1})
+				_ = tdal.Create(db, &Task{TaskKey: "t3", TaskStatus: TaskStatusRunning, RunAt: time.Now(), OrderingKey: &k2})
+				_ = tdal.Create(db, &Task{TaskKey: "t3", TaskStatus: TaskStatusInitialized, RunAt: time.Now(), OrderingKey: &k2})
+				// the first task of order_1 is claimed though the second one is earlier
+				task, err := firstOf(tdal.GetInitializedSlice(db, nil, time.Second, []TaskKey{"t3"}, math.MinInt32, 1))
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(*task.OrderingKey, convey.ShouldEqual, k1)
+				first := task.ID
+				_, _ = tdal.UpdateStatusByIDs(db, []uint64{first}, TaskStatusInitialized, TaskStatusRunning)
+				task, err = firstOf(tdal.GetInitializedSlice(db, nil, time.Second, []TaskKey{"t3"}, math.MinInt32, 1))
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(task, convey.ShouldBeNil)
+				_, _ = tdal.UpdateStatusByIDs(db, []uint64{first}, TaskStatusRunning, TaskStatusSucceeded)
+				task, err = firstOf(tdal.GetInitializedSlice(db, nil, time.Second, []TaskKey{"t3"}, math.MinInt32, 1))
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(task.ID, convey.ShouldBeGreaterThan, first)
+				convey.So(*task.OrderingKey, convey.ShouldEqual, k1)
+			})
 		})
 		convey.Convey("error", func() {
 			tdal := taskDALImp{options: &options{db: db, table: "not exist"}}
-			_, err := tdal.GetInitialized(db, nil, time.Second, nil)
+			_, err := firstOf(tdal.GetInitializedSlice(db, nil, time.Second, nil, math.MinInt32, 1))
 			convey.So(err, convey.ShouldNotBeNil)
 		})
 	})
@@ -56,3 +116,275 @@ func Test_taskDALImp_GetForUpdate(t *testing.T) {
 		})
 	})
 }
+
+func Test_taskDALImp_GetLeaseExpiredSlice(t *testing.T) {
+	convey.Convey("Test_taskDALImp_GetLeaseExpiredSlice", t, func() {
+		db := testDB("Test_taskDALImp_GetLeaseExpiredSlice")
+		tdal := taskDALImp{options: &options{db: db, table: "tasks"}}
+		expired, valid := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+		convey.Convey("lease expired", func() {
+			earlier := expired.Add(-time.Second)
+			_ = tdal.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusRunning, LeaseOwner: "i1", LeaseExpireAt: &expired})
+			_ = tdal.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusRunning, LeaseOwner: "i1", LeaseExpireAt: &earlier,
+				Priority: -1})
+			tasks, err := tdal.GetLeaseExpiredSlice(db, []TaskKey{"t1"}, math.MinInt32, 10)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(tasks, convey.ShouldHaveLength, 2)
+			// in the order the leases expired
+			convey.So(tasks[0].Priority, convey.ShouldEqual, -1)
+			tasks, _ = tdal.GetLeaseExpiredSlice(db, []TaskKey{"t1"}, 0, 10)
+			convey.So(tasks, convey.ShouldHaveLength, 1)
+			tasks, _ = tdal.GetLeaseExpiredSlice(db, []TaskKey{"t1"}, math.MinInt32, 1)
+			convey.So(tasks, convey.ShouldHaveLength, 1)
+
+			task := &tasks[0]
+			task.LeaseOwner, task.LeaseExpireAt = "i2", &valid
+			rowsAffected, err := tdal.UpdateLeaseExpired(db, "i1", task)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(rowsAffected, convey.ShouldEqual, 1)
+			rowsAffected, _ = tdal.UpdateLeaseExpired(db, "i1", task)
+			convey.So(rowsAffected, convey.ShouldEqual, 0)
+		})
+		convey.Convey("lease valid or disabled", func() {
+			_ = tdal.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusRunning, LeaseOwner: "i1", LeaseExpireAt: &valid})
+			_ = tdal.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusRunning})
+			tasks, err := tdal.GetLeaseExpiredSlice(db, []TaskKey{"t1"}, math.MinInt32, 10)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(tasks, convey.ShouldBeEmpty)
+		})
+		convey.Convey("error", func() {
+			tdal := taskDALImp{options: &options{db: db, table: "not exist"}}
+			_, err := tdal.GetLeaseExpiredSlice(db, nil, math.MinInt32, 10)
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_taskDALImp_UpdateLeaseByIDs(t *testing.T) {
+	convey.Convey("Test_taskDALImp_UpdateLeaseByIDs", t, func() {
+		db := testDB("Test_taskDALImp_UpdateLeaseByIDs")
+		tdal := taskDALImp{options: &options{db: db, table: "tasks"}}
+		expired := time.Now().Add(-time.Second)
+		_ = tdal.Create(db, &Task{ID: 1, TaskKey: "t1", TaskStatus: TaskStatusRunning, LeaseOwner: "i1", LeaseExpireAt: &expired})
+		_ = tdal.Create(db, &Task{ID: 2, TaskKey: "t1", TaskStatus: TaskStatusRunning, LeaseOwner: "i2", LeaseExpireAt: &expired})
+		rowsAffected, err := tdal.UpdateLeaseByIDs(db, []uint64{1, 2}, "i1", time.Now().Add(time.Hour))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(rowsAffected, convey.ShouldEqual, 1)
+		tasks, _ := tdal.GetLeaseExpiredSlice(db, nil, math.MinInt32, 10)
+		convey.So(tasks, convey.ShouldHaveLength, 1)
+		convey.So(tasks[0].ID, convey.ShouldEqual, 2)
+	})
+}
+
+func Test_taskDALImp_UpdateRunningByLeaseOwner(t *testing.T) {
+	convey.Convey("Test_taskDALImp_UpdateRunningByLeaseOwner", t, func() {
+		db := testDB("Test_taskDALImp_UpdateRunningByLeaseOwner")
+		for _, store := range []Store{&taskDALImp{options: &options{db: db, table: "tasks"}}, NewMemoryStore()} {
+			// reclaimed by i2 after the lease of i1 expired
+			_ = store.Create(db, &Task{ID: 1, TaskKey: "t1", TaskStatus: TaskStatusRunning, LeaseOwner: "i2",
+				CancelRequested: true})
+			rowsAffected, err := store.UpdateRunningByLeaseOwner(db, 1, "i1", TaskStatusFailed, TaskExtra{})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(rowsAffected, convey.ShouldEqual, 0)
+			rowsAffected, err = store.UpdateRunningToRetry(db, 1, "i1", time.Now(), TaskExtra{})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(rowsAffected, convey.ShouldEqual, 0)
+
+			rowsAffected, err = store.UpdateRunningToRetry(db, 1, "i2", time.Now(), TaskExtra{Retries: 1})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(rowsAffected, convey.ShouldEqual, 1)
+			// the cancellation requested for the previous run is reset
+			task, _ := store.Get(db, 1)
+			convey.So(task.CancelRequested, convey.ShouldBeFalse)
+			_, _ = store.UpdateStatusByIDs(db, []uint64{1}, TaskStatusInitialized, TaskStatusRunning)
+			rowsAffected, err = store.UpdateRunningByLeaseOwner(db, 1, "i2", TaskStatusSucceeded, TaskExtra{})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(rowsAffected, convey.ShouldEqual, 1)
+			task, _ = store.Get(db, 1)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+
+			leaseExpireAt := time.Now().Add(time.Minute)
+			_ = store.Create(db, &Task{ID: 2, TaskKey: "t1", TaskStatus: TaskStatusRunning, LeaseOwner: "i2",
+				LeaseExpireAt: &leaseExpireAt, CancelRequested: true})
+			rowsAffected, err = store.UpdateRunningToInitializedByLeaseOwner(db, []uint64{2}, "i1")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(rowsAffected, convey.ShouldEqual, 0)
+			rowsAffected, err = store.UpdateRunningToInitializedByLeaseOwner(db, []uint64{2}, "i2")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(rowsAffected, convey.ShouldEqual, 1)
+			task, _ = store.Get(db, 2)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
+			convey.So(task.LeaseOwner, convey.ShouldBeEmpty)
+			convey.So(task.LeaseExpireAt, convey.ShouldBeNil)
+			convey.So(task.CancelRequested, convey.ShouldBeFalse)
+		}
+	})
+}
+
+func Test_taskDALImp_LockRateLimitToken(t *testing.T) {
+	convey.Convey("Test_taskDALImp_LockRateLimitToken", t, func() {
+		db := testDB("Test_taskDALImp_LockRateLimitToken")
+		_ = db.Table("tasks_rate_limit").AutoMigrate(&RateLimitToken{})
+		tdal := &taskDALImp{options: &options{db: db, table: "tasks", rateLimitTable: "tasks_rate_limit"}}
+		for _, store := range []Store{tdal, NewMemoryStore()} {
+			err := store.Transaction(db, func(tx StoreTx) error {
+				// created if not exists
+				token, err := store.LockRateLimitToken(tx, "t1")
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(*token, convey.ShouldResemble, RateLimitToken{TaskKey: "t1"})
+				token.Tokens = 1
+				_, err = store.UpdateRateLimitToken(tx, token)
+				return err
+			})
+			convey.So(err, convey.ShouldBeNil)
+			token, err := store.LockRateLimitToken(db, "t1")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(token.Tokens, convey.ShouldEqual, 1)
+		}
+	})
+}
+
+func Test_taskDALImp_GetSliceByOffsetsAndStatus(t *testing.T) {
+	convey.Convey("Test_taskDALImp_GetSliceByOffsetsAndStatus", t, func() {
+		db := testDB("Test_taskDALImp_GetSliceByOffsetsAndStatus")
+		now := time.Now()
+		tasks := []Task{
+			// created long ago but due an hour ago
+			{ID: 1, TaskKey: "t1", TaskStatus: TaskStatusInitialized, RunAt: now.Add(-time.Hour), UpdatedAt: now.Add(-48 * time.Hour)},
+			// not due yet
+			{ID: 2, TaskKey: "t1", TaskStatus: TaskStatusInitialized, RunAt: now.Add(time.Hour), UpdatedAt: now.Add(-time.Hour)},
+			// due just now
+			{ID: 3, TaskKey: "t1", TaskStatus: TaskStatusInitialized, RunAt: now, UpdatedAt: now.Add(-time.Hour)},
+			// updated just now
+			{ID: 4, TaskKey: "t1", TaskStatus: TaskStatusInitialized, RunAt: now.Add(-time.Hour), UpdatedAt: now},
+			// out of the storage timeout
+			{ID: 5, TaskKey: "t1", TaskStatus: TaskStatusInitialized, RunAt: now.Add(-48 * time.Hour), UpdatedAt: now.Add(-48 * time.Hour)},
+		}
+		for _, store := range []Store{&taskDALImp{options: &options{db: db, table: "tasks"}}, NewMemoryStore()} {
+			for i := range tasks {
+				task := tasks[i]
+				_ = store.Create(db, &task)
+			}
+			res, err := store.GetSliceByOffsetsAndStatus(db, 24*time.Hour, time.Minute, TaskStatusInitialized)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(taskIDsOf(res), convey.ShouldResemble, []uint64{1})
+		}
+	})
+}
+
+func Test_taskDALImp_GetByDedupKey(t *testing.T) {
+	convey.Convey("Test_taskDALImp_GetByDedupKey", t, func() {
+		db := testDB("Test_taskDALImp_GetByDedupKey")
+		tdal := taskDALImp{options: &options{db: db, table: "tasks"}}
+		dedupKey := "event_1"
+		err := tdal.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized, DedupKey: &dedupKey})
+		convey.So(err, convey.ShouldBeNil)
+		err = tdal.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized, DedupKey: &dedupKey})
+		convey.So(err, convey.ShouldNotBeNil)
+		task, err := tdal.GetByDedupKey(db, "t1", dedupKey)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(task, convey.ShouldNotBeNil)
+
+		rowsAffected, err := tdal.UpdateDedupKeyToNull(db, task.ID)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(rowsAffected, convey.ShouldEqual, 1)
+		task, err = tdal.GetByDedupKey(db, "t1", dedupKey)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(task, convey.ShouldBeNil)
+	})
+}
+
+func Test_taskDALImp_UpdateCancelRequested(t *testing.T) {
+	convey.Convey("Test_taskDALImp_UpdateCancelRequested", t, func() {
+		db := testDB("Test_taskDALImp_UpdateCancelRequested")
+		tdal := taskDALImp{options: &options{db: db, table: "tasks"}}
+		_ = tdal.Create(db, &Task{ID: 1, TaskKey: "t1", TaskStatus: TaskStatusRunning})
+		_ = tdal.Create(db, &Task{ID: 2, TaskKey: "t1", TaskStatus: TaskStatusSucceeded})
+		rowsAffected, err := tdal.UpdateCancelRequested(db, 1)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(rowsAffected, convey.ShouldEqual, 1)
+		rowsAffected, _ = tdal.UpdateCancelRequested(db, 2)
+		convey.So(rowsAffected, convey.ShouldEqual, 0)
+		ids, err := tdal.GetCancelRequestedIDs(db, []uint64{1, 2})
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(ids, convey.ShouldResemble, []uint64{1})
+	})
+}
+
+// testSQLRecorder records the SQL statements instead of logging them.
+type testSQLRecorder struct {
+	logger.Interface
+	sqls []string
+}
+
+func (r *testSQLRecorder) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	sql, _ := fc()
+	r.sqls = append(r.sqls, sql)
+}
+
+// testPostgresDialector returns the PostgreSQL dialector, which never connects to the server in dry run mode.
+func testPostgresDialector() gorm.Dialector {
+	return postgres.New(postgres.Config{DSN: "host=127.0.0.1 user=gta password=gta dbname=gta port=5432"})
+}
+
+// testDryRunDB opens a db which generates the SQL statements without connecting to the server.
+func testDryRunDB(dialector gorm.Dialector) (*gorm.DB, *testSQLRecorder) {
+	recorder := &testSQLRecorder{Interface: logger.Default.LogMode(logger.Silent)}
+	db, _ := gorm.Open(dialector, &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true,
+		Logger: recorder})
+	return db, recorder
+}
+
+func Test_taskDALImp_SkipLocked(t *testing.T) {
+	convey.Convey("Test_taskDALImp_SkipLocked", t, func() {
+		mysqlConfig := mysql.Config{DSN: "gta:gta@tcp(127.0.0.1:3306)/gta", SkipInitializeWithVersion: true}
+		mysql57Config := mysqlConfig
+		mysql57Config.DontSupportForShareClause = true
+		cases := []struct {
+			name       string
+			dialector  gorm.Dialector
+			skipLocked bool
+			quote      string
+		}{
+			{name: "mysql 8", dialector: mysql.New(mysqlConfig), skipLocked: true, quote: "`"},
+			{name: "mysql 5.7", dialector: mysql.New(mysql57Config), skipLocked: false, quote: "`"},
+			{name: "postgres", dialector: testPostgresDialector(), skipLocked: true, quote: `"`},
+		}
+		for _, c := range cases {
+			c := c
+			convey.Convey(c.name, func() {
+				// the expected statements are written in the quotes of MySQL
+				quoted := func(sql string) string { return strings.ReplaceAll(sql, "`", c.quote) }
+				db, recorder := testDryRunDB(c.dialector)
+				tdal := taskDALImp{options: &options{db: db, table: "tasks"}}
+				convey.So(tdal.SupportsSkipLocked(db), convey.ShouldEqual, c.skipLocked)
+
+				_, err := tdal.GetInitializedSliceForUpdate(db, nil, time.Second, []TaskKey{"t1"}, math.MinInt32, 10)
+				convey.So(err, convey.ShouldBeNil)
+				_, err = tdal.UpdateInitializedToRunningByIDs(db, []uint64{1, 2}, "i1", nil)
+				convey.So(recorder.sqls, convey.ShouldHaveLength, 2)
+				convey.So(recorder.sqls[0], convey.ShouldStartWith, quoted("SELECT * FROM `tasks` WHERE (task_status = 'initialized'"))
+				convey.So(recorder.sqls[0], convey.ShouldContainSubstring, "ORDER BY priority DESC, run_at, id LIMIT 10")
+				if c.skipLocked {
+					// nothing is locked in dry run mode
+					convey.So(err, convey.ShouldBeNil)
+					convey.So(recorder.sqls[0], convey.ShouldEndWith, quoted("FOR UPDATE OF `tasks` SKIP LOCKED"))
+					convey.So(recorder.sqls[1], convey.ShouldStartWith, quoted("SELECT `id` FROM `tasks` WHERE id IN (1,2) AND task_status = 'initialized'"))
+					convey.So(recorder.sqls[1], convey.ShouldEndWith, "FOR UPDATE SKIP LOCKED")
+				} else {
+					// claimed by the conditional update only, which updates nothing in dry run mode
+					convey.So(err, convey.ShouldEqual, ErrZeroRowsAffected)
+					convey.So(recorder.sqls[0], convey.ShouldEndWith, "LIMIT 10 FOR UPDATE")
+					convey.So(recorder.sqls[1], convey.ShouldStartWith, quoted("UPDATE `tasks` SET"))
+					convey.So(recorder.sqls[1], convey.ShouldContainSubstring, "WHERE id IN (1,2) AND task_status = 'initialized'")
+				}
+			})
+		}
+
+		convey.Convey("sqlite", func() {
+			db := testDB("Test_taskDALImp_SkipLocked")
+			tdal := taskDALImp{options: &options{db: db, table: "tasks"}}
+			convey.So(tdal.SupportsSkipLocked(db), convey.ShouldBeFalse)
+		})
+	})
+}
@@ -2,11 +2,20 @@ package gta
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
 	"reflect"
 	"time"
 )
 
-// TaskHandler is a handler to a certain task
+const (
+	periodicTaskIDBase  uint64 = 1000
+	periodicTaskIDRange uint64 = 8000
+)
+
+// TaskHandler is a handler to a certain task. The context passed in is derived from the one unmarshaled by the
+// CtxMarshaler, which is done once the task times out, is canceled or the task manager is stopped. The values of the
+// unmarshaled context are kept, but not its concrete type, e.g. a *gin.Context unmarshaled can't be asserted from it.
 type TaskHandler func(ctx context.Context, arg interface{}) (err error)
 
 // TaskDefinition is a definition of a certain task
@@ -22,7 +31,34 @@ type TaskDefinition struct {
 	RetryTimes int
 	// optional, retry interval
 	RetryInterval func(times int) time.Duration
-	// optional, determine whether the task will be cleaned immediately once succeeded
+	// optional, initialized tasks with higher priority are claimed first by the scanner, and tasks with positive
+	// priority can use the pool workers reserved by ReservedPoolSize
+	Priority int
+	// optional, called once the task is marked failed after the retries are exhausted, with the context and argument
+	// of the task and the error of the last attempt, e.g. to alert or compensate
+	OnFailed func(ctx context.Context, arg interface{}, err error)
+	// optional, max number of tasks of this key running in current instance, unlimited if zero. Excess tasks are left
+	// 'initialized' to be scanned later, note that it's not supported in dry run mode
+	MaxConcurrency int
+	// optional, max number of tasks of this key running across the cluster, unlimited if zero. It's enforced by
+	// counting the running tasks of this key under the lock of its row in the rate limit table when a task is claimed,
+	// so WithRateLimitTable is required, and excess tasks are left 'initialized'
+	MaxGlobalConcurrency int
+	// optional, max number of tasks of this key started per second, which can be adjusted at runtime by SetRateLimit.
+	// The tokens are taken when the tasks are claimed, and tasks over the limit are left 'initialized' rather than
+	// failed, note that it's not supported in dry run mode
+	RateLimit RateLimit
+	// optional, timeout of a single attempt, to replace the global TaskTimeout if not zero. The handler context is done
+	// once the timeout is exceeded, and the attempt is regarded as failed without waiting for the handler to return.
+	// Note that a handler ignoring its context keeps running after that, so it may run concurrently with the retry of
+	// the task, or after the task is finished, which the handler should be idempotent for
+	Timeout time.Duration
+	// optional, determine whether a failed task is retried by writing it back to 'initialized' with a delayed run_at,
+	// instead of sleeping and retrying inside the process, so that the retry survives process restarts and can be
+	// picked up by any instance
+	PersistentRetry bool
+	// optional, determine whether the task will be cleaned immediately once succeeded, it's archived first if archive
+	// enabled, see WithArchiveTable and WithArchiver
 	CleanSucceeded bool
 	// optional, determine whether the initialized task can still be scheduled after timeout
 	InitTimeoutSensitive bool
@@ -33,6 +69,9 @@ type TaskDefinition struct {
 	argument     interface{}
 	loopInterval time.Duration
 
+	// for periodic task only
+	schedule schedule
+
 	// inner use
 	key TaskKey
 }
@@ -52,10 +91,108 @@ func (s *TaskDefinition) init(key TaskKey) error {
 			return ErrDefInvalidArgument
 		}
 	}
+	if s.Timeout < 0 {
+		return ErrDefInvalidTimeout
+	}
+	if s.MaxConcurrency < 0 || s.MaxGlobalConcurrency < 0 {
+		return ErrDefInvalidConcurrency
+	}
+	if err := s.RateLimit.verify(); err != nil {
+		return err
+	}
+	if s.schedule != nil && s.taskID == 0 {
+		return ErrDefEmptyPrimaryKey
+	}
 	s.key = key
 	return nil
 }
 
+// looped returns whether the task is looped by the monitor, i.e. a built-in task or a periodic task.
+func (s *TaskDefinition) looped() bool {
+	return s.builtin || s.schedule != nil
+}
+
+// RunOptions contains options of creating a single task.
+type RunOptions struct {
+	// optional, the task will not be scheduled before this time if provided
+	RunAt time.Time
+	// optional, tasks with the same task key and dedup key are created only once, the creations afterwards return the
+	// existing task ID along with ErrDuplicateTask, note that it's not supported in dry run mode
+	DedupKey string
+	// optional, the dedup key can be reused once the existing task was created longer than the window ago, never
+	// reused if zero. The dedup key is also released once the existing task is cleaned
+	DedupWindow time.Duration
+	// optional, to replace the priority of the task definition if provided
+	Priority *int
+	// optional, tasks with the same ordering key are run one at a time across the cluster in the order of creation,
+	// even if they have different task keys. They are always claimed by the scan process rather than run once the
+	// transaction is committed. Note that it's not supported in dry run mode
+	OrderingKey string
+
+	// for workflow only
+	workflowRoot    bool
+	workflowID      uint64
+	dependsOn       TaskIDs
+	compensates     uint64
+	groupCompletion bool
+}
+
+func (s *RunOptions) verify() error {
+	if len([]rune(s.DedupKey)) > varchar128MaxLength {
+		return fmt.Errorf("dedup_key exceed max length: %v", s.DedupKey)
+	}
+	if len([]rune(s.OrderingKey)) > varchar128MaxLength {
+		return fmt.Errorf("ordering_key exceed max length: %v", s.OrderingKey)
+	}
+	if s.DedupWindow < 0 {
+		return fmt.Errorf("dedup_window is negative: %v", s.DedupWindow)
+	}
+	return nil
+}
+
+// PeriodicDefinition is a definition of a periodic task, which is executed once per tick across all instances.
+type PeriodicDefinition struct {
+	// must provide, definition of the task executed on every tick, note that CleanSucceeded is ignored
+	TaskDefinition
+	// must provide, cron expression like "*/5 * * * *", descriptor like "@daily" or fixed interval like "@every 5m"
+	Schedule string
+	// optional, task argument passed to the handler on every tick
+	Arg interface{}
+	// optional, fixed task ID in [1000, 9000) to store the task with, which must be unique among the periodic tasks.
+	// It's generated from the task key by default, which may collide with the one of another task key.
+	ID uint64
+}
+
+func (s *PeriodicDefinition) taskDefinition(key TaskKey) (TaskDefinition, error) {
+	sch, err := parseSchedule(s.Schedule)
+	if err != nil {
+		return TaskDefinition{}, fmt.Errorf("%w: %v", ErrDefInvalidSchedule, err)
+	}
+	if sch.next(time.Now()).IsZero() {
+		return TaskDefinition{}, fmt.Errorf("%w: no tick in the future", ErrDefInvalidSchedule)
+	}
+	def := s.TaskDefinition
+	def.CleanSucceeded = false
+	def.taskID = periodicTaskID(key)
+	if s.ID != 0 {
+		if s.ID < periodicTaskIDBase || s.ID >= periodicTaskIDBase+periodicTaskIDRange {
+			return TaskDefinition{}, fmt.Errorf("%w: %v", ErrDefInvalidPrimaryKey, s.ID)
+		}
+		def.taskID = s.ID
+	}
+	def.argument = s.Arg
+	def.schedule = sch
+	return def, nil
+}
+
+// periodicTaskID generates a fixed task ID for a periodic task in [periodicTaskIDBase,
+// periodicTaskIDBase+periodicTaskIDRange), which is below the auto increment start of the task table.
+func periodicTaskID(key TaskKey) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return periodicTaskIDBase + h.Sum64()%periodicTaskIDRange
+}
+
 func (s *TaskDefinition) ctxMarshaler(global CtxMarshaler) CtxMarshaler {
 	if m := s.CtxMarshaler; m != nil {
 		return m
@@ -69,3 +206,10 @@ func (s *TaskDefinition) retryInterval(times int) time.Duration {
 	}
 	return defaultRetryInterval
 }
+
+func (s *TaskDefinition) timeout(global time.Duration) time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return global
+}
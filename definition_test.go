@@ -2,6 +2,8 @@ package gta
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -40,6 +42,27 @@ func TestTaskDefinition_init(t *testing.T) {
 			convey.So(err, convey.ShouldNotBeNil)
 		})
 
+		convey.Convey("negative timeout", func() {
+			taskDef := &TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) { return nil }, Timeout: -1}
+			err := taskDef.init("key")
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("negative concurrency", func() {
+			taskDef := &TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) { return nil }, MaxConcurrency: -1}
+			err := taskDef.init("key")
+			convey.So(errors.Is(err, ErrDefInvalidConcurrency), convey.ShouldBeTrue)
+
+			taskDef = &TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) { return nil }, MaxGlobalConcurrency: -1}
+			err = taskDef.init("key")
+			convey.So(errors.Is(err, ErrDefInvalidConcurrency), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("invalid rate limit", func() {
+			taskDef := &TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) { return nil }, RateLimit: RateLimit{Rate: -1}}
+			err := taskDef.init("key")
+			convey.So(errors.Is(err, ErrDefInvalidRateLimit), convey.ShouldBeTrue)
+		})
 	})
 }
 
@@ -74,3 +97,19 @@ func TestTaskDefinition_retryInterval(t *testing.T) {
 		})
 	})
 }
+
+func TestTaskDefinition_timeout(t *testing.T) {
+	convey.Convey("TestTaskDefinition_timeout", t, func() {
+		convey.So((&TaskDefinition{}).timeout(time.Second), convey.ShouldEqual, time.Second)
+		convey.So((&TaskDefinition{Timeout: time.Minute}).timeout(time.Second), convey.ShouldEqual, time.Minute)
+	})
+}
+
+func TestRunOptions_verify(t *testing.T) {
+	convey.Convey("TestRunOptions_verify", t, func() {
+		convey.So((&RunOptions{DedupKey: "key", DedupWindow: time.Hour}).verify(), convey.ShouldBeNil)
+		convey.So((&RunOptions{DedupKey: strings.Repeat("1", 129)}).verify(), convey.ShouldNotBeNil)
+		convey.So((&RunOptions{DedupWindow: -time.Hour}).verify(), convey.ShouldNotBeNil)
+		convey.So((&RunOptions{OrderingKey: strings.Repeat("1", 129)}).verify(), convey.ShouldNotBeNil)
+	})
+}
@@ -9,6 +9,25 @@ var (
 	ErrUnexpected = errors.New("unexpected")
 	// ErrTaskNotFound represents certain task not found.
 	ErrTaskNotFound = errors.New("task not found")
+	// ErrDuplicateTask represents a task with the same dedup key already exists, which can be treated as success.
+	ErrDuplicateTask = errors.New("duplicate task")
+	// ErrTaskNotCancelable represents the task is neither initialized nor running, so it cannot be canceled.
+	ErrTaskNotCancelable = errors.New("task not cancelable")
+	// ErrWorkflowInvalid represents the workflow is empty or has invalid dependencies.
+	ErrWorkflowInvalid = errors.New("workflow invalid")
+	// ErrTaskTimeout represents the task handler did not finish within its timeout.
+	ErrTaskTimeout = errors.New("task timeout")
+	// ErrLeaseExpired represents the instance running the task lost its lease, e.g. the process crashed.
+	ErrLeaseExpired = errors.New("lease expired")
+	// ErrStoreConflict represents the transaction of the store wrote a record written by another one committed in the
+	// meantime, which can be retried.
+	ErrStoreConflict = errors.New("store transaction conflict")
+	// ErrStoreDuplicateKey represents the record conflicts with an existing one on the primary key or a unique key.
+	ErrStoreDuplicateKey = errors.New("store duplicate key")
+	// ErrSchemaMismatch represents the task table is missing, lacks columns, or is migrated by a newer release.
+	ErrSchemaMismatch = errors.New("schema mismatch")
+	// ErrSchemaUnsupported represents the dialect of the db is not supported by the schema migration.
+	ErrSchemaUnsupported = errors.New("schema unsupported")
 
 	// ErrOption represents option is invalid.
 	ErrOption = errors.New("option invalid")
@@ -21,4 +40,16 @@ var (
 	ErrDefInvalidLoopInterval = errors.New("definition loop interval is invalid")
 	// ErrDefInvalidArgument represents argument in the task definition is invalid.
 	ErrDefInvalidArgument = errors.New("definition argument is invalid")
+	// ErrDefInvalidTimeout represents Timeout in the task definition is invalid.
+	ErrDefInvalidTimeout = errors.New("definition timeout is invalid")
+	// ErrDefInvalidConcurrency represents MaxConcurrency or MaxGlobalConcurrency in the task definition is invalid.
+	ErrDefInvalidConcurrency = errors.New("definition concurrency is invalid")
+	// ErrDefInvalidRateLimit represents RateLimit in the task definition is invalid.
+	ErrDefInvalidRateLimit = errors.New("definition rate limit is invalid")
+	// ErrDefInvalidSchedule represents schedule in the periodic task definition is invalid.
+	ErrDefInvalidSchedule = errors.New("definition schedule is invalid")
+	// ErrDefInvalidPrimaryKey represents ID in the periodic task definition is out of range.
+	ErrDefInvalidPrimaryKey = errors.New("definition primary key is invalid")
+	// ErrDefDuplicatedPrimaryKey represents primary key in the task definition is used by another definition.
+	ErrDefDuplicatedPrimaryKey = errors.New("definition primary key is duplicated")
 )
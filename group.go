@@ -0,0 +1,90 @@
+package gta
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// GroupResult is the argument passed to the completion task of a group, which aggregates the results of the members.
+// The completion task should be registered with it as the argument type.
+type GroupResult struct {
+	// ID of the group, which is the ID of its first member
+	GroupID uint64 `json:"group_id"`
+	// number of the members
+	Total int `json:"total"`
+	// number of the members succeeded, including the ones cleaned
+	Succeeded int `json:"succeeded"`
+	// number of the members failed
+	Failed int `json:"failed"`
+	// number of the members canceled
+	Canceled int `json:"canceled"`
+}
+
+// aggregate counts the finished members of the group, and returns the number of the unfinished ones. The members
+// missing in the table were cleaned after succeeded.
+func (r *GroupResult) aggregate(completionID uint64, tasks []Task, statusMap map[uint64]TaskStatus) int {
+	unfinished := 0
+	r.Failed, r.Canceled = 0, 0
+	for _, t := range tasks {
+		if t.ID == completionID {
+			continue
+		}
+		switch statusMap[t.ID] {
+		case TaskStatusSucceeded:
+		case TaskStatusFailed:
+			r.Failed++
+		case TaskStatusCanceled:
+			r.Canceled++
+		default:
+			unfinished++
+		}
+	}
+	r.Succeeded = r.Total - r.Failed - r.Canceled - unfinished
+	return unfinished
+}
+
+// GroupInfo is the progress of a group.
+type GroupInfo struct {
+	GroupResult
+	// number of the members not finished yet
+	Unfinished int
+	// the completion task, which is 'pending' until all the members finished, nil if cleaned
+	Completion *Task
+}
+
+// newGroupWorkflow converts a group to a workflow, in which the members have no dependencies and the completion task
+// is promoted once all of them finished.
+func newGroupWorkflow(key TaskKey, args []interface{}, onComplete TaskKey) *Workflow {
+	wf := NewWorkflow()
+	if len(args) == 0 {
+		wf.err = fmt.Errorf("%w: empty group", ErrWorkflowInvalid)
+		return wf
+	}
+	for _, arg := range args {
+		wf.Add(key, arg)
+	}
+	node := wf.Add(onComplete, GroupResult{Total: len(args)})
+	wf.nodes[node].groupCompletion = true
+	return wf
+}
+
+func newGroupInfo(id uint64, tasks []Task) (*GroupInfo, error) {
+	info := &GroupInfo{}
+	statusMap := make(map[uint64]TaskStatus, len(tasks))
+	var completionID uint64
+	for i, t := range tasks {
+		statusMap[t.ID] = t.TaskStatus
+		if t.Extra.GroupCompletion {
+			info.Completion, completionID = &tasks[i], t.ID
+		}
+	}
+	if info.Completion == nil {
+		// the completion task has been cleaned
+		info.Total = len(tasks)
+	} else if err := json.Unmarshal(info.Completion.Argument, &info.GroupResult); err != nil {
+		return nil, err
+	}
+	info.GroupID = id
+	info.Unfinished = info.aggregate(completionID, tasks, statusMap)
+	return info, nil
+}
@@ -0,0 +1,36 @@
+package gta
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestGroupResult_aggregate(t *testing.T) {
+	convey.Convey("TestGroupResult_aggregate", t, func() {
+		tasks := []Task{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 5}}
+		statusMap := map[uint64]TaskStatus{1: TaskStatusFailed, 2: TaskStatusRunning, 3: TaskStatusCanceled,
+			5: TaskStatusPending}
+		result := GroupResult{Total: 4}
+		// the member 4 was cleaned after succeeded
+		convey.So(result.aggregate(5, tasks, statusMap), convey.ShouldEqual, 1)
+		convey.So(result, convey.ShouldResemble, GroupResult{Total: 4, Succeeded: 1, Failed: 1, Canceled: 1})
+		statusMap[2] = TaskStatusSucceeded
+		convey.So(result.aggregate(5, tasks, statusMap), convey.ShouldEqual, 0)
+		convey.So(result, convey.ShouldResemble, GroupResult{Total: 4, Succeeded: 2, Failed: 1, Canceled: 1})
+	})
+}
+
+func Test_newGroupWorkflow(t *testing.T) {
+	convey.Convey("Test_newGroupWorkflow", t, func() {
+		wf := newGroupWorkflow("t1", []interface{}{1, 2}, "t2")
+		convey.So(wf.verify(), convey.ShouldBeNil)
+		convey.So(wf.nodes, convey.ShouldResemble, []workflowNode{
+			{key: "t1", arg: 1},
+			{key: "t1", arg: 2},
+			{key: "t2", arg: GroupResult{Total: 2}, groupCompletion: true},
+		})
+		convey.So(errors.Is(newGroupWorkflow("t1", nil, "t2").verify(), ErrWorkflowInvalid), convey.ShouldBeTrue)
+	})
+}
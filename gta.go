@@ -2,6 +2,7 @@ package gta
 
 import (
 	"context"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -25,6 +26,11 @@ func Register(key TaskKey, definition TaskDefinition) {
 	defaultTaskManager.Register(key, definition)
 }
 
+// RegisterPeriodic binds a periodic task definition to a certain task key.
+func RegisterPeriodic(key TaskKey, definition PeriodicDefinition) {
+	defaultTaskManager.RegisterPeriodic(key, definition)
+}
+
 // Run provides the ability to asynchronously run a registered task reliably.
 func Run(ctx context.Context, key TaskKey, arg interface{}) error {
 	return defaultTaskManager.Run(ctx, key, arg)
@@ -35,6 +41,105 @@ func RunWithTx(tx *gorm.DB, ctx context.Context, key TaskKey, arg interface{}) e
 	return defaultTaskManager.RunWithTx(tx, ctx, key, arg)
 }
 
+// RunWithOptions is like Run, but with extra options of the task, and returns the reference of the task created.
+func RunWithOptions(ctx context.Context, key TaskKey, arg interface{}, opts RunOptions) (TaskRef, error) {
+	return defaultTaskManager.RunWithOptions(ctx, key, arg, opts)
+}
+
+// RunWithTxAndOptions is like RunWithTx, but with extra options of the task, and returns the reference of the task
+// created.
+func RunWithTxAndOptions(tx *gorm.DB, ctx context.Context, key TaskKey, arg interface{}, opts RunOptions) (TaskRef,
+	error) {
+	return defaultTaskManager.RunWithTxAndOptions(tx, ctx, key, arg, opts)
+}
+
+// RunBatch is like Run, but creates a task for each argument in one transaction with multi-row inserts.
+func RunBatch(ctx context.Context, key TaskKey, args []interface{}) ([]uint64, error) {
+	return defaultTaskManager.RunBatch(ctx, key, args)
+}
+
+// RunBatchWithTx is like RunWithTx, but creates a task for each argument with multi-row inserts.
+func RunBatchWithTx(tx *gorm.DB, ctx context.Context, key TaskKey, args []interface{}) ([]uint64, error) {
+	return defaultTaskManager.RunBatchWithTx(tx, ctx, key, args)
+}
+
+// RunAt provides the ability to asynchronously run a registered task reliably, but not before the specific time.
+func RunAt(ctx context.Context, key TaskKey, arg interface{}, runAt time.Time) error {
+	return defaultTaskManager.RunAt(ctx, key, arg, runAt)
+}
+
+// RunAtWithTx is like RunWithTx, but the task will not be scheduled before the specific time.
+func RunAtWithTx(tx *gorm.DB, ctx context.Context, key TaskKey, arg interface{}, runAt time.Time) error {
+	return defaultTaskManager.RunAtWithTx(tx, ctx, key, arg, runAt)
+}
+
+// RunAfter provides the ability to asynchronously run a registered task reliably after a delay.
+func RunAfter(ctx context.Context, key TaskKey, arg interface{}, delay time.Duration) error {
+	return defaultTaskManager.RunAfter(ctx, key, arg, delay)
+}
+
+// RunAfterWithTx is like RunWithTx, but the task will not be scheduled until the delay has elapsed.
+func RunAfterWithTx(tx *gorm.DB, ctx context.Context, key TaskKey, arg interface{}, delay time.Duration) error {
+	return defaultTaskManager.RunAfterWithTx(tx, ctx, key, arg, delay)
+}
+
+// Cancel cancels a task which is initialized or running.
+func Cancel(id uint64) error {
+	return defaultTaskManager.Cancel(id)
+}
+
+// GetTask looks up a task by its ID.
+func GetTask(id uint64) (*Task, error) {
+	return defaultTaskManager.GetTask(id)
+}
+
+// RunWorkflow creates all the tasks of a workflow in one transaction, and returns the ID of the workflow.
+func RunWorkflow(ctx context.Context, wf *Workflow) (uint64, error) {
+	return defaultTaskManager.RunWorkflow(ctx, wf)
+}
+
+// RunWorkflowWithTx is like RunWorkflow, but creates the tasks in the transaction passed in.
+func RunWorkflowWithTx(tx *gorm.DB, ctx context.Context, wf *Workflow) (uint64, error) {
+	return defaultTaskManager.RunWorkflowWithTx(tx, ctx, wf)
+}
+
+// RunSaga creates all the tasks of a saga in one transaction, and returns the ID of the saga.
+func RunSaga(ctx context.Context, saga *Saga) (uint64, error) {
+	return defaultTaskManager.RunSaga(ctx, saga)
+}
+
+// RunSagaWithTx is like RunSaga, but creates the tasks in the transaction passed in.
+func RunSagaWithTx(tx *gorm.DB, ctx context.Context, saga *Saga) (uint64, error) {
+	return defaultTaskManager.RunSagaWithTx(tx, ctx, saga)
+}
+
+// RunGroup creates a group of tasks in one transaction, and returns the ID of the group. The completion task is
+// scheduled once all the members finished.
+func RunGroup(ctx context.Context, key TaskKey, args []interface{}, onComplete TaskKey) (uint64, error) {
+	return defaultTaskManager.RunGroup(ctx, key, args, onComplete)
+}
+
+// RunGroupWithTx is like RunGroup, but creates the tasks in the transaction passed in.
+func RunGroupWithTx(tx *gorm.DB, ctx context.Context, key TaskKey, args []interface{}, onComplete TaskKey) (uint64,
+	error) {
+	return defaultTaskManager.RunGroupWithTx(tx, ctx, key, args, onComplete)
+}
+
+// GetGroup looks up the progress of a group by its ID.
+func GetGroup(id uint64) (*GroupInfo, error) {
+	return defaultTaskManager.GetGroup(id)
+}
+
+// GetWorkflow looks up a workflow by its ID.
+func GetWorkflow(id uint64) (*WorkflowInfo, error) {
+	return defaultTaskManager.GetWorkflow(id)
+}
+
+// SetRateLimit adjusts the rate limit of a registered task at runtime.
+func SetRateLimit(key TaskKey, limit RateLimit) error {
+	return defaultTaskManager.SetRateLimit(key, limit)
+}
+
 // Transaction wraps the 'Transaction' function of *gorm.DB
 func Transaction(fc func(tx *gorm.DB) error) (err error) {
 	return defaultTaskManager.Transaction(fc)
@@ -2,7 +2,9 @@ package gta
 
 import (
 	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/panjf2000/ants/v2"
@@ -15,12 +17,15 @@ type TaskManager struct {
 	tr   taskRegister
 	tass taskAssembler
 	tsch taskScheduler
-	tdal taskDAL
+	tdal Store
 	tmon taskMonitor
 	tscn taskScanner
+	trl  taskRateLimiter
+	tarc taskArchiver
 
 	startOnce sync.Once
 	stopOnce  sync.Once
+	started   int32
 }
 
 // Start starts the TaskManager. This function should be called before any other functions in a TaskManager is called.
@@ -31,8 +36,13 @@ func (s *TaskManager) Start() {
 			return
 		}
 		s.registerBuiltinTasks()
+		atomic.StoreInt32(&s.started, 1)
 		s.tscn.GoScanAndSchedule()
-		s.tmon.GoMonitorBuiltinTasks()
+		s.tmon.GoMonitorLoopTasks()
+		if s.leaseEnabled() {
+			s.tsch.GoRenewLeases()
+		}
+		s.tsch.GoWatchCancellation()
 		time.Sleep(time.Second)
 	})
 }
@@ -45,11 +55,31 @@ func (s *TaskManager) Start() {
 // Handler must be provided in the task definition. It would be better to provide the argument type additionally, unless
 // you want to use the default argument type(i.e. map[string]interface{} for struct) inside the handler.
 func (s *TaskManager) Register(key TaskKey, definition TaskDefinition) {
+	if (definition.RateLimit.Global || definition.MaxGlobalConcurrency > 0) && s.rateLimitTable == "" {
+		panic(fmt.Errorf("%w: rateLimitTable is not set, task_key: %v", ErrOption, key))
+	}
 	if err := s.tr.Register(key, definition); err != nil {
 		panic(err)
 	}
 }
 
+// RegisterPeriodic binds a periodic task definition to a certain task key. The task is executed once per tick of the
+// schedule across all instances, which is guaranteed by the row lock of its fixed task record. Ticks missed because of
+// a previous long-running execution or a downtime are skipped rather than caught up.
+//
+// The schedule can be a standard 5-field cron expression(e.g. "*/5 * * * *"), a descriptor(e.g. "@daily") or a fixed
+// interval(e.g. "@every 5m"). Periodic tasks are not scheduled in dry run mode. It panics if the task ID generated from
+// the key collides with the one of another periodic task, which can be resolved by an explicit ID in the definition.
+func (s *TaskManager) RegisterPeriodic(key TaskKey, definition PeriodicDefinition) {
+	if err := s.tr.RegisterPeriodic(key, definition); err != nil {
+		panic(err)
+	}
+	if atomic.LoadInt32(&s.started) == 1 {
+		// registered after start
+		s.tmon.GoMonitorLoopTasks()
+	}
+}
+
 // Run provides the ability to asynchronously run a registered task reliably. It's an alternative to using 'go func(
 // ){}' when you need to care about the ultimate success of a task.
 //
@@ -66,7 +96,8 @@ func (s *TaskManager) Run(ctx context.Context, key TaskKey, arg interface{}) err
 
 // RunWithTx makes it possible to create a task along with other database operations in the same transaction. The task
 // will be scheduled if the transaction is committed successfully, or canceled if the transaction is rolled backs. Thus,
-// this is a simple implement for BASE that can be used in distributed transaction situations.
+// this is a simple implement for BASE that can be used in distributed transaction situations. See RunSaga if the later
+// steps may fail and the previous ones need to be compensated.
 //
 // The task will be scheduled immediately after the transaction is committed if you use the builtin 'Transaction'
 // function below. Otherwise, it will be scheduled later in the scan process.
@@ -89,7 +120,80 @@ func (s *TaskManager) Run(ctx context.Context, key TaskKey, arg interface{}) err
 // })
 //
 func (s *TaskManager) RunWithTx(tx *gorm.DB, ctx context.Context, key TaskKey, arg interface{}) error {
-	return s.tsch.CreateTask(tx, ctx, key, arg)
+	_, err := s.tsch.CreateTask(tx, ctx, key, arg, RunOptions{})
+	return err
+}
+
+// RunWithOptions is like Run, but with extra options of the task, and returns the reference of the task created. Use it
+// with empty options if you need to know the ID of the task.
+//
+// If a dedup key is provided and a task with the same task key and dedup key already exists, no task will be created.
+// The reference of the existing task is returned along with an error wrapping ErrDuplicateTask, which can be treated as
+// success by callers, e.g. when an upstream retries the same business event. Note that the transaction may be aborted
+// if the task with the same dedup key is created concurrently, e.g. in PostgreSQL, in which case it should be rolled
+// back rather than committed.
+func (s *TaskManager) RunWithOptions(ctx context.Context, key TaskKey, arg interface{}, opts RunOptions) (TaskRef,
+	error) {
+	var ref TaskRef
+	err := s.Transaction(func(tx *gorm.DB) (err error) {
+		ref, err = s.RunWithTxAndOptions(tx, ctx, key, arg, opts)
+		return err
+	})
+	return ref, err
+}
+
+// RunWithTxAndOptions is like RunWithTx, but with extra options of the task, and returns the reference of the task
+// created. See RunWithOptions for more information.
+func (s *TaskManager) RunWithTxAndOptions(tx *gorm.DB, ctx context.Context, key TaskKey, arg interface{},
+	opts RunOptions) (TaskRef, error) {
+	taskID, err := s.tsch.CreateTask(tx, ctx, key, arg, opts)
+	if taskID == 0 {
+		return TaskRef{}, err
+	}
+	return TaskRef{ID: taskID, Key: key}, err
+}
+
+// RunBatch is like Run, but creates a task for each argument in one transaction with multi-row inserts, which is much
+// faster than calling Run for each argument. The IDs of the tasks are returned in the order of the arguments. The tasks
+// within the free capacity of the pool are scheduled once the transaction is committed, and the others are scheduled
+// later in the scan process.
+func (s *TaskManager) RunBatch(ctx context.Context, key TaskKey, args []interface{}) ([]uint64, error) {
+	var taskIDs []uint64
+	err := s.Transaction(func(tx *gorm.DB) (err error) {
+		taskIDs, err = s.RunBatchWithTx(tx, ctx, key, args)
+		return err
+	})
+	return taskIDs, err
+}
+
+// RunBatchWithTx is like RunWithTx, but creates a task for each argument with multi-row inserts. See RunBatch for more
+// information.
+func (s *TaskManager) RunBatchWithTx(tx *gorm.DB, ctx context.Context, key TaskKey, args []interface{}) ([]uint64,
+	error) {
+	return s.tsch.CreateTasks(tx, ctx, key, args)
+}
+
+// RunAt is like Run, but the task will not be scheduled before the specific time. The time is persisted along with the
+// task, so a delayed task survives process restarts and will be scheduled by the scan process once it is due.
+func (s *TaskManager) RunAt(ctx context.Context, key TaskKey, arg interface{}, runAt time.Time) error {
+	return s.Transaction(func(tx *gorm.DB) error { return s.RunAtWithTx(tx, ctx, key, arg, runAt) })
+}
+
+// RunAtWithTx is like RunWithTx, but the task will not be scheduled before the specific time.
+func (s *TaskManager) RunAtWithTx(tx *gorm.DB, ctx context.Context, key TaskKey, arg interface{}, runAt time.Time) error {
+	_, err := s.tsch.CreateTask(tx, ctx, key, arg, RunOptions{RunAt: runAt})
+	return err
+}
+
+// RunAfter is like Run, but the task will not be scheduled until the duration has elapsed.
+func (s *TaskManager) RunAfter(ctx context.Context, key TaskKey, arg interface{}, delay time.Duration) error {
+	return s.RunAt(ctx, key, arg, time.Now().Add(delay))
+}
+
+// RunAfterWithTx is like RunWithTx, but the task will not be scheduled until the duration has elapsed.
+func (s *TaskManager) RunAfterWithTx(tx *gorm.DB, ctx context.Context, key TaskKey, arg interface{},
+	delay time.Duration) error {
+	return s.RunAtWithTx(tx, ctx, key, arg, time.Now().Add(delay))
 }
 
 // Transaction wraps the 'Transaction' function of *gorm.DB, providing the ability to schedule the tasks created inside
@@ -101,9 +205,10 @@ func (s *TaskManager) Transaction(fc func(tx *gorm.DB) error) (err error) {
 // Stop provides the ability to gracefully stop current running tasks. If you cannot tolerate task failure or loss in
 // cases when a termination signal is received or the pod is migrated, it would be better to explicitly call this
 // function before the main process exits. Otherwise, these tasks are easily to be killed and will be reported by
-// abnormal task check process later.
+// abnormal task check process later, or reclaimed by other instances once their leases expire if 'LeaseTimeout' is set.
 //
-// The wait parameter determines whether to wait for all running tasks to complete.
+// The wait parameter determines whether to wait for all running tasks to complete. Note that the contexts passed to
+// the running task handlers are canceled once this function is called, so that they can abort cooperatively.
 func (s *TaskManager) Stop(wait bool) {
 	s.stopOnce.Do(func() {
 		if !s.dryRun {
@@ -131,34 +236,242 @@ func (s *TaskManager) ForceRerunTasks(taskIDs []uint64, status TaskStatus) (int6
 	return s.tdal.UpdateStatusByIDs(s.getDB(), taskIDs, status, TaskStatusInitialized)
 }
 
-// QueryUnsuccessfulTasks checks initialized, running or failed tasks.
+// Cancel cancels a task which is initialized or running. An initialized task is changed to 'canceled' immediately and
+// will never be scheduled. For a running task, the instance running it is notified through a flag in the database
+// within the scan interval, and then the context passed to the handler is canceled, so that the handler can abort
+// cooperatively. The running task is marked 'canceled' without further retries once the handler returns, unless it
+// succeeded. ErrTaskNotCancelable is returned if the task has already finished.
+//
+// Only the tasks running in current instance can be canceled in dry run mode.
+func (s *TaskManager) Cancel(id uint64) error {
+	return s.tsch.CancelTask(id)
+}
+
+// GetTask looks up a task by its ID, ErrTaskNotFound is returned if the task does not exist or has been cleaned. It's
+// not available in dry run mode.
+func (s *TaskManager) GetTask(id uint64) (*Task, error) {
+	task, err := s.tdal.Get(s.getDB(), id)
+	if err != nil {
+		return nil, err
+	} else if task == nil {
+		return nil, ErrTaskNotFound
+	}
+	return task, nil
+}
+
+// RunWorkflow creates all the tasks of a workflow in one transaction, and returns the ID of the workflow, which is the
+// ID of its first task. A task in the workflow is 'pending' until all its parents succeeded, and it's marked failed or
+// canceled with the upstream task recorded in 'Extra.Upstream' once any of its parents terminally failed or was
+// canceled. It's not available in dry run mode.
+func (s *TaskManager) RunWorkflow(ctx context.Context, wf *Workflow) (uint64, error) {
+	var workflowID uint64
+	err := s.Transaction(func(tx *gorm.DB) (err error) {
+		workflowID, err = s.RunWorkflowWithTx(tx, ctx, wf)
+		return err
+	})
+	return workflowID, err
+}
+
+// RunWorkflowWithTx is like RunWorkflow, but creates the tasks in the transaction passed in.
+func (s *TaskManager) RunWorkflowWithTx(tx *gorm.DB, ctx context.Context, wf *Workflow) (uint64, error) {
+	if s.dryRun {
+		return 0, fmt.Errorf("%w: not available in dry run mode", ErrWorkflowInvalid)
+	}
+	if err := wf.verify(); err != nil {
+		return 0, err
+	}
+
+	var workflowID uint64
+	taskIDs := make([]uint64, len(wf.nodes))
+	for i, node := range wf.nodes {
+		opts := RunOptions{workflowRoot: i == 0, workflowID: workflowID}
+		for _, parent := range node.parents {
+			opts.dependsOn = append(opts.dependsOn, taskIDs[parent])
+		}
+		if node.compensating {
+			opts.compensates = taskIDs[node.compensates]
+		}
+		opts.groupCompletion = node.groupCompletion
+		taskID, err := s.tsch.CreateTask(tx, ctx, node.key, node.arg, opts)
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 {
+			workflowID = taskID
+		}
+		taskIDs[i] = taskID
+	}
+	return workflowID, nil
+}
+
+// RunSaga creates all the tasks of a saga in one transaction, and returns the ID of the saga, which can be looked up by
+// GetWorkflow. The steps are run one by one, and once a step terminally failed or was canceled, the compensating tasks
+// of the previous steps are run in reverse order, each after the previous one succeeded. The compensating tasks not
+// needed are deleted once the saga finished. It's not available in dry run mode.
+func (s *TaskManager) RunSaga(ctx context.Context, saga *Saga) (uint64, error) {
+	return s.RunWorkflow(ctx, saga.workflow())
+}
+
+// RunSagaWithTx is like RunSaga, but creates the tasks in the transaction passed in.
+func (s *TaskManager) RunSagaWithTx(tx *gorm.DB, ctx context.Context, saga *Saga) (uint64, error) {
+	return s.RunWorkflowWithTx(tx, ctx, saga.workflow())
+}
+
+// RunGroup creates a group of tasks with the same task key in one transaction, one for each argument, and returns the ID
+// of the group, which is the ID of its first member. Once all the members finished, i.e. succeeded, failed or canceled,
+// the completion task is scheduled with a GroupResult as its argument, which aggregates the results of the members. The
+// progress of the group can be looked up by GetGroup. It's not available in dry run mode.
+func (s *TaskManager) RunGroup(ctx context.Context, key TaskKey, args []interface{}, onComplete TaskKey) (uint64,
+	error) {
+	return s.RunWorkflow(ctx, newGroupWorkflow(key, args, onComplete))
+}
+
+// RunGroupWithTx is like RunGroup, but creates the tasks in the transaction passed in.
+func (s *TaskManager) RunGroupWithTx(tx *gorm.DB, ctx context.Context, key TaskKey, args []interface{},
+	onComplete TaskKey) (uint64, error) {
+	return s.RunWorkflowWithTx(tx, ctx, newGroupWorkflow(key, args, onComplete))
+}
+
+// GetGroup looks up the progress of a group by its ID, ErrTaskNotFound is returned if all the tasks in the group have
+// been cleaned. It's not available in dry run mode.
+func (s *TaskManager) GetGroup(id uint64) (*GroupInfo, error) {
+	tasks, err := s.tdal.GetSliceByWorkflowID(s.getDB(), id)
+	if err != nil {
+		return nil, err
+	} else if len(tasks) == 0 {
+		return nil, ErrTaskNotFound
+	}
+	return newGroupInfo(id, tasks)
+}
+
+// GetWorkflow looks up a workflow by its ID, ErrTaskNotFound is returned if all the tasks in the workflow have been
+// cleaned. It's not available in dry run mode.
+func (s *TaskManager) GetWorkflow(id uint64) (*WorkflowInfo, error) {
+	tasks, err := s.tdal.GetSliceByWorkflowID(s.getDB(), id)
+	if err != nil {
+		return nil, err
+	} else if len(tasks) == 0 {
+		return nil, ErrTaskNotFound
+	}
+	return &WorkflowInfo{ID: id, Status: workflowStatus(tasks), Tasks: tasks}, nil
+}
+
+// SetRateLimit adjusts the rate limit of a registered task at runtime, which replaces the 'RateLimit' in the task
+// definition. It only takes effect in current instance, so it should be called in every instance to adjust a global
+// rate limit, e.g. on the change of a configuration center.
+func (s *TaskManager) SetRateLimit(key TaskKey, limit RateLimit) error {
+	if _, err := s.tr.GetDefinition(key); err != nil {
+		return err
+	}
+	if err := limit.verify(); err != nil {
+		return err
+	}
+	if limit.Global && s.rateLimitTable == "" {
+		return fmt.Errorf("%w: rateLimitTable is not set", ErrOption)
+	}
+	s.trl.SetLimit(key, limit)
+	return nil
+}
+
+// QueryUnsuccessfulTasks checks initialized, running, failed or canceled tasks. The attempt history of each task,
+// including the errors and the instances that ran it, is available in the 'Extra' field.
 func (s *TaskManager) QueryUnsuccessfulTasks(limit, offset int) ([]Task, error) {
 	return s.tdal.GetSliceExcludeSucceeded(s.getDB(), s.tr.GetBuiltInKeys(), limit, offset)
 }
 
+// QueryDeadLetterTasks checks the tasks in the dead letter table, which are moved there once failed if the
+// 'DeadLetterTable' option is set.
+func (s *TaskManager) QueryDeadLetterTasks(limit, offset int) ([]Task, error) {
+	if s.deadLetterTable == "" {
+		return nil, fmt.Errorf("%w: deadLetterTable is not set", ErrOption)
+	}
+	return s.tdal.GetDeadLetterSlice(s.getDB(), limit, offset)
+}
+
+// QueryArchivedTasks checks the tasks in the archive table, which are moved there once cleaned if the 'ArchiveTable'
+// option is set.
+func (s *TaskManager) QueryArchivedTasks(limit, offset int) ([]Task, error) {
+	if s.archiveTable == "" {
+		return nil, fmt.Errorf("%w: archiveTable is not set", ErrOption)
+	}
+	return s.tdal.GetArchiveSlice(s.getDB(), limit, offset)
+}
+
+// ReplayDeadLetterTasks moves specific tasks in the dead letter table back to the task table as 'initialized', which
+// will be scheduled later in the scan process with a full retry budget. The task IDs and attempt histories are
+// reserved. It returns the number of tasks replayed, and the tasks not found in the dead letter table are ignored.
+func (s *TaskManager) ReplayDeadLetterTasks(taskIDs []uint64) (int64, error) {
+	if s.deadLetterTable == "" {
+		return 0, fmt.Errorf("%w: deadLetterTable is not set", ErrOption)
+	}
+	var replayed int64
+	for _, id := range taskIDs {
+		if err := s.tdal.Transaction(s.getDB(), func(tx StoreTx) error {
+			task, err := s.tdal.GetDeadLetter(tx, id)
+			if err != nil {
+				return err
+			} else if task == nil {
+				return nil
+			}
+			timeNow := time.Now()
+			task.TaskStatus, task.RunAt, task.UpdatedAt = TaskStatusInitialized, timeNow, timeNow
+			task.LeaseOwner, task.LeaseExpireAt, task.CancelRequested = "", nil, false
+			task.Extra.Retries = 0
+			if err := s.tdal.Create(tx, task); err != nil {
+				return err
+			}
+			if rowsAffected, err := s.tdal.DeleteDeadLetterByID(tx, id); err != nil {
+				return err
+			} else if rowsAffected == 0 {
+				return ErrZeroRowsAffected
+			}
+			replayed++
+			return nil
+		}); err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
 func (s *TaskManager) registerBuiltinTasks() {
 	registerCleanUpTask(s)
 	registerCheckAbnormalTask(s)
+	registerAdvanceWorkflowTask(s)
 }
 
 // NewTaskManager generates a new instance of TaskManager.
 //
 // The database and task table must be provided because this tool relies heavily on the database. For more information
-// about the table schema, please refer to 'model.sql'.
+// about the table schema, please refer to 'model.sql', or create and upgrade the table by Migrate. Another storage can
+// be used instead with WithStore, e.g. the MemoryStore, in which case the db can be nil.
 func NewTaskManager(db *gorm.DB, table string, options ...Option) *TaskManager {
 	opts, err := newOptions(db, table, options...)
 	if err != nil {
 		panic(err)
 	}
+	if opts.schemaCheck && opts.store == nil {
+		if err := VerifySchema(opts.db, opts.table); err != nil {
+			panic(err)
+		}
+	}
 	tr := opts.taskRegister
-	tdal := &taskDALImp{options: opts}
+	var tdal Store = &taskDALImp{options: opts}
+	if opts.store != nil {
+		tdal = opts.store
+	}
 	tass := &taskAssemblerImp{options: opts}
 	pool, err := ants.NewPool(opts.poolSize, ants.WithLogger(opts.logger()), ants.WithNonblocking(true))
 	if err != nil {
 		panic(err)
 	}
-	tsch := &taskSchedulerImp{options: opts, register: tr, dal: tdal, assembler: tass, pool: pool}
+	trl := &taskRateLimiterImp{options: opts, register: tr, dal: tdal}
+	tarc := &taskArchiverImp{options: opts, dal: tdal}
+	scanSignal := newSignal()
+	tsch := &taskSchedulerImp{options: opts, register: tr, dal: tdal, assembler: tass, limiter: trl, archiver: tarc,
+		pool: pool, scanSignal: scanSignal, finishSignal: newSignal()}
 	tmon := &taskMonitorImp{options: opts, register: tr, dal: tdal, assembler: tass}
-	tscn := &taskScannerImp{options: opts, register: tr, dal: tdal, scheduler: tsch}
-	return &TaskManager{options: opts, tr: tr, tass: tass, tsch: tsch, tdal: tdal, tmon: tmon, tscn: tscn}
+	tscn := &taskScannerImp{options: opts, register: tr, dal: tdal, scheduler: tsch, wakeUp: scanSignal}
+	return &TaskManager{options: opts, tr: tr, tass: tass, tsch: tsch, tdal: tdal, tmon: tmon, tscn: tscn, trl: trl,
+		tarc: tarc}
 }
@@ -3,9 +3,13 @@ package gta
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -35,7 +39,7 @@ func TestTaskManager_Start(t *testing.T) {
 			m := NewTaskManager(testDB("TestTaskManager_Start"), "tasks")
 			m.Start()
 			defer m.Stop(false)
-			convey.So(m.tr.GetBuiltInKeys(), convey.ShouldHaveLength, 2)
+			convey.So(m.tr.GetBuiltInKeys(), convey.ShouldHaveLength, 3)
 			task, err := m.tdal.Get(m.getDB(), taskCheckAbnormalID)
 			convey.So(err, convey.ShouldBeNil)
 			convey.So(task, convey.ShouldNotBeNil)
@@ -86,6 +90,41 @@ func (t *testGinCtxMarshaler) UnmarshalCtx(bytes []byte) (context.Context, error
 	return ctx, nil
 }
 
+func TestTaskManager_RegisterPeriodic(t *testing.T) {
+	convey.Convey("TestTaskManager_RegisterPeriodic", t, func() {
+		db := testDB("TestTaskManager_RegisterPeriodic")
+		var t1Run int64
+		managers := make([]*TaskManager, 3)
+		startTime := time.Now()
+		for i := range managers {
+			managers[i] = NewTaskManager(db, "tasks", WithScanInterval(time.Second))
+			if i == 0 {
+				// register before start
+				managers[i].RegisterPeriodic("t1", PeriodicDefinition{
+					TaskDefinition: TaskDefinition{Handler: testCountHandler(&t1Run)}, Schedule: "@every 1s",
+				})
+				managers[i].Start()
+			} else {
+				// register after start
+				managers[i].Start()
+				managers[i].RegisterPeriodic("t1", PeriodicDefinition{
+					TaskDefinition: TaskDefinition{Handler: testCountHandler(&t1Run)}, Schedule: "@every 1s",
+				})
+			}
+		}
+		time.Sleep(time.Second * 5)
+		for _, m := range managers {
+			m.Stop(true)
+		}
+		// at most one execution per tick
+		convey.So(atomic.LoadInt64(&t1Run), convey.ShouldBeBetweenOrEqual, 1, int64(time.Since(startTime)/time.Second))
+		task, err := managers[0].tdal.Get(db, periodicTaskID("t1"))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(task, convey.ShouldNotBeNil)
+		convey.So(task.TaskKey, convey.ShouldEqual, "t1")
+	})
+}
+
 func TestTaskManager_Run(t *testing.T) {
 	convey.Convey("TestTaskManager_Run", t, func() {
 		convey.Convey("normal", func() {
@@ -109,7 +148,7 @@ func TestTaskManager_Run(t *testing.T) {
 				var t1Run int64
 				m.Register("t1", TaskDefinition{
 					Handler: testWrappedHandler(func(ctx context.Context, arg interface{}) (err error) {
-						_ = ctx.(*gin.Context)
+						// the unmarshaled context is wrapped with cancellation, values are still available
 						_ = ctx.Value("request_id").(string)
 						return nil
 					}, testCountHandler(&t1Run)),
@@ -135,6 +174,17 @@ func TestTaskManager_Run(t *testing.T) {
 				m.Stop(true)
 				convey.So(err, convey.ShouldBeNil)
 				convey.So(t1Run, convey.ShouldEqual, 4)
+				task, err := m.tdal.Get(m.getDB(), 10001)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+				convey.So(task.Extra.Attempts, convey.ShouldEqual, 4)
+				convey.So(task.Extra.AttemptRecords, convey.ShouldHaveLength, 4)
+				for i, r := range task.Extra.AttemptRecords {
+					convey.So(r.Attempt, convey.ShouldEqual, i+1)
+					convey.So(r.Instance, convey.ShouldEqual, m.instanceID)
+					convey.So(r.Error, convey.ShouldContainSubstring, ErrUnexpected.Error())
+					convey.So(r.FinishedAt, convey.ShouldHappenOnOrAfter, r.StartedAt)
+				}
 			})
 
 			convey.Convey("with RetryInterval", func() {
@@ -165,6 +215,65 @@ func TestTaskManager_Run(t *testing.T) {
 				convey.So(sub, convey.ShouldBeLessThan, time.Second)
 			})
 
+			convey.Convey("with PersistentRetry", func() {
+				m := NewTaskManager(testDB("TestTaskManager_Run"), "tasks", WithScanInterval(time.Second))
+				var t1Run int64
+				m.Register("t1", TaskDefinition{
+					Handler: testWrappedHandler(testCountHandler(&t1Run), func(ctx context.Context, arg interface{}) (err error) {
+						return ErrUnexpected
+					}),
+					RetryTimes:      2,
+					RetryInterval:   func(times int) time.Duration { return time.Millisecond * 100 },
+					PersistentRetry: true,
+				})
+				m.Start()
+				err := m.Run(context.TODO(), "t1", nil)
+				convey.So(err, convey.ShouldBeNil)
+				time.Sleep(time.Millisecond * 50)
+				task, err := m.tdal.Get(m.getDB(), 10001)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
+				convey.So(task.Extra.Retries, convey.ShouldEqual, 1)
+				time.Sleep(time.Second * 2)
+				m.Stop(true)
+				convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 3)
+				task, err = m.tdal.Get(m.getDB(), 10001)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+				convey.So(task.Extra.Attempts, convey.ShouldEqual, 3)
+				convey.So(task.Extra.Retries, convey.ShouldEqual, 0)
+			})
+
+			convey.Convey("with PersistentRetry across restarts", func() {
+				m := NewTaskManager(testDB("TestTaskManager_Run"), "tasks", WithScanInterval(time.Second))
+				var t1Run int64
+				m.Register("t1", TaskDefinition{
+					Handler: testWrappedHandler(testCountHandler(&t1Run), func(ctx context.Context, arg interface{}) (err error) {
+						return ErrUnexpected
+					}),
+					RetryTimes:      1,
+					RetryInterval:   func(times int) time.Duration { return time.Second },
+					PersistentRetry: true,
+				})
+				m.Start()
+				err := m.Run(context.TODO(), "t1", nil)
+				convey.So(err, convey.ShouldBeNil)
+				m.Stop(true)
+				convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 1)
+
+				var t2Run int64
+				m2 := NewTaskManager(m.getDB(), "tasks", WithScanInterval(time.Second))
+				m2.Register("t1", TaskDefinition{Handler: testCountHandler(&t2Run), RetryTimes: 1, PersistentRetry: true})
+				m2.Start()
+				time.Sleep(time.Second * 2)
+				m2.Stop(true)
+				convey.So(atomic.LoadInt64(&t2Run), convey.ShouldEqual, 1)
+				task, err := m2.tdal.Get(m2.getDB(), 10001)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+				convey.So(task.Extra.Attempts, convey.ShouldEqual, 2)
+			})
+
 			convey.Convey("with CleanSucceeded", func() {
 				var t1Run int64
 				m.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run), CleanSucceeded: true})
@@ -242,7 +351,13 @@ func TestTaskManager_Run(t *testing.T) {
 		convey.Convey("full pool", func() {
 			m := NewTaskManager(testDB("TestTaskManager_Run"), "tasks", WithPoolSize(5))
 			var t1Run int64
-			m.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run)})
+			// hold the workers, otherwise the freed ones wake up the scanner to claim the remaining tasks
+			release := make(chan struct{})
+			m.Register("t1", TaskDefinition{Handler: testWrappedHandler(testCountHandler(&t1Run),
+				func(ctx context.Context, arg interface{}) error {
+					<-release
+					return nil
+				})})
 			m.Start()
 			var errSlice []error
 			for i := 0; i < 10; i++ {
@@ -251,10 +366,12 @@ func TestTaskManager_Run(t *testing.T) {
 					errSlice = append(errSlice, err)
 				}
 			}
+			time.Sleep(100 * time.Millisecond)
+			task, err := m.tdal.Get(m.getDB(), 10010)
+			close(release)
 			m.Stop(true)
 			convey.So(errSlice, convey.ShouldHaveLength, 0)
-			convey.So(t1Run, convey.ShouldBeLessThan, 10)
-			task, err := m.tdal.Get(m.getDB(), 10010)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldBeLessThan, 10)
 			convey.So(err, convey.ShouldBeNil)
 			convey.So(task, convey.ShouldNotBeNil)
 			convey.So(task.TaskKey, convey.ShouldEqual, "t1")
@@ -302,7 +419,6 @@ func TestTaskManager_Run(t *testing.T) {
 				var t1Run int64
 				m.Register("t1", TaskDefinition{Handler: testWrappedHandler(testCountHandler(&t1Run), func(ctx context.Context, arg interface{}) (err error) {
 					panic("panic inside task handler")
-					return nil
 				})})
 				m.Start()
 				err := m.Run(context.TODO(), "t1", nil)
@@ -313,6 +429,8 @@ func TestTaskManager_Run(t *testing.T) {
 				convey.So(err, convey.ShouldBeNil)
 				convey.So(task, convey.ShouldNotBeNil)
 				convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+				convey.So(task.Extra.LastError(), convey.ShouldContainSubstring, "panic inside task handler")
+				convey.So(task.Extra.LastError(), convey.ShouldContainSubstring, "goroutine")
 			})
 		})
 
@@ -425,6 +543,183 @@ func TestTaskManager_RunWithTx(t *testing.T) {
 	})
 }
 
+func TestTaskManager_WakeUp(t *testing.T) {
+	convey.Convey("TestTaskManager_WakeUp", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_WakeUp"), "tasks", WithScanInterval(time.Second*5))
+		var t1Run int64
+		m.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run)})
+		m.Start()
+		// let the scan process back off to the scan interval
+		time.Sleep(time.Second * 6)
+		err := m.getDB().Transaction(func(tx *gorm.DB) error {
+			return m.RunWithTx(tx, context.TODO(), "t1", nil)
+		})
+		convey.So(err, convey.ShouldBeNil)
+		time.Sleep(time.Second)
+		convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 1)
+		m.Stop(true)
+	})
+}
+
+func TestTaskManager_RunAt(t *testing.T) {
+	convey.Convey("TestTaskManager_RunAt", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_RunAt"), "tasks", WithScanInterval(time.Second),
+			WithInstantScanInterval(time.Millisecond*100))
+		var t1Run int64
+		m.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run)})
+
+		convey.Convey("builtin transaction", func() {
+			m.Start()
+			err := m.RunAfter(context.TODO(), "t1", nil, time.Second)
+			convey.So(err, convey.ShouldBeNil)
+			task, err := m.tdal.Get(m.getDB(), 10001)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task, convey.ShouldNotBeNil)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
+			time.Sleep(time.Millisecond * 500)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 0)
+			time.Sleep(time.Second * 2)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("not builtin transaction", func() {
+			m.Start()
+			err := m.getDB().Transaction(func(tx *gorm.DB) error {
+				return m.RunAtWithTx(tx, context.TODO(), "t1", nil, time.Now().Add(time.Hour))
+			})
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Second * 2)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 0)
+			task, err := m.tdal.Get(m.getDB(), 10001)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task, convey.ShouldNotBeNil)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
+		})
+	})
+}
+
+func TestTaskManager_RunWithOptions(t *testing.T) {
+	convey.Convey("TestTaskManager_RunWithOptions", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_RunWithOptions"), "tasks")
+		var t1Run, t2Run int64
+		m.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run)})
+		m.Register("t2", TaskDefinition{Handler: testCountHandler(&t2Run)})
+		m.Start()
+
+		convey.Convey("dedup", func() {
+			ref1, err := m.RunWithOptions(context.TODO(), "t1", nil, RunOptions{DedupKey: "event_1"})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(ref1, convey.ShouldResemble, TaskRef{ID: 10001, Key: "t1"})
+			ref2, err := m.RunWithOptions(context.TODO(), "t1", nil, RunOptions{DedupKey: "event_1"})
+			convey.So(errors.Is(err, ErrDuplicateTask), convey.ShouldBeTrue)
+			convey.So(ref2, convey.ShouldResemble, ref1)
+			err = m.Transaction(func(tx *gorm.DB) error {
+				ref2, err = m.RunWithTxAndOptions(tx, context.TODO(), "t1", nil, RunOptions{DedupKey: "event_1"})
+				return err
+			})
+			convey.So(errors.Is(err, ErrDuplicateTask), convey.ShouldBeTrue)
+			convey.So(ref2, convey.ShouldResemble, ref1)
+			ref3, err := m.RunWithOptions(context.TODO(), "t2", nil, RunOptions{DedupKey: "event_1"})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(ref3.ID, convey.ShouldNotEqual, ref1.ID)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 1)
+			convey.So(atomic.LoadInt64(&t2Run), convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("dedup window", func() {
+			ref1, err := m.RunWithOptions(context.TODO(), "t1", nil, RunOptions{DedupKey: "event_1", DedupWindow: time.Second})
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Millisecond * 1100)
+			ref2, err := m.RunWithOptions(context.TODO(), "t1", nil, RunOptions{DedupKey: "event_1", DedupWindow: time.Second})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(ref2.ID, convey.ShouldNotEqual, ref1.ID)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 2)
+		})
+
+		convey.Convey("priority", func() {
+			m.Register("t3", TaskDefinition{Handler: testCountHandler(&t1Run), Priority: 5})
+			runAt := time.Now().Add(time.Hour)
+			ref1, err := m.RunWithOptions(context.TODO(), "t3", nil, RunOptions{RunAt: runAt})
+			convey.So(err, convey.ShouldBeNil)
+			priority := -1
+			ref2, err := m.RunWithOptions(context.TODO(), "t3", nil, RunOptions{RunAt: runAt, Priority: &priority})
+			convey.So(err, convey.ShouldBeNil)
+			task1, _ := m.GetTask(ref1.ID)
+			convey.So(task1.Priority, convey.ShouldEqual, 5)
+			task2, _ := m.GetTask(ref2.ID)
+			convey.So(task2.Priority, convey.ShouldEqual, -1)
+			m.Stop(true)
+		})
+
+		convey.Convey("invalid options", func() {
+			_, err := m.RunWithOptions(context.TODO(), "t1", nil, RunOptions{DedupWindow: -time.Second})
+			convey.So(err, convey.ShouldNotBeNil)
+			m.Stop(true)
+		})
+	})
+}
+
+func TestTaskManager_RunBatch(t *testing.T) {
+	convey.Convey("TestTaskManager_RunBatch", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_RunBatch"), "tasks", WithPoolSize(2),
+			WithScanInterval(time.Millisecond*200))
+		var t1Run int64
+		release := make(chan struct{})
+		m.Register("t1", TaskDefinition{
+			Handler: testWrappedHandler(func(ctx context.Context, arg interface{}) (err error) {
+				<-release
+				return nil
+			}, testCountHandler(&t1Run)),
+			ArgType: reflect.TypeOf(0),
+		})
+		countByStatus := func(status TaskStatus) int64 {
+			var count int64
+			m.getDB().Table("tasks").Where("task_key = ? AND task_status = ?", "t1", status).Count(&count)
+			return count
+		}
+
+		convey.Convey("builtin transaction", func() {
+			taskIDs, err := m.RunBatch(context.TODO(), "t1", []interface{}{1, 2, 3, 4, 5})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(taskIDs, convey.ShouldResemble, []uint64{10001, 10002, 10003, 10004, 10005})
+			// only the tasks within the pool capacity are run at once
+			convey.So(countByStatus(TaskStatusRunning), convey.ShouldEqual, 2)
+			convey.So(countByStatus(TaskStatusInitialized), convey.ShouldEqual, 3)
+			task, err := m.GetTask(10003)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(task.Argument), convey.ShouldEqual, "3")
+			m.Start()
+			close(release)
+			for i := 0; i < 30 && atomic.LoadInt64(&t1Run) < 5; i++ {
+				time.Sleep(time.Millisecond * 200)
+			}
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 5)
+		})
+
+		convey.Convey("other transaction", func() {
+			close(release)
+			err := m.getDB().Transaction(func(tx *gorm.DB) error {
+				taskIDs, err := m.RunBatchWithTx(tx, context.TODO(), "t1", []interface{}{1, 2, 3})
+				convey.So(taskIDs, convey.ShouldHaveLength, 3)
+				return err
+			})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(countByStatus(TaskStatusInitialized), convey.ShouldEqual, 3)
+			taskIDs, err := m.RunBatch(context.TODO(), "t1", nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(taskIDs, convey.ShouldBeEmpty)
+			_, err = m.RunBatch(context.TODO(), "t1", []interface{}{"1"})
+			convey.So(err, convey.ShouldNotBeNil)
+			m.Stop(true)
+		})
+	})
+}
+
 func TestTaskManager_Transaction(t *testing.T) {
 	convey.Convey("TestTaskManager_Transaction", t, func() {
 		m := NewTaskManager(testDB("TestTaskManager_Transaction"), "tasks")
@@ -448,7 +743,10 @@ func TestTaskManager_Stop(t *testing.T) {
 				m.Register("t1", TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) { return nil }})
 				m.Start()
 				err := m.Run(context.TODO(), "t1", nil)
+				stopStart := time.Now()
 				m.Stop(true)
+				// notified once the task finished instead of polling
+				convey.So(time.Since(stopStart), convey.ShouldBeLessThan, stopGracePeriod)
 				convey.So(err, convey.ShouldBeNil)
 				task, err := m.tdal.Get(m.getDB(), 10001)
 				convey.So(err, convey.ShouldBeNil)
@@ -472,6 +770,25 @@ func TestTaskManager_Stop(t *testing.T) {
 			})
 		})
 
+		convey.Convey("reclaimed by others", func() {
+			m := NewTaskManager(testDB("TestTaskManager_Stop"), "tasks", WithWaitTimeout(time.Millisecond),
+				WithLeaseTimeout(time.Minute))
+			m.Register("t1", TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) {
+				time.Sleep(time.Second * 6)
+				return nil
+			}})
+			m.Start()
+			err := m.Run(context.TODO(), "t1", nil)
+			convey.So(err, convey.ShouldBeNil)
+			// the lease of current instance expired and the task is reclaimed by i2
+			m.getDB().Table("tasks").Where("id = ?", 10001).Update("lease_owner", "i2")
+			m.Stop(false)
+			task, err := m.tdal.Get(m.getDB(), 10001)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusRunning)
+			convey.So(task.LeaseOwner, convey.ShouldEqual, "i2")
+		})
+
 		convey.Convey("dry run", func() {
 			m := NewTaskManager(testDB("TestTaskManager_Stop"), "tasks", WithWaitTimeout(time.Millisecond), WithDryRun(true))
 			m.Register("t1", TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) {
@@ -489,6 +806,145 @@ func TestTaskManager_Stop(t *testing.T) {
 	})
 }
 
+func TestTaskManager_LeaseTimeout(t *testing.T) {
+	convey.Convey("TestTaskManager_LeaseTimeout", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_LeaseTimeout"), "tasks", WithScanInterval(time.Second),
+			WithLeaseTimeout(time.Second), WithMaxReclaimTimes(1))
+		var t1Run int64
+		m.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run)})
+		expired := time.Now().Add(-time.Second)
+
+		convey.Convey("renew", func() {
+			m.Register("t2", TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) {
+				time.Sleep(time.Second * 3)
+				return nil
+			}})
+			m.Start()
+			err := m.Run(context.TODO(), "t2", nil)
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Second * 2)
+			task, err := m.tdal.Get(m.getDB(), 10001)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusRunning)
+			convey.So(task.LeaseOwner, convey.ShouldEqual, m.instanceID)
+			convey.So(task.LeaseExpireAt.After(time.Now()), convey.ShouldBeTrue)
+			m.Stop(true)
+			task, _ = m.tdal.Get(m.getDB(), 10001)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+			convey.So(task.Extra.Reclaims, convey.ShouldEqual, 0)
+		})
+
+		convey.Convey("reclaim orphan", func() {
+			_ = m.tdal.Create(m.getDB(), &Task{ID: 10001, TaskKey: "t1", TaskStatus: TaskStatusRunning, RunAt: expired,
+				LeaseOwner: "crashed", LeaseExpireAt: &expired})
+			m.Start()
+			time.Sleep(time.Second * 3)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 1)
+			task, _ := m.tdal.Get(m.getDB(), 10001)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+			convey.So(task.Extra.Reclaims, convey.ShouldEqual, 1)
+			convey.So(task.Extra.AttemptRecords, convey.ShouldHaveLength, 2)
+			convey.So(task.Extra.AttemptRecords[0].Instance, convey.ShouldEqual, "crashed")
+			convey.So(task.Extra.AttemptRecords[0].Error, convey.ShouldNotBeEmpty)
+		})
+
+		convey.Convey("max reclaim times exceeded", func() {
+			var onFailedRun int64
+			var onFailedErr error
+			m.Register("t3", TaskDefinition{Handler: testCountHandler(&t1Run),
+				OnFailed: func(ctx context.Context, arg interface{}, err error) {
+					atomic.AddInt64(&onFailedRun, 1)
+					onFailedErr = err
+				}})
+			_ = m.tdal.Create(m.getDB(), &Task{ID: 10001, TaskKey: "t3", TaskStatus: TaskStatusRunning, RunAt: expired,
+				LeaseOwner: "crashed", LeaseExpireAt: &expired, Extra: TaskExtra{Reclaims: 1}})
+			m.Start()
+			time.Sleep(time.Second * 3)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 0)
+			task, _ := m.tdal.Get(m.getDB(), 10001)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+			convey.So(task.Extra.LastError(), convey.ShouldNotBeEmpty)
+			convey.So(atomic.LoadInt64(&onFailedRun), convey.ShouldEqual, 1)
+			convey.So(errors.Is(onFailedErr, ErrLeaseExpired), convey.ShouldBeTrue)
+		})
+	})
+}
+
+func TestTaskManager_Timeout(t *testing.T) {
+	convey.Convey("TestTaskManager_Timeout", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_Timeout"), "tasks", WithTaskTimeout(time.Hour))
+		var t1Run int64
+		m.Register("t1", TaskDefinition{
+			Handler: func(ctx context.Context, arg interface{}) (err error) {
+				atomic.AddInt64(&t1Run, 1)
+				time.Sleep(time.Hour)
+				return nil
+			},
+			Timeout:    time.Millisecond * 500,
+			RetryTimes: 1,
+			RetryInterval: func(times int) time.Duration {
+				return time.Millisecond * 100
+			},
+		})
+		m.Register("t2", TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) {
+			<-ctx.Done()
+			return ctx.Err()
+		}})
+		m.Register("t3", TaskDefinition{
+			Handler: func(ctx context.Context, arg interface{}) (err error) {
+				// derived from the unmarshaled context
+				_ = ctx.Value("request_id").(string)
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			CtxMarshaler: &testGinCtxMarshaler{},
+			Timeout:      time.Millisecond * 500,
+		})
+
+		convey.Convey("timeout exceeded", func() {
+			m.Start()
+			err := m.Run(context.TODO(), "t1", nil)
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Second * 2)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 2)
+			task, err := m.tdal.Get(m.getDB(), 10001)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+			convey.So(task.Extra.Attempts, convey.ShouldEqual, 2)
+			convey.So(task.Extra.LastError(), convey.ShouldContainSubstring, ErrTaskTimeout.Error())
+		})
+
+		convey.Convey("canceled by stop", func() {
+			m.Start()
+			err := m.Run(context.TODO(), "t2", nil)
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Millisecond * 500)
+			startTime := time.Now()
+			m.Stop(true)
+			convey.So(time.Since(startTime), convey.ShouldBeLessThan, time.Second*10)
+			task, err := m.tdal.Get(m.getDB(), 10001)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+			convey.So(task.Extra.LastError(), convey.ShouldContainSubstring, context.Canceled.Error())
+		})
+
+		convey.Convey("with ctxMarshaler", func() {
+			m.Start()
+			err := m.Run(context.WithValue(context.TODO(), "request_id", "10086"), "t3", nil)
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Second)
+			m.Stop(true)
+			task, err := m.tdal.Get(m.getDB(), 10001)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+			convey.So(task.Extra.LastError(), convey.ShouldContainSubstring, ErrTaskTimeout.Error())
+		})
+	})
+}
+
 func TestTaskManager_ForceRerunTasks(t *testing.T) {
 	m := NewTaskManager(testDB("TestTaskManager_ForceRerunTasks"), "tasks")
 	var t1Run int64
@@ -510,6 +966,669 @@ func TestTaskManager_ForceRerunTasks(t *testing.T) {
 	})
 }
 
+func TestTaskManager_Cancel(t *testing.T) {
+	convey.Convey("TestTaskManager_Cancel", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_Cancel"), "tasks", WithScanInterval(time.Second))
+		var t1Run int64
+		m.Register("t1", TaskDefinition{
+			Handler: testWrappedHandler(testCountHandler(&t1Run), func(ctx context.Context, arg interface{}) (err error) {
+				<-ctx.Done()
+				return ctx.Err()
+			}),
+			RetryTimes: 3,
+		})
+		m.Start()
+
+		convey.Convey("initialized", func() {
+			err := m.RunAfter(context.TODO(), "t1", nil, time.Hour)
+			convey.So(err, convey.ShouldBeNil)
+			err = m.Cancel(10001)
+			convey.So(err, convey.ShouldBeNil)
+			m.Stop(true)
+			task, _ := m.GetTask(10001)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusCanceled)
+			convey.So(task.Extra.CanceledAt, convey.ShouldNotBeNil)
+			convey.So(errors.Is(m.Cancel(10001), ErrTaskNotCancelable), convey.ShouldBeTrue)
+			convey.So(m.Cancel(10002), convey.ShouldEqual, ErrTaskNotFound)
+		})
+
+		convey.Convey("running", func() {
+			err := m.Run(context.TODO(), "t1", nil)
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Millisecond * 500)
+			err = m.Cancel(10001)
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Millisecond * 500)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 1)
+			task, _ := m.GetTask(10001)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusCanceled)
+			convey.So(task.Extra.CanceledAt, convey.ShouldNotBeNil)
+			convey.So(task.Extra.LastError(), convey.ShouldContainSubstring, context.Canceled.Error())
+		})
+
+		convey.Convey("running with ctxMarshaler", func() {
+			m.Register("t2", TaskDefinition{
+				Handler: func(ctx context.Context, arg interface{}) (err error) {
+					// no timeout is set, the context is still done once canceled
+					<-ctx.Done()
+					return ctx.Err()
+				},
+				CtxMarshaler: &testGinCtxMarshaler{},
+			})
+			err := m.Run(context.WithValue(context.TODO(), "request_id", "10086"), "t2", nil)
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Millisecond * 500)
+			err = m.Cancel(10001)
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Millisecond * 500)
+			m.Stop(true)
+			task, _ := m.GetTask(10001)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusCanceled)
+			convey.So(task.Extra.LastError(), convey.ShouldContainSubstring, context.Canceled.Error())
+		})
+
+		convey.Convey("running in another instance", func() {
+			m2 := NewTaskManager(m.getDB(), "tasks")
+			err := m.Run(context.TODO(), "t1", nil)
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Millisecond * 500)
+			err = m2.Cancel(10001)
+			convey.So(err, convey.ShouldBeNil)
+			time.Sleep(time.Second * 2)
+			task, _ := m.GetTask(10001)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusCanceled)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 1)
+		})
+	})
+}
+
+func testConcurrencyHandler(running, maxRunning, count *int64) TaskHandler {
+	return func(ctx context.Context, arg interface{}) (err error) {
+		n := atomic.AddInt64(running, 1)
+		for m := atomic.LoadInt64(maxRunning); n > m && !atomic.CompareAndSwapInt64(maxRunning, m, n); {
+			m = atomic.LoadInt64(maxRunning)
+		}
+		time.Sleep(time.Millisecond * 500)
+		atomic.AddInt64(running, -1)
+		atomic.AddInt64(count, 1)
+		return nil
+	}
+}
+
+func TestTaskManager_Concurrency(t *testing.T) {
+	convey.Convey("TestTaskManager_Concurrency", t, func() {
+		convey.Convey("max concurrency", func() {
+			m := NewTaskManager(testDB("TestTaskManager_Concurrency"), "tasks", WithScanInterval(time.Second))
+			var running, maxRunning, t1Run int64
+			m.Register("t1", TaskDefinition{Handler: testConcurrencyHandler(&running, &maxRunning, &t1Run), MaxConcurrency: 1})
+			m.Start()
+			for i := 0; i < 3; i++ {
+				err := m.Run(context.TODO(), "t1", nil)
+				convey.So(err, convey.ShouldBeNil)
+			}
+			for i := 0; i < 20 && atomic.LoadInt64(&t1Run) < 3; i++ {
+				time.Sleep(time.Millisecond * 500)
+			}
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 3)
+			convey.So(atomic.LoadInt64(&maxRunning), convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("max global concurrency", func() {
+			db := testDB("TestTaskManager_Concurrency")
+			_ = db.Table("tasks_rate_limit").AutoMigrate(&RateLimitToken{})
+			var running, maxRunning, t1Run int64
+			managers := make([]*TaskManager, 2)
+			for i := range managers {
+				managers[i] = NewTaskManager(db, "tasks", WithScanInterval(time.Second), WithRateLimitTable("tasks_rate_limit"))
+				managers[i].Register("t1", TaskDefinition{Handler: testConcurrencyHandler(&running, &maxRunning, &t1Run), MaxGlobalConcurrency: 1})
+				managers[i].Start()
+			}
+			for i := 0; i < 4; i++ {
+				err := managers[i%2].Run(context.TODO(), "t1", nil)
+				convey.So(err, convey.ShouldBeNil)
+			}
+			for i := 0; i < 30 && atomic.LoadInt64(&t1Run) < 4; i++ {
+				time.Sleep(time.Millisecond * 500)
+			}
+			for _, m := range managers {
+				m.Stop(true)
+			}
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 4)
+			convey.So(atomic.LoadInt64(&maxRunning), convey.ShouldEqual, 1)
+		})
+	})
+}
+
+func TestTaskManager_RateLimit(t *testing.T) {
+	convey.Convey("TestTaskManager_RateLimit", t, func() {
+		convey.Convey("rate limited", func() {
+			m := NewTaskManager(testDB("TestTaskManager_RateLimit"), "tasks", WithScanInterval(time.Second))
+			var t1Run int64
+			var mu sync.Mutex
+			var timeSlice []time.Time
+			m.Register("t1", TaskDefinition{
+				Handler: testWrappedHandler(testCountHandler(&t1Run), func(ctx context.Context, arg interface{}) (err error) {
+					mu.Lock()
+					defer mu.Unlock()
+					timeSlice = append(timeSlice, time.Now())
+					return nil
+				}),
+				RateLimit: RateLimit{Rate: 2, Burst: 1},
+			})
+			m.Start()
+			for i := 0; i < 4; i++ {
+				err := m.Run(context.TODO(), "t1", nil)
+				convey.So(err, convey.ShouldBeNil)
+			}
+			for i := 0; i < 20 && atomic.LoadInt64(&t1Run) < 4; i++ {
+				time.Sleep(time.Millisecond * 500)
+			}
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 4)
+			convey.So(timeSlice[3].Sub(timeSlice[0]), convey.ShouldBeGreaterThanOrEqualTo, time.Millisecond*1400)
+		})
+
+		convey.Convey("set rate limit", func() {
+			m := NewTaskManager(testDB("TestTaskManager_RateLimit"), "tasks")
+			handler := func(ctx context.Context, arg interface{}) (err error) { return nil }
+			convey.So(func() {
+				m.Register("t1", TaskDefinition{Handler: handler, RateLimit: RateLimit{Rate: 1, Global: true}})
+			}, convey.ShouldPanic)
+			m.Register("t1", TaskDefinition{Handler: handler})
+			convey.So(m.SetRateLimit("t1", RateLimit{Rate: 1}), convey.ShouldBeNil)
+			convey.So(m.SetRateLimit("t2", RateLimit{Rate: 1}), convey.ShouldNotBeNil)
+			convey.So(m.SetRateLimit("t1", RateLimit{Rate: -1}), convey.ShouldEqual, ErrDefInvalidRateLimit)
+			convey.So(errors.Is(m.SetRateLimit("t1", RateLimit{Rate: 1, Global: true}), ErrOption), convey.ShouldBeTrue)
+		})
+	})
+}
+
+func TestTaskManager_OrderingKey(t *testing.T) {
+	convey.Convey("TestTaskManager_OrderingKey", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_OrderingKey"), "tasks", WithScanInterval(time.Second))
+		var running, maxRunning, tRun int64
+		var mu sync.Mutex
+		var args []int
+		handler := testWrappedHandler(testConcurrencyHandler(&running, &maxRunning, &tRun), func(ctx context.Context, arg interface{}) (err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			args = append(args, arg.(int))
+			return nil
+		})
+		m.Register("t1", TaskDefinition{Handler: handler, ArgType: reflect.TypeOf(0)})
+		m.Register("t2", TaskDefinition{Handler: handler, ArgType: reflect.TypeOf(0)})
+		m.Start()
+		opts := RunOptions{OrderingKey: "order_1"}
+		for i := 0; i < 2; i++ {
+			_, err := m.RunWithOptions(context.TODO(), "t1", i, opts)
+			convey.So(err, convey.ShouldBeNil)
+		}
+		err := m.Transaction(func(tx *gorm.DB) error {
+			for i := 2; i < 4; i++ {
+				if _, err := m.RunWithTxAndOptions(tx, context.TODO(), "t2", i, opts); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		convey.So(err, convey.ShouldBeNil)
+		for i := 0; i < 30 && atomic.LoadInt64(&tRun) < 4; i++ {
+			time.Sleep(time.Millisecond * 500)
+		}
+		m.Stop(true)
+		convey.So(atomic.LoadInt64(&tRun), convey.ShouldEqual, 4)
+		convey.So(atomic.LoadInt64(&maxRunning), convey.ShouldEqual, 1)
+		convey.So(args, convey.ShouldResemble, []int{0, 1, 2, 3})
+	})
+}
+
+func TestTaskManager_OrderingKeyConcurrently(t *testing.T) {
+	convey.Convey("TestTaskManager_OrderingKeyConcurrently", t, func() {
+		m := NewTaskManager(nil, "tasks", WithStore(NewMemoryStore()), WithScanInterval(time.Second))
+		var running, maxRunning, tRun int64
+		m.Register("t1", TaskDefinition{Handler: testConcurrencyHandler(&running, &maxRunning, &tRun)})
+		m.Start()
+		opts := RunOptions{OrderingKey: "order_1"}
+		err := m.Transaction(func(tx *gorm.DB) error {
+			if _, err := m.RunWithTxAndOptions(tx, context.TODO(), "t1", nil, opts); err != nil {
+				return err
+			}
+			// created by another one and committed in the meantime
+			_, err := m.RunWithOptions(context.TODO(), "t1", nil, opts)
+			return err
+		})
+		convey.So(err, convey.ShouldBeNil)
+		for i := 0; i < 30 && atomic.LoadInt64(&tRun) < 2; i++ {
+			time.Sleep(time.Millisecond * 500)
+		}
+		m.Stop(true)
+		convey.So(atomic.LoadInt64(&tRun), convey.ShouldEqual, 2)
+		convey.So(atomic.LoadInt64(&maxRunning), convey.ShouldEqual, 1)
+	})
+}
+
+func TestTaskManager_Workflow(t *testing.T) {
+	convey.Convey("TestTaskManager_Workflow", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_Workflow"), "tasks", WithScanInterval(time.Millisecond*200))
+		var mu sync.Mutex
+		var args []int
+		handler := func(ctx context.Context, arg interface{}) (err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			args = append(args, arg.(int))
+			if arg.(int) < 0 {
+				return ErrUnexpected
+			}
+			return nil
+		}
+		m.Register("t1", TaskDefinition{Handler: handler, ArgType: reflect.TypeOf(0)})
+		m.Register("t2", TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) {
+			time.Sleep(time.Millisecond * 500)
+			return nil
+		}})
+		m.Start()
+		defer m.Stop(true)
+		waitWorkflow := func(id uint64) *WorkflowInfo {
+			for i := 0; i < 30; i++ {
+				if info, err := m.GetWorkflow(id); err == nil && info.Status != TaskStatusRunning &&
+					info.Status != TaskStatusInitialized {
+					return info
+				}
+				time.Sleep(time.Millisecond * 200)
+			}
+			info, _ := m.GetWorkflow(id)
+			return info
+		}
+
+		convey.Convey("invalid", func() {
+			_, err := m.RunWorkflow(context.TODO(), NewWorkflow())
+			convey.So(errors.Is(err, ErrWorkflowInvalid), convey.ShouldBeTrue)
+			wf := NewWorkflow()
+			wf.Add("t1", 1, 1)
+			_, err = m.RunWorkflow(context.TODO(), wf)
+			convey.So(errors.Is(err, ErrWorkflowInvalid), convey.ShouldBeTrue)
+			_, err = m.GetWorkflow(1)
+			convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+		})
+
+		convey.Convey("succeeded", func() {
+			wf := NewWorkflow()
+			a := wf.Add("t1", 1)
+			b := wf.Add("t1", 2)
+			wf.Add("t1", 3, a, b)
+			id, err := m.RunWorkflow(context.TODO(), wf)
+			convey.So(err, convey.ShouldBeNil)
+			info := waitWorkflow(id)
+			convey.So(info.Status, convey.ShouldEqual, TaskStatusSucceeded)
+			convey.So(len(info.Tasks), convey.ShouldEqual, 3)
+			convey.So(info.Tasks[2].DependsOn, convey.ShouldResemble, TaskIDs{info.Tasks[0].ID, info.Tasks[1].ID})
+			convey.So(len(args), convey.ShouldEqual, 3)
+			convey.So(args[2], convey.ShouldEqual, 3)
+		})
+
+		convey.Convey("failed", func() {
+			wf := NewWorkflow()
+			a := wf.Add("t1", -1)
+			b := wf.Add("t1", 1, a)
+			wf.Add("t1", 2, b)
+			id, err := m.RunWorkflow(context.TODO(), wf)
+			convey.So(err, convey.ShouldBeNil)
+			info := waitWorkflow(id)
+			convey.So(info.Status, convey.ShouldEqual, TaskStatusFailed)
+			convey.So(args, convey.ShouldResemble, []int{-1})
+			convey.So(info.Tasks[1].TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+			convey.So(info.Tasks[1].Extra.Upstream, convey.ShouldEqual, info.Tasks[0].ID)
+			convey.So(info.Tasks[2].TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+			convey.So(info.Tasks[2].Extra.Upstream, convey.ShouldEqual, info.Tasks[1].ID)
+		})
+
+		convey.Convey("canceled", func() {
+			wf := NewWorkflow()
+			a := wf.Add("t2", nil)
+			wf.Add("t1", 1, a)
+			var id uint64
+			err := m.Transaction(func(tx *gorm.DB) (err error) {
+				id, err = m.RunWorkflowWithTx(tx, context.TODO(), wf)
+				return err
+			})
+			convey.So(err, convey.ShouldBeNil)
+			info, err := m.GetWorkflow(id)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(info.Tasks[1].TaskStatus, convey.ShouldEqual, TaskStatusPending)
+			convey.So(m.Cancel(info.Tasks[1].ID), convey.ShouldBeNil)
+			info = waitWorkflow(id)
+			convey.So(info.Status, convey.ShouldEqual, TaskStatusCanceled)
+			convey.So(info.Tasks[0].TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+		})
+
+		convey.Convey("resumed", func() {
+			// the process exited after the first task succeeded, and before the workflow was advanced
+			m2 := NewTaskManager(testDB("TestTaskManager_Workflow_resumed"), "tasks")
+			m2.Register("t1", TaskDefinition{Handler: handler, ArgType: reflect.TypeOf(0)})
+			wf := NewWorkflow()
+			a := wf.Add("t1", 1)
+			wf.Add("t1", 2, a)
+			var id uint64
+			err := m2.getDB().Transaction(func(tx *gorm.DB) (err error) {
+				id, err = m2.RunWorkflowWithTx(tx, context.TODO(), wf)
+				return err
+			})
+			convey.So(err, convey.ShouldBeNil)
+			_, _ = m2.tdal.UpdateStatusByIDs(m2.getDB(), []uint64{id}, TaskStatusInitialized, TaskStatusSucceeded)
+			ids, err := m2.tdal.GetPendingWorkflowIDs(m2.getDB(), 0)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(ids, convey.ShouldResemble, []uint64{id})
+			convey.So(advanceWorkflowHandler(m2)(context.TODO(), advanceWorkflowReq{}), convey.ShouldBeNil)
+			info, err := m2.GetWorkflow(id)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(info.Tasks[1].TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
+			ids, _ = m2.tdal.GetPendingWorkflowIDs(m2.getDB(), 0)
+			convey.So(ids, convey.ShouldBeEmpty)
+		})
+	})
+}
+
+func TestTaskManager_Saga(t *testing.T) {
+	convey.Convey("TestTaskManager_Saga", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_Saga"), "tasks", WithScanInterval(time.Millisecond*200))
+		var mu sync.Mutex
+		var steps []string
+		handler := func(name string) TaskHandler {
+			return func(ctx context.Context, arg interface{}) (err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				steps = append(steps, fmt.Sprintf("%v:%v", name, arg))
+				if name == "forward" && arg.(int) < 0 {
+					return ErrUnexpected
+				}
+				return nil
+			}
+		}
+		m.Register("forward", TaskDefinition{Handler: handler("forward"), ArgType: reflect.TypeOf(0)})
+		m.Register("compensate", TaskDefinition{Handler: handler("compensate"), ArgType: reflect.TypeOf(0)})
+		m.Start()
+		defer m.Stop(true)
+		waitSaga := func(id uint64) *WorkflowInfo {
+			for i := 0; i < 30; i++ {
+				if info, err := m.GetWorkflow(id); err == nil && info.Status != TaskStatusRunning &&
+					info.Status != TaskStatusInitialized {
+					return info
+				}
+				time.Sleep(time.Millisecond * 200)
+			}
+			info, _ := m.GetWorkflow(id)
+			return info
+		}
+
+		convey.Convey("succeeded", func() {
+			saga := NewSaga().AddStep("forward", "compensate", 1).AddStep("forward", "compensate", 2).
+				AddStep("forward", "compensate", 3)
+			id, err := m.RunSaga(context.TODO(), saga)
+			convey.So(err, convey.ShouldBeNil)
+			info := waitSaga(id)
+			convey.So(info.Status, convey.ShouldEqual, TaskStatusSucceeded)
+			convey.So(steps, convey.ShouldResemble, []string{"forward:1", "forward:2", "forward:3"})
+			// the compensating tasks not needed are deleted
+			convey.So(len(info.Tasks), convey.ShouldEqual, 3)
+		})
+
+		convey.Convey("compensated", func() {
+			saga := NewSaga().AddStep("forward", "compensate", 1).AddStep("forward", "", 2).
+				AddStep("forward", "compensate", 3).AddStep("forward", "compensate", -4).AddStep("forward", "compensate", 5)
+			id, err := m.RunSaga(context.TODO(), saga)
+			convey.So(err, convey.ShouldBeNil)
+			info := waitSaga(id)
+			convey.So(info.Status, convey.ShouldEqual, TaskStatusFailed)
+			convey.So(steps, convey.ShouldResemble, []string{"forward:1", "forward:2", "forward:3", "forward:-4",
+				"compensate:3", "compensate:1"})
+			convey.So(len(info.Tasks), convey.ShouldEqual, 7)
+			convey.So(info.Tasks[4].TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+			convey.So(info.Tasks[4].Extra.Upstream, convey.ShouldEqual, info.Tasks[3].ID)
+			convey.So(info.Tasks[5].Extra.Compensates, convey.ShouldEqual, info.Tasks[2].ID)
+			convey.So(info.Tasks[6].Extra.Compensates, convey.ShouldEqual, info.Tasks[0].ID)
+		})
+
+		convey.Convey("resumed", func() {
+			// the process exited after the second step failed, and before the saga was advanced
+			m2 := NewTaskManager(testDB("TestTaskManager_Saga_resumed"), "tasks")
+			m2.Register("forward", TaskDefinition{Handler: handler("forward"), ArgType: reflect.TypeOf(0)})
+			m2.Register("compensate", TaskDefinition{Handler: handler("compensate"), ArgType: reflect.TypeOf(0)})
+			saga := NewSaga().AddStep("forward", "compensate", 1).AddStep("forward", "compensate", 2)
+			var id uint64
+			err := m2.getDB().Transaction(func(tx *gorm.DB) (err error) {
+				id, err = m2.RunSagaWithTx(tx, context.TODO(), saga)
+				return err
+			})
+			convey.So(err, convey.ShouldBeNil)
+			_, _ = m2.tdal.UpdateStatusByIDs(m2.getDB(), []uint64{id}, TaskStatusInitialized, TaskStatusSucceeded)
+			_, _ = m2.tdal.UpdateStatusByIDs(m2.getDB(), []uint64{id + 1}, TaskStatusPending, TaskStatusFailed)
+			ids, err := m2.tdal.GetPendingWorkflowIDs(m2.getDB(), 0)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(ids, convey.ShouldResemble, []uint64{id})
+			convey.So(m2.tsch.AdvanceWorkflowByID(id), convey.ShouldBeNil)
+			info, err := m2.GetWorkflow(id)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(info.Status, convey.ShouldEqual, TaskStatusRunning)
+			convey.So(info.Tasks[2].TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
+			convey.So(info.Tasks[2].Extra.Compensates, convey.ShouldEqual, id)
+		})
+	})
+}
+
+func TestTaskManager_Group(t *testing.T) {
+	convey.Convey("TestTaskManager_Group", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_Group"), "tasks", WithScanInterval(time.Millisecond*200))
+		var t1Run int64
+		results := make(chan GroupResult, 1)
+		m.Register("t1", TaskDefinition{
+			Handler: testWrappedHandler(testCountHandler(&t1Run), func(ctx context.Context, arg interface{}) (err error) {
+				if arg.(int) < 0 {
+					return ErrUnexpected
+				}
+				return nil
+			}),
+			ArgType: reflect.TypeOf(0),
+		})
+		m.Register("t2", TaskDefinition{
+			Handler: func(ctx context.Context, arg interface{}) (err error) {
+				results <- arg.(GroupResult)
+				return nil
+			},
+			ArgType: reflect.TypeOf(GroupResult{}),
+		})
+
+		convey.Convey("invalid", func() {
+			_, err := m.RunGroup(context.TODO(), "t1", nil, "t2")
+			convey.So(errors.Is(err, ErrWorkflowInvalid), convey.ShouldBeTrue)
+			_, err = m.GetGroup(1)
+			convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+		})
+
+		convey.Convey("completed", func() {
+			id, err := m.RunGroup(context.TODO(), "t1", []interface{}{1, -2, 3}, "t2")
+			convey.So(err, convey.ShouldBeNil)
+			info, err := m.GetGroup(id)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(info.Total, convey.ShouldEqual, 3)
+			convey.So(info.Completion.TaskKey, convey.ShouldEqual, "t2")
+
+			m.Start()
+			defer m.Stop(true)
+			var result GroupResult
+			select {
+			case result = <-results:
+			case <-time.After(time.Second * 10):
+			}
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 3)
+			convey.So(result, convey.ShouldResemble, GroupResult{GroupID: id, Total: 3, Succeeded: 2, Failed: 1})
+			info, err = m.GetGroup(id)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(info.Unfinished, convey.ShouldEqual, 0)
+			convey.So(info.GroupResult, convey.ShouldResemble, result)
+		})
+	})
+}
+
+func TestTaskManager_DeadLetter(t *testing.T) {
+	convey.Convey("TestTaskManager_DeadLetter", t, func() {
+		db := testDB("TestTaskManager_DeadLetter")
+		// index names are unique in a sqlite database, so only the table is copied
+		var ddl string
+		db.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'tasks'").Scan(&ddl)
+		err := db.Exec(strings.Replace(ddl, "`tasks`", "`tasks_dead_letter`", 1)).Error
+		convey.So(err, convey.ShouldBeNil)
+		var t1Run, onFailedRun int64
+		var onFailedErr error
+		taskDef := TaskDefinition{
+			Handler: testWrappedHandler(testCountHandler(&t1Run), func(ctx context.Context, arg interface{}) (err error) {
+				return ErrUnexpected
+			}),
+			RetryTimes: 1,
+			RetryInterval: func(times int) time.Duration {
+				return time.Millisecond * 100
+			},
+			OnFailed: func(ctx context.Context, arg interface{}, err error) {
+				atomic.AddInt64(&onFailedRun, 1)
+				onFailedErr = err
+			},
+		}
+
+		convey.Convey("without dead letter table", func() {
+			m := NewTaskManager(db, "tasks")
+			m.Register("t1", taskDef)
+			m.Start()
+			err := m.Run(context.TODO(), "t1", nil)
+			convey.So(err, convey.ShouldBeNil)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&onFailedRun), convey.ShouldEqual, 1)
+			convey.So(errors.Is(onFailedErr, ErrUnexpected), convey.ShouldBeTrue)
+			task, err := m.GetTask(10001)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+			_, err = m.QueryDeadLetterTasks(10, 0)
+			convey.So(errors.Is(err, ErrOption), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("move and replay", func() {
+			m := NewTaskManager(db, "tasks", WithDeadLetterTable("tasks_dead_letter"))
+			m.Register("t1", taskDef)
+			m.Start()
+			err := m.Run(context.TODO(), "t1", nil)
+			convey.So(err, convey.ShouldBeNil)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 2)
+			convey.So(atomic.LoadInt64(&onFailedRun), convey.ShouldEqual, 1)
+			_, err = m.GetTask(10001)
+			convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+			deadTasks, err := m.QueryDeadLetterTasks(10, 0)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(deadTasks, convey.ShouldHaveLength, 1)
+			convey.So(deadTasks[0].ID, convey.ShouldEqual, 10001)
+			convey.So(deadTasks[0].TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+			convey.So(deadTasks[0].Extra.Attempts, convey.ShouldEqual, 2)
+
+			var t1Rerun int64
+			m2 := NewTaskManager(db, "tasks", WithDeadLetterTable("tasks_dead_letter"), WithScanInterval(time.Second))
+			m2.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Rerun)})
+			replayed, err := m2.ReplayDeadLetterTasks([]uint64{10001, 10002})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(replayed, convey.ShouldEqual, 1)
+			m2.Start()
+			time.Sleep(time.Second * 2)
+			m2.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Rerun), convey.ShouldEqual, 1)
+			task, err := m2.GetTask(10001)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+			convey.So(task.Extra.Attempts, convey.ShouldEqual, 3)
+			deadTasks, _ = m2.QueryDeadLetterTasks(10, 0)
+			convey.So(deadTasks, convey.ShouldHaveLength, 0)
+		})
+
+		convey.Convey("max reclaim times exceeded", func() {
+			m := NewTaskManager(db, "tasks", WithDeadLetterTable("tasks_dead_letter"), WithScanInterval(time.Second),
+				WithLeaseTimeout(time.Second), WithMaxReclaimTimes(0))
+			m.Register("t1", taskDef)
+			expired := time.Now().Add(-time.Second)
+			_ = m.tdal.Create(m.getDB(), &Task{ID: 10001, TaskKey: "t1", TaskStatus: TaskStatusRunning, RunAt: expired,
+				LeaseOwner: "crashed", LeaseExpireAt: &expired})
+			m.Start()
+			time.Sleep(time.Second * 2)
+			m.Stop(true)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 0)
+			convey.So(atomic.LoadInt64(&onFailedRun), convey.ShouldEqual, 1)
+			convey.So(errors.Is(onFailedErr, ErrLeaseExpired), convey.ShouldBeTrue)
+			_, err = m.GetTask(10001)
+			convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+			deadTasks, err := m.QueryDeadLetterTasks(10, 0)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(deadTasks, convey.ShouldHaveLength, 1)
+			convey.So(deadTasks[0].Extra.Attempts, convey.ShouldEqual, 1)
+		})
+	})
+}
+
+func TestTaskManager_MemoryStore(t *testing.T) {
+	convey.Convey("TestTaskManager_MemoryStore", t, func() {
+		m := NewTaskManager(nil, "tasks", WithStore(NewMemoryStore()), WithScanInterval(time.Second))
+		var t1Run, t2Run int64
+		m.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run)})
+		m.Register("t2", TaskDefinition{Handler: func(ctx context.Context, arg interface{}) error {
+			atomic.AddInt64(&t2Run, 1)
+			return ErrUnexpected
+		}})
+		m.Start()
+
+		ref, err := m.RunWithOptions(context.TODO(), "t1", nil, RunOptions{DedupKey: "d1"})
+		convey.So(err, convey.ShouldBeNil)
+		_, err = m.RunWithOptions(context.TODO(), "t1", nil, RunOptions{DedupKey: "d1"})
+		convey.So(errors.Is(err, ErrDuplicateTask), convey.ShouldBeTrue)
+		err = m.Transaction(func(tx *gorm.DB) error {
+			if err := m.RunWithTx(tx, context.TODO(), "t1", nil); err != nil {
+				return err
+			}
+			return ErrUnexpected
+		})
+		convey.So(err, convey.ShouldEqual, ErrUnexpected)
+		convey.So(m.RunAfter(context.TODO(), "t2", nil, time.Millisecond*100), convey.ShouldBeNil)
+		time.Sleep(time.Second * 2)
+		m.Stop(true)
+
+		convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 1)
+		convey.So(atomic.LoadInt64(&t2Run), convey.ShouldEqual, 1)
+		task, err := m.GetTask(ref.ID)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+		// the task created in the transaction rolled back is discarded
+		_, err = m.GetTask(ref.ID + 1)
+		convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+		task, err = m.GetTask(ref.ID + 2)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusFailed)
+	})
+}
+
+func TestTaskManager_GetTask(t *testing.T) {
+	convey.Convey("TestTaskManager_GetTask", t, func() {
+		m := NewTaskManager(testDB("TestTaskManager_GetTask"), "tasks")
+		var t1Run int64
+		m.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run)})
+		m.Start()
+		ref, err := m.RunWithOptions(context.TODO(), "t1", nil, RunOptions{})
+		m.Stop(true)
+		convey.So(err, convey.ShouldBeNil)
+		task, err := m.GetTask(ref.ID)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(task.TaskKey, convey.ShouldEqual, ref.Key)
+		convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+		_, err = m.GetTask(ref.ID + 1)
+		convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+	})
+}
+
 func TestTaskManager_QueryUnsuccessfulTasks(t *testing.T) {
 	m := NewTaskManager(testDB("TestTaskManager_QueryUnsuccessfulTasks"), "tasks")
 	var t1Run int64
@@ -521,13 +1640,15 @@ func TestTaskManager_QueryUnsuccessfulTasks(t *testing.T) {
 			TaskStatus: TaskStatusFailed,
 			Context:    nil,
 			Argument:   nil,
-			Extra:      TaskExtra{},
+			Extra:      TaskExtra{Attempts: 1, AttemptRecords: []TaskAttempt{{Attempt: 1, Error: "handle failed"}}},
 			CreatedAt:  time.Now(),
 			UpdatedAt:  time.Now(),
 		})
 		tasks, err := m.QueryUnsuccessfulTasks(10, 0)
 		convey.So(err, convey.ShouldBeNil)
 		convey.So(tasks, convey.ShouldHaveLength, 1)
+		convey.So(tasks[0].Extra.Attempts, convey.ShouldEqual, 1)
+		convey.So(tasks[0].Extra.LastError(), convey.ShouldEqual, "handle failed")
 	})
 }
 
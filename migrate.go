@@ -0,0 +1,376 @@
+package gta
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// schemaVersion is the version of the task table schema of current release, which is increased once a migration is
+// appended to schemaMigrations.
+const schemaVersion = 9
+
+// schemaVersionTable records the schema version of each task table migrated by Migrate.
+const schemaVersionTable = "gta_schema_versions"
+
+// schemaVersionRecord is a row of schemaVersionTable.
+type schemaVersionRecord struct {
+	Table     string `gorm:"column:table_name;primaryKey;size:64"`
+	Version   int
+	UpdatedAt time.Time
+}
+
+// columnTypes are the types of a column in the supported dialects.
+type columnTypes struct {
+	mysql    string
+	postgres string
+	sqlite   string
+}
+
+func (t columnTypes) of(dialect string) string {
+	switch dialect {
+	case "mysql":
+		return t.mysql
+	case "postgres":
+		return t.postgres
+	default:
+		return t.sqlite
+	}
+}
+
+var (
+	keyColumnTypes = columnTypes{
+		mysql:    "varchar(64) NOT NULL DEFAULT ''",
+		postgres: "varchar(64) NOT NULL DEFAULT ''",
+		sqlite:   "varchar(64) NOT NULL DEFAULT ''",
+	}
+	blobColumnTypes = columnTypes{mysql: "mediumtext", postgres: "bytea", sqlite: "blob"}
+	textColumnTypes = columnTypes{mysql: "text", postgres: "bytea", sqlite: "blob"}
+	timeColumnTypes = columnTypes{
+		mysql:    "datetime NOT NULL DEFAULT '1000-01-01 00:00:00'",
+		postgres: "timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00'",
+		sqlite:   "datetime NOT NULL DEFAULT '1000-01-01 00:00:00'",
+	}
+	nullTimeColumnTypes = columnTypes{
+		mysql:    "datetime DEFAULT NULL",
+		postgres: "timestamptz DEFAULT NULL",
+		sqlite:   "datetime DEFAULT NULL",
+	}
+	intColumnTypes = columnTypes{
+		mysql:    "int(11) NOT NULL DEFAULT '0'",
+		postgres: "integer NOT NULL DEFAULT 0",
+		sqlite:   "integer NOT NULL DEFAULT 0",
+	}
+	nullStringColumnTypes = columnTypes{
+		mysql:    "varchar(128) DEFAULT NULL",
+		postgres: "varchar(128) DEFAULT NULL",
+		sqlite:   "varchar(128) DEFAULT NULL",
+	}
+	nullIDColumnTypes = columnTypes{
+		mysql:    "bigint(20) unsigned DEFAULT NULL",
+		postgres: "bigint DEFAULT NULL",
+		sqlite:   "bigint DEFAULT NULL",
+	}
+	boolColumnTypes = columnTypes{
+		mysql:    "tinyint(1) NOT NULL DEFAULT '0'",
+		postgres: "boolean NOT NULL DEFAULT false",
+		sqlite:   "boolean NOT NULL DEFAULT 0",
+	}
+	// idColumnTypes is only used when the table is created
+	idColumnTypes = columnTypes{
+		mysql:    "bigint(20) unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY",
+		postgres: "bigserial PRIMARY KEY",
+		sqlite:   "integer PRIMARY KEY AUTOINCREMENT",
+	}
+)
+
+type schemaColumn struct {
+	name string
+	columnTypes
+}
+
+type schemaIndex struct {
+	name    string
+	columns string
+	unique  bool
+	// where makes a partial index, which is only created in PostgreSQL
+	where string
+}
+
+// schemaMigration adds the columns and indexes introduced by a release, it's applied to the tables of lower versions.
+type schemaMigration struct {
+	version int
+	columns []schemaColumn
+	indexes []schemaIndex
+}
+
+// schemaMigrations must be appended only, and the schema of every migration should be described in model.sql as well.
+var schemaMigrations = []schemaMigration{
+	{
+		version: 1,
+		columns: []schemaColumn{
+			{"id", idColumnTypes},
+			{"task_key", keyColumnTypes},
+			{"task_status", keyColumnTypes},
+			{"context", blobColumnTypes},
+			{"argument", blobColumnTypes},
+			{"extra", blobColumnTypes},
+			{"created_at", timeColumnTypes},
+			{"updated_at", timeColumnTypes},
+		},
+		indexes: []schemaIndex{
+			{name: "idx_task_key", columns: "task_key"},
+			{name: "idx_task_status", columns: "task_status"},
+			{name: "idx_updated_at", columns: "updated_at"},
+		},
+	},
+	{
+		version: 2,
+		columns: []schemaColumn{{"run_at", timeColumnTypes}},
+		indexes: []schemaIndex{{name: "idx_run_at", columns: "run_at"}},
+	},
+	{
+		version: 3,
+		columns: []schemaColumn{{"lease_owner", keyColumnTypes}, {"lease_expire_at", nullTimeColumnTypes}},
+		indexes: []schemaIndex{{name: "idx_lease_expire_at", columns: "lease_expire_at"}},
+	},
+	{
+		version: 4,
+		columns: []schemaColumn{{"dedup_key", nullStringColumnTypes}},
+		indexes: []schemaIndex{{name: "uk_task_key_dedup_key", columns: "task_key, dedup_key", unique: true}},
+	},
+	{
+		version: 5,
+		columns: []schemaColumn{{"cancel_requested", boolColumnTypes}},
+	},
+	{
+		version: 6,
+		columns: []schemaColumn{{"priority", intColumnTypes}},
+		indexes: []schemaIndex{{name: "idx_priority_run_at", columns: "priority, run_at"}},
+	},
+	{
+		version: 7,
+		columns: []schemaColumn{{"ordering_key", nullStringColumnTypes}},
+		indexes: []schemaIndex{{name: "idx_ordering_key_task_status", columns: "ordering_key, task_status"}},
+	},
+	{
+		version: 8,
+		columns: []schemaColumn{{"workflow_id", nullIDColumnTypes}, {"depends_on", textColumnTypes}},
+		indexes: []schemaIndex{{name: "idx_workflow_id", columns: "workflow_id"}},
+	},
+	{
+		version: 9,
+		indexes: []schemaIndex{
+			{name: "idx_initialized", columns: "priority DESC, run_at, id", where: "task_status = 'initialized'"},
+		},
+	},
+}
+
+// Migrate creates the task table with its indexes if it doesn't exist, or upgrades it to the schema of current release
+// by adding the missing columns and indexes. The schema version of the table is recorded in the 'gta_schema_versions'
+// table, and the migrations are idempotent, so that a table created from model.sql by hand can be migrated as well.
+//
+// MySQL, PostgreSQL and SQLite are supported. Migrate should be called before the TaskManager is created, and it's not
+// meant to be run by several instances at the same time. The optional tables, i.e. the dead letter table, the archive
+// table and the rate limit table, are not migrated, please refer to model.sql for them.
+func Migrate(db *gorm.DB, table string) error {
+	m, err := newSchemaMigrator(db, table)
+	if err != nil {
+		return err
+	}
+	return m.migrate()
+}
+
+// VerifySchema checks whether the task table is compatible with current release, ErrSchemaMismatch is returned if the
+// table or any column is missing, or the table has been migrated by a newer release. Only the columns are checked, the
+// indexes are not, since they differ between the tables created by hand and by Migrate.
+func VerifySchema(db *gorm.DB, table string) error {
+	m, err := newSchemaMigrator(db, table)
+	if err != nil {
+		return err
+	}
+	return m.verify()
+}
+
+type schemaMigrator struct {
+	db      *gorm.DB
+	table   string
+	dialect string
+}
+
+func newSchemaMigrator(db *gorm.DB, table string) (*schemaMigrator, error) {
+	if db == nil || table == "" {
+		return nil, fmt.Errorf("%w: db or table is empty", ErrSchemaUnsupported)
+	}
+	dialect := db.Dialector.Name()
+	switch dialect {
+	case "mysql", "postgres", "sqlite":
+	default:
+		return nil, fmt.Errorf("%w: dialect[%v]", ErrSchemaUnsupported, dialect)
+	}
+	return &schemaMigrator{db: db, table: table, dialect: dialect}, nil
+}
+
+func (s *schemaMigrator) migrate() error {
+	if err := s.db.Table(schemaVersionTable).AutoMigrate(&schemaVersionRecord{}); err != nil {
+		return err
+	}
+	version, err := s.version()
+	if err != nil {
+		return err
+	} else if version > schemaVersion {
+		return fmt.Errorf("%w: table[%v] is migrated to version[%v] by a newer release, current version[%v]",
+			ErrSchemaMismatch, s.table, version, schemaVersion)
+	}
+
+	if !s.db.Migrator().HasTable(s.table) {
+		// create the table with all the columns at once, the indexes are created by the migrations below
+		if err := s.createTable(); err != nil {
+			return err
+		}
+		version = 0
+	}
+	for _, migration := range schemaMigrations {
+		if migration.version <= version {
+			continue
+		}
+		if err := s.apply(migration); err != nil {
+			return fmt.Errorf("migrate table[%v] to version[%v] err: %w", s.table, migration.version, err)
+		}
+		if err := s.setVersion(migration.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *schemaMigrator) verify() error {
+	if !s.db.Migrator().HasTable(s.table) {
+		return fmt.Errorf("%w: table[%v] not found", ErrSchemaMismatch, s.table)
+	}
+	if s.db.Migrator().HasTable(schemaVersionTable) {
+		// the tables created by hand have no version recorded
+		if version, err := s.version(); err != nil {
+			return err
+		} else if version > schemaVersion {
+			return fmt.Errorf("%w: table[%v] is migrated to version[%v] by a newer release, current version[%v]",
+				ErrSchemaMismatch, s.table, version, schemaVersion)
+		}
+	}
+	for _, migration := range schemaMigrations {
+		for _, column := range migration.columns {
+			if !s.hasColumn(column.name) {
+				return fmt.Errorf("%w: column[%v] of table[%v] not found, please migrate it", ErrSchemaMismatch,
+					column.name, s.table)
+			}
+		}
+	}
+	return nil
+}
+
+// version returns the recorded schema version of the table, 0 if not recorded.
+func (s *schemaMigrator) version() (int, error) {
+	var records []schemaVersionRecord
+	if err := s.db.Table(schemaVersionTable).Where("table_name = ?", s.table).Limit(1).Find(&records).
+		Error; err != nil {
+		return 0, err
+	} else if len(records) == 0 {
+		return 0, nil
+	}
+	return records[0].Version, nil
+}
+
+func (s *schemaMigrator) setVersion(version int) error {
+	record := &schemaVersionRecord{Table: s.table, Version: version, UpdatedAt: time.Now()}
+	return s.db.Table(schemaVersionTable).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "table_name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"version", "updated_at"}),
+	}).Create(record).Error
+}
+
+func (s *schemaMigrator) createTable() error {
+	for _, sql := range s.createTableSQLs() {
+		if err := s.db.Exec(sql).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *schemaMigrator) apply(migration schemaMigration) error {
+	for _, column := range migration.columns {
+		if s.hasColumn(column.name) {
+			continue
+		}
+		if err := s.db.Exec(s.addColumnSQL(column)).Error; err != nil {
+			return err
+		}
+	}
+	for _, index := range migration.indexes {
+		if index.where != "" && s.dialect != "postgres" {
+			continue
+		}
+		if s.db.Table(s.table).Migrator().HasIndex(&Task{}, s.indexName(index.name)) {
+			continue
+		}
+		if err := s.db.Exec(s.createIndexSQL(index)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTableSQLs returns the statements creating the table with all the columns, the IDs start from 10000 like model.sql.
+func (s *schemaMigrator) createTableSQLs() []string {
+	var defs []string
+	for _, migration := range schemaMigrations {
+		for _, column := range migration.columns {
+			defs = append(defs, s.db.Statement.Quote(column.name)+" "+column.of(s.dialect))
+		}
+	}
+	sqls := []string{fmt.Sprintf("CREATE TABLE %v (%v)", s.db.Statement.Quote(s.table), strings.Join(defs, ", "))}
+	switch s.dialect {
+	case "mysql":
+		sqls[0] += " ENGINE=InnoDB AUTO_INCREMENT=10000 DEFAULT CHARSET=utf8mb4"
+	case "postgres":
+		sqls = append(sqls, fmt.Sprintf("ALTER SEQUENCE %v RESTART WITH 10000", s.db.Statement.Quote(s.table+"_id_seq")))
+	case "sqlite":
+		// the last ID of the sequence, the IDs generated start above the ones of the periodic and builtin tasks
+		sqls = append(sqls, fmt.Sprintf("INSERT INTO sqlite_sequence (name, seq) VALUES ('%v', 10000)", s.table))
+	}
+	return sqls
+}
+
+func (s *schemaMigrator) addColumnSQL(column schemaColumn) string {
+	return fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", s.db.Statement.Quote(s.table),
+		s.db.Statement.Quote(column.name), column.of(s.dialect))
+}
+
+func (s *schemaMigrator) createIndexSQL(index schemaIndex) string {
+	sql := "CREATE INDEX"
+	if index.unique {
+		sql = "CREATE UNIQUE INDEX"
+	}
+	sql = fmt.Sprintf("%v %v ON %v (%v)", sql, s.db.Statement.Quote(s.indexName(index.name)),
+		s.db.Statement.Quote(s.table), index.columns)
+	if index.where != "" {
+		sql += " WHERE " + index.where
+	}
+	return sql
+}
+
+func (s *schemaMigrator) hasColumn(name string) bool {
+	return s.db.Table(s.table).Migrator().HasColumn(&Task{}, name)
+}
+
+// indexName returns the name of the index in the dialect, which is prefixed with the table name unless in MySQL, since
+// the index names are unique in a whole schema rather than a table in PostgreSQL and SQLite.
+func (s *schemaMigrator) indexName(name string) string {
+	if s.dialect == "mysql" {
+		return name
+	}
+	return s.table + "_" + name
+}
@@ -0,0 +1,196 @@
+package gta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMigrate(t *testing.T) {
+	convey.Convey("TestMigrate", t, func() {
+		db, _ := gorm.Open(sqlite.Open(fmt.Sprintf("TestMigrate_%d.db", rand.Int())),
+			&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+		m, _ := newSchemaMigrator(db, "tasks")
+
+		convey.Convey("create", func() {
+			convey.So(errors.Is(VerifySchema(db, "tasks"), ErrSchemaMismatch), convey.ShouldBeTrue)
+			convey.So(Migrate(db, "tasks"), convey.ShouldBeNil)
+			convey.So(VerifySchema(db, "tasks"), convey.ShouldBeNil)
+			version, err := m.version()
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(version, convey.ShouldEqual, schemaVersion)
+			convey.So(db.Table("tasks").Migrator().HasIndex(&Task{}, "tasks_uk_task_key_dedup_key"), convey.ShouldBeTrue)
+			convey.So(db.Table("tasks").Migrator().HasIndex(&Task{}, "tasks_idx_priority_run_at"), convey.ShouldBeTrue)
+			// partial index is only created in PostgreSQL
+			convey.So(db.Table("tasks").Migrator().HasIndex(&Task{}, "tasks_idx_initialized"), convey.ShouldBeFalse)
+
+			// the first ID is above the ones of the periodic and builtin tasks
+			first := &Task{TaskKey: "t0"}
+			convey.So(db.Table("tasks").Create(first).Error, convey.ShouldBeNil)
+			convey.So(first.ID, convey.ShouldEqual, 10001)
+			convey.So(db.Table("tasks").Delete(first).Error, convey.ShouldBeNil)
+
+			// idempotent
+			convey.So(Migrate(db, "tasks"), convey.ShouldBeNil)
+
+			tm := NewTaskManager(db, "tasks", WithSchemaCheck(true))
+			var t1Run int64
+			tm.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run)})
+			tm.Start()
+			dedupKey := "d1"
+			_, err = tm.RunWithOptions(context.TODO(), "t1", nil, RunOptions{DedupKey: dedupKey})
+			convey.So(err, convey.ShouldBeNil)
+			_, err = tm.RunWithOptions(context.TODO(), "t1", nil, RunOptions{DedupKey: dedupKey})
+			convey.So(errors.Is(err, ErrDuplicateTask), convey.ShouldBeTrue)
+			tm.Stop(true)
+			convey.So(t1Run, convey.ShouldEqual, 1)
+			task, _ := tm.tdal.Get(db, 10002)
+			convey.So(task, convey.ShouldNotBeNil)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+		})
+
+		convey.Convey("upgrade", func() {
+			// the table of the first release
+			err := db.Exec("CREATE TABLE `tasks` (`id` integer PRIMARY KEY AUTOINCREMENT, " +
+				"`task_key` varchar(64) NOT NULL DEFAULT '', `task_status` varchar(64) NOT NULL DEFAULT '', " +
+				"`context` blob, `argument` blob, `extra` blob, " +
+				"`created_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00', " +
+				"`updated_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00')").Error
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(db.Exec("INSERT INTO `tasks` (`id`, `task_key`, `task_status`) VALUES (1, 't1', 'succeeded')").
+				Error, convey.ShouldBeNil)
+			err = VerifySchema(db, "tasks")
+			convey.So(errors.Is(err, ErrSchemaMismatch), convey.ShouldBeTrue)
+			convey.So(err.Error(), convey.ShouldContainSubstring, "run_at")
+			convey.So(func() { NewTaskManager(db, "tasks", WithSchemaCheck(true)) }, convey.ShouldPanic)
+
+			convey.So(Migrate(db, "tasks"), convey.ShouldBeNil)
+			convey.So(VerifySchema(db, "tasks"), convey.ShouldBeNil)
+			convey.So(func() { NewTaskManager(db, "tasks", WithSchemaCheck(true)) }, convey.ShouldNotPanic)
+			task, err := (&taskDALImp{options: &options{table: "tasks"}}).Get(db, 1)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task.TaskKey, convey.ShouldEqual, "t1")
+			convey.So(task.Priority, convey.ShouldEqual, 0)
+			convey.So(task.CancelRequested, convey.ShouldBeFalse)
+			convey.So(task.DedupKey, convey.ShouldBeNil)
+		})
+
+		convey.Convey("newer version", func() {
+			convey.So(Migrate(db, "tasks"), convey.ShouldBeNil)
+			convey.So(m.setVersion(schemaVersion+1), convey.ShouldBeNil)
+			convey.So(errors.Is(VerifySchema(db, "tasks"), ErrSchemaMismatch), convey.ShouldBeTrue)
+			convey.So(errors.Is(Migrate(db, "tasks"), ErrSchemaMismatch), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("auto migrated", func() {
+			convey.So(db.AutoMigrate(&Task{}), convey.ShouldBeNil)
+			convey.So(VerifySchema(db, "tasks"), convey.ShouldBeNil)
+		})
+
+		convey.Convey("unsupported", func() {
+			convey.So(errors.Is(Migrate(db, ""), ErrSchemaUnsupported), convey.ShouldBeTrue)
+			db, _ := testDryRunDB(testUnknownDialector{Dialector: mysql.New(mysql.Config{SkipInitializeWithVersion: true})})
+			convey.So(errors.Is(Migrate(db, "tasks"), ErrSchemaUnsupported), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("dialects", func() {
+			mysqlDialector := mysql.New(mysql.Config{DSN: "gta:gta@tcp(127.0.0.1:3306)/gta",
+				SkipInitializeWithVersion: true})
+			uniqueIndex := schemaMigrations[3].indexes[0]
+			partialIndex := schemaMigrations[8].indexes[0]
+
+			mysqlDB, _ := testDryRunDB(mysqlDialector)
+			m, _ := newSchemaMigrator(mysqlDB, "tasks")
+			sqls := m.createTableSQLs()
+			convey.So(sqls, convey.ShouldHaveLength, 1)
+			convey.So(sqls[0], convey.ShouldStartWith, "CREATE TABLE `tasks` (`id` bigint(20) unsigned NOT NULL "+
+				"AUTO_INCREMENT PRIMARY KEY, `task_key` varchar(64) NOT NULL DEFAULT ''")
+			convey.So(sqls[0], convey.ShouldEndWith, "ENGINE=InnoDB AUTO_INCREMENT=10000 DEFAULT CHARSET=utf8mb4")
+			convey.So(m.addColumnSQL(schemaMigrations[1].columns[0]), convey.ShouldEqual,
+				"ALTER TABLE `tasks` ADD COLUMN `run_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00'")
+			convey.So(m.createIndexSQL(uniqueIndex), convey.ShouldEqual,
+				"CREATE UNIQUE INDEX `uk_task_key_dedup_key` ON `tasks` (task_key, dedup_key)")
+
+			postgresDB, _ := testDryRunDB(testPostgresDialector())
+			m, _ = newSchemaMigrator(postgresDB, "tasks")
+			sqls = m.createTableSQLs()
+			convey.So(sqls, convey.ShouldHaveLength, 2)
+			convey.So(sqls[0], convey.ShouldStartWith, `CREATE TABLE "tasks" ("id" bigserial PRIMARY KEY`)
+			convey.So(sqls[0], convey.ShouldContainSubstring, `"context" bytea`)
+			convey.So(sqls[1], convey.ShouldEqual, `ALTER SEQUENCE "tasks_id_seq" RESTART WITH 10000`)
+			convey.So(m.addColumnSQL(schemaMigrations[1].columns[0]), convey.ShouldEqual,
+				`ALTER TABLE "tasks" ADD COLUMN "run_at" timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00'`)
+			convey.So(m.createIndexSQL(uniqueIndex), convey.ShouldEqual,
+				`CREATE UNIQUE INDEX "tasks_uk_task_key_dedup_key" ON "tasks" (task_key, dedup_key)`)
+			convey.So(m.createIndexSQL(partialIndex), convey.ShouldEqual, `CREATE INDEX "tasks_idx_initialized" ON `+
+				`"tasks" (priority DESC, run_at, id) WHERE task_status = 'initialized'`)
+		})
+	})
+}
+
+func TestModelSQL(t *testing.T) {
+	convey.Convey("TestModelSQL", t, func() {
+		content, err := ioutil.ReadFile("model.sql")
+		convey.So(err, convey.ShouldBeNil)
+		postgresSQL := string(content[strings.Index(string(content), "-- PostgreSQL"):])
+		postgresDB, _ := testDryRunDB(testPostgresDialector())
+		stmt := &gorm.Statement{DB: postgresDB}
+		convey.So(stmt.Parse(&Task{}), convey.ShouldBeNil)
+		m, _ := newSchemaMigrator(postgresDB, "tasks")
+
+		// the columns of the PostgreSQL tables in model.sql, by table
+		tables := map[string]map[string]string{}
+		for _, match := range regexp.MustCompile(`(?s)CREATE TABLE (\w+) \(\n(.*?)\n\);`).
+			FindAllStringSubmatch(postgresSQL, -1) {
+			columns := map[string]string{}
+			for _, line := range strings.Split(match[2], "\n") {
+				column := strings.SplitN(strings.TrimSuffix(strings.TrimSpace(line), ","), " ", 2)
+				columns[column[0]] = column[1]
+			}
+			tables[match[1]] = columns
+		}
+
+		convey.Convey("task table", func() {
+			columns := map[string]string{}
+			for _, migration := range schemaMigrations {
+				for _, column := range migration.columns {
+					columns[column.name] = column.of(m.dialect)
+				}
+			}
+			convey.So(tables["tasks"], convey.ShouldResemble, columns)
+			convey.So(tables["tasks"], convey.ShouldHaveLength, len(stmt.Schema.DBNames))
+			for _, name := range stmt.Schema.DBNames {
+				convey.So(tables["tasks"], convey.ShouldContainKey, name)
+			}
+		})
+
+		convey.Convey("dead letter and archive table", func() {
+			for _, table := range []string{"tasks_dead_letter", "tasks_archive"} {
+				convey.So(tables[table], convey.ShouldHaveLength, len(stmt.Schema.DBNames))
+				for _, name := range stmt.Schema.DBNames {
+					convey.So(tables[table], convey.ShouldContainKey, name)
+				}
+			}
+		})
+	})
+}
+
+// testUnknownDialector pretends to be a dialector not supported.
+type testUnknownDialector struct {
+	gorm.Dialector
+}
+
+func (testUnknownDialector) Name() string {
+	return "unknown"
+}
@@ -6,13 +6,19 @@ import (
 	"time"
 )
 
+const (
+	maxTaskAttemptRecords = 10
+)
+
 // here are constants for task status
 const (
 	TaskStatusUnKnown     TaskStatus = ""
+	TaskStatusPending     TaskStatus = "pending"
 	TaskStatusInitialized TaskStatus = "initialized"
 	TaskStatusRunning     TaskStatus = "running"
 	TaskStatusSucceeded   TaskStatus = "succeeded"
 	TaskStatusFailed      TaskStatus = "failed"
+	TaskStatusCanceled    TaskStatus = "canceled"
 )
 
 // TaskKey is a unique ID for a set of tasks with same definition.
@@ -23,18 +29,85 @@ type TaskStatus string
 
 // Task is an entity in database.
 type Task struct {
-	ID         uint64
-	TaskKey    TaskKey
-	TaskStatus TaskStatus
-	Context    []byte
-	Argument   []byte
-	Extra      TaskExtra
-	CreatedAt  time.Time
-	UpdatedAt  time.Time
+	ID              uint64
+	TaskKey         TaskKey `gorm:"uniqueIndex:uk_task_key_dedup_key"`
+	TaskStatus      TaskStatus
+	Context         []byte
+	Argument        []byte
+	Extra           TaskExtra
+	RunAt           time.Time
+	Priority        int
+	LeaseOwner      string
+	LeaseExpireAt   *time.Time
+	DedupKey        *string `gorm:"uniqueIndex:uk_task_key_dedup_key"`
+	OrderingKey     *string
+	WorkflowID      *uint64
+	DependsOn       TaskIDs
+	CancelRequested bool
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// RateLimitToken is the token bucket of a task key shared by all instances.
+type RateLimitToken struct {
+	TaskKey TaskKey `gorm:"primaryKey"`
+	Tokens  float64
+	// unix time in nanoseconds when the tokens are refilled
+	RefilledAt int64
+}
+
+// TaskRef is a reference to a created task, which can be stored along with the business record to look up the task
+// later.
+type TaskRef struct {
+	ID  uint64
+	Key TaskKey
 }
 
 // TaskExtra contains other information of a task.
-type TaskExtra struct{}
+type TaskExtra struct {
+	// number of attempts executed
+	Attempts int `json:"attempts,omitempty"`
+	// number of retries rescheduled through the database in current run, reset once the task finishes
+	Retries int `json:"retries,omitempty"`
+	// number of times the running task is reclaimed after its lease expired
+	Reclaims int `json:"reclaims,omitempty"`
+	// time when the task is canceled
+	CanceledAt *time.Time `json:"canceled_at,omitempty"`
+	// ID of the upstream task in the workflow, whose failure or cancellation terminated this task before it ran
+	Upstream uint64 `json:"upstream,omitempty"`
+	// ID of the forward step in the saga, which is compensated by this task once a later step failed
+	Compensates uint64 `json:"compensates,omitempty"`
+	// whether the task is the completion task of a group, which is run once all the members finished
+	GroupCompletion bool `json:"group_completion,omitempty"`
+	// records of the latest attempts, at most maxTaskAttemptRecords records are reserved
+	AttemptRecords []TaskAttempt `json:"attempt_records,omitempty"`
+}
+
+// TaskAttempt is the execution record of a single attempt.
+type TaskAttempt struct {
+	Attempt    int       `json:"attempt"`
+	Instance   string    `json:"instance"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// error returned by the handler, including the stack if panic occurred, empty if succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// LastError returns the error of the latest attempt, or empty string if there is none.
+func (s TaskExtra) LastError() string {
+	if len(s.AttemptRecords) == 0 {
+		return ""
+	}
+	return s.AttemptRecords[len(s.AttemptRecords)-1].Error
+}
+
+func (s *TaskExtra) addAttempt(attempt TaskAttempt) {
+	s.Attempts = attempt.Attempt
+	s.AttemptRecords = append(s.AttemptRecords, attempt)
+	if l := len(s.AttemptRecords); l > maxTaskAttemptRecords {
+		s.AttemptRecords = s.AttemptRecords[l-maxTaskAttemptRecords:]
+	}
+}
 
 // Value implements Valuer.
 func (s TaskExtra) Value() (driver.Value, error) {
@@ -43,5 +116,50 @@ func (s TaskExtra) Value() (driver.Value, error) {
 
 // Scan implements Scanner.
 func (s *TaskExtra) Scan(v interface{}) error {
-	return json.Unmarshal(v.([]byte), s)
+	var bytes []byte
+	switch t := v.(type) {
+	case nil:
+	case string:
+		bytes = []byte(t)
+	default:
+		bytes = v.([]byte)
+	}
+	if len(bytes) == 0 {
+		// extra of legacy tasks may be empty
+		return nil
+	}
+	return json.Unmarshal(bytes, s)
+}
+
+// TaskIDs is a list of task IDs stored as a JSON array, e.g. the parents of a task in a workflow.
+type TaskIDs []uint64
+
+// GormDataType implements GormDataTypeInterface.
+func (s TaskIDs) GormDataType() string {
+	return "bytes"
+}
+
+// Value implements Valuer.
+func (s TaskIDs) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(s)
+}
+
+// Scan implements Scanner.
+func (s *TaskIDs) Scan(v interface{}) error {
+	var bytes []byte
+	switch t := v.(type) {
+	case nil:
+	case string:
+		bytes = []byte(t)
+	default:
+		bytes = v.([]byte)
+	}
+	if len(bytes) == 0 {
+		*s = nil
+		return nil
+	}
+	return json.Unmarshal(bytes, s)
 }
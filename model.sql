@@ -1,4 +1,5 @@
 /* -------------------- TABLE SCHEMA --------------------- */
+-- the task table can also be created and upgraded by 'Migrate', which records its schema version
 -- MySQL
 CREATE TABLE `tasks` (
   `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
@@ -7,10 +8,166 @@ CREATE TABLE `tasks` (
   `context` mediumtext,
   `argument` mediumtext,
   `extra` mediumtext,
+  `run_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  `priority` int(11) NOT NULL DEFAULT '0',
+  `lease_owner` varchar(64) NOT NULL DEFAULT '',
+  `lease_expire_at` datetime DEFAULT NULL,
+  `dedup_key` varchar(128) DEFAULT NULL,
+  `ordering_key` varchar(128) DEFAULT NULL,
+  `workflow_id` bigint(20) unsigned DEFAULT NULL,
+  `depends_on` text,
+  `cancel_requested` tinyint(1) NOT NULL DEFAULT '0',
   `created_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
   `updated_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
   PRIMARY KEY (`id`),
+  UNIQUE KEY `uk_task_key_dedup_key` (`task_key`, `dedup_key`),
   KEY `idx_task_key` (`task_key`),
   KEY `idx_task_status` (`task_status`),
+  KEY `idx_updated_at` (`updated_at`),
+  KEY `idx_run_at` (`run_at`),
+  KEY `idx_priority_run_at` (`priority`, `run_at`),
+  KEY `idx_lease_expire_at` (`lease_expire_at`),
+  KEY `idx_ordering_key_task_status` (`ordering_key`, `task_status`),
+  KEY `idx_workflow_id` (`workflow_id`)
+) ENGINE=InnoDB AUTO_INCREMENT=10000 DEFAULT CHARSET=utf8mb4;
+
+-- MySQL, optional, the dead letter table with the same columns as the task table, see 'WithDeadLetterTable'
+CREATE TABLE `tasks_dead_letter` (
+  `id` bigint(20) unsigned NOT NULL,
+  `task_key` varchar(64) NOT NULL DEFAULT '',
+  `task_status` varchar(64) NOT NULL DEFAULT '',
+  `context` mediumtext,
+  `argument` mediumtext,
+  `extra` mediumtext,
+  `run_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  `priority` int(11) NOT NULL DEFAULT '0',
+  `lease_owner` varchar(64) NOT NULL DEFAULT '',
+  `lease_expire_at` datetime DEFAULT NULL,
+  `dedup_key` varchar(128) DEFAULT NULL,
+  `ordering_key` varchar(128) DEFAULT NULL,
+  `workflow_id` bigint(20) unsigned DEFAULT NULL,
+  `depends_on` text,
+  `cancel_requested` tinyint(1) NOT NULL DEFAULT '0',
+  `created_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  `updated_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  PRIMARY KEY (`id`),
+  KEY `idx_task_key` (`task_key`),
+  KEY `idx_updated_at` (`updated_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- MySQL, optional, the archive table with the same columns as the task table, see 'WithArchiveTable'
+CREATE TABLE `tasks_archive` (
+  `id` bigint(20) unsigned NOT NULL,
+  `task_key` varchar(64) NOT NULL DEFAULT '',
+  `task_status` varchar(64) NOT NULL DEFAULT '',
+  `context` mediumtext,
+  `argument` mediumtext,
+  `extra` mediumtext,
+  `run_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  `priority` int(11) NOT NULL DEFAULT '0',
+  `lease_owner` varchar(64) NOT NULL DEFAULT '',
+  `lease_expire_at` datetime DEFAULT NULL,
+  `dedup_key` varchar(128) DEFAULT NULL,
+  `ordering_key` varchar(128) DEFAULT NULL,
+  `workflow_id` bigint(20) unsigned DEFAULT NULL,
+  `depends_on` text,
+  `cancel_requested` tinyint(1) NOT NULL DEFAULT '0',
+  `created_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  `updated_at` datetime NOT NULL DEFAULT '1000-01-01 00:00:00',
+  PRIMARY KEY (`id`),
+  KEY `idx_task_key` (`task_key`),
   KEY `idx_updated_at` (`updated_at`)
-) ENGINE=InnoDB AUTO_INCREMENT=10000 DEFAULT CHARSET=utf8mb4;
\ No newline at end of file
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- MySQL, optional, the token buckets of the global rate limits and the locks of the global concurrency limits, see 'WithRateLimitTable'
+CREATE TABLE `tasks_rate_limit` (
+  `task_key` varchar(64) NOT NULL,
+  `tokens` double NOT NULL DEFAULT '0',
+  `refilled_at` bigint(20) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`task_key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+-- PostgreSQL
+CREATE TABLE tasks (
+  id bigserial PRIMARY KEY,
+  task_key varchar(64) NOT NULL DEFAULT '',
+  task_status varchar(64) NOT NULL DEFAULT '',
+  context bytea,
+  argument bytea,
+  extra bytea,
+  run_at timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00',
+  priority integer NOT NULL DEFAULT 0,
+  lease_owner varchar(64) NOT NULL DEFAULT '',
+  lease_expire_at timestamptz DEFAULT NULL,
+  dedup_key varchar(128) DEFAULT NULL,
+  ordering_key varchar(128) DEFAULT NULL,
+  workflow_id bigint DEFAULT NULL,
+  depends_on bytea,
+  cancel_requested boolean NOT NULL DEFAULT false,
+  created_at timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00',
+  updated_at timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00'
+);
+CREATE UNIQUE INDEX tasks_uk_task_key_dedup_key ON tasks (task_key, dedup_key);
+CREATE INDEX tasks_idx_task_key ON tasks (task_key);
+CREATE INDEX tasks_idx_task_status ON tasks (task_status);
+CREATE INDEX tasks_idx_updated_at ON tasks (updated_at);
+CREATE INDEX tasks_idx_run_at ON tasks (run_at);
+CREATE INDEX tasks_idx_priority_run_at ON tasks (priority, run_at);
+CREATE INDEX tasks_idx_lease_expire_at ON tasks (lease_expire_at);
+CREATE INDEX tasks_idx_ordering_key_task_status ON tasks (ordering_key, task_status);
+CREATE INDEX tasks_idx_workflow_id ON tasks (workflow_id);
+-- the initialized tasks are claimed in this order with 'FOR UPDATE SKIP LOCKED'
+CREATE INDEX tasks_idx_initialized ON tasks (priority DESC, run_at, id) WHERE task_status = 'initialized';
+ALTER SEQUENCE tasks_id_seq RESTART WITH 10000;
+
+-- PostgreSQL, optional, the dead letter table with the same columns as the task table, see 'WithDeadLetterTable'
+CREATE TABLE tasks_dead_letter (
+  id bigint PRIMARY KEY,
+  task_key varchar(64) NOT NULL DEFAULT '',
+  task_status varchar(64) NOT NULL DEFAULT '',
+  context bytea,
+  argument bytea,
+  extra bytea,
+  run_at timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00',
+  priority integer NOT NULL DEFAULT 0,
+  lease_owner varchar(64) NOT NULL DEFAULT '',
+  lease_expire_at timestamptz DEFAULT NULL,
+  dedup_key varchar(128) DEFAULT NULL,
+  ordering_key varchar(128) DEFAULT NULL,
+  workflow_id bigint DEFAULT NULL,
+  depends_on bytea,
+  cancel_requested boolean NOT NULL DEFAULT false,
+  created_at timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00',
+  updated_at timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00'
+);
+CREATE INDEX tasks_dead_letter_idx_task_key ON tasks_dead_letter (task_key);
+CREATE INDEX tasks_dead_letter_idx_updated_at ON tasks_dead_letter (updated_at);
+
+-- PostgreSQL, optional, the archive table with the same columns as the task table, see 'WithArchiveTable'
+CREATE TABLE tasks_archive (
+  id bigint PRIMARY KEY,
+  task_key varchar(64) NOT NULL DEFAULT '',
+  task_status varchar(64) NOT NULL DEFAULT '',
+  context bytea,
+  argument bytea,
+  extra bytea,
+  run_at timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00',
+  priority integer NOT NULL DEFAULT 0,
+  lease_owner varchar(64) NOT NULL DEFAULT '',
+  lease_expire_at timestamptz DEFAULT NULL,
+  dedup_key varchar(128) DEFAULT NULL,
+  ordering_key varchar(128) DEFAULT NULL,
+  workflow_id bigint DEFAULT NULL,
+  depends_on bytea,
+  cancel_requested boolean NOT NULL DEFAULT false,
+  created_at timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00',
+  updated_at timestamptz NOT NULL DEFAULT '1000-01-01 00:00:00+00'
+);
+CREATE INDEX tasks_archive_idx_task_key ON tasks_archive (task_key);
+CREATE INDEX tasks_archive_idx_updated_at ON tasks_archive (updated_at);
+
+-- PostgreSQL, optional, the token buckets of the global rate limits and the locks of the global concurrency limits, see 'WithRateLimitTable'
+CREATE TABLE tasks_rate_limit (
+  task_key varchar(64) PRIMARY KEY,
+  tokens double precision NOT NULL DEFAULT 0,
+  refilled_at bigint NOT NULL DEFAULT 0
+);
@@ -1,32 +1,37 @@
 package gta
 
 import (
+	"fmt"
+	"sync"
 	"time"
-
-	"gorm.io/gorm"
 )
 
 type taskMonitor interface {
-	GoMonitorBuiltinTasks()
+	GoMonitorLoopTasks()
 }
 
 type taskMonitorImp struct {
 	*options
 	register  taskRegister
-	dal       taskDAL
+	dal       Store
 	assembler taskAssembler
+	monitored sync.Map
 }
 
-func (s *taskMonitorImp) GoMonitorBuiltinTasks() {
+func (s *taskMonitorImp) GoMonitorLoopTasks() {
 	logger := s.logger()
-	for _, key := range s.register.GetBuiltInKeys() {
+	for _, key := range s.register.GetLoopKeys() {
+		if _, loaded := s.monitored.LoadOrStore(key, struct{}{}); loaded {
+			// already monitored
+			continue
+		}
 		taskDef, _ := s.register.GetDefinition(key)
-		s.goMonitorBuiltinTask(taskDef)
-		logger.Infof("[GoMonitorBuiltinTasks] monitor built-in task start, task_key[%v], monitor interval[%v]", taskDef.key, taskDef.loopInterval)
+		s.goMonitorLoopTask(taskDef)
+		logger.Infof("[GoMonitorLoopTasks] monitor loop task start, task_key[%v], monitor interval[%v]", taskDef.key, s.monitorInterval(taskDef))
 	}
 }
 
-func (s *taskMonitorImp) goMonitorBuiltinTask(taskDef *TaskDefinition) {
+func (s *taskMonitorImp) goMonitorLoopTask(taskDef *TaskDefinition) {
 	go func() {
 		defer panicHandler()
 		for {
@@ -34,32 +39,56 @@ func (s *taskMonitorImp) goMonitorBuiltinTask(taskDef *TaskDefinition) {
 			case <-s.done():
 				return
 			default:
-				s.monitorBuiltinTask(taskDef)
-				time.Sleep(randomInterval(taskDef.loopInterval))
+				s.monitorLoopTask(taskDef)
+				time.Sleep(randomInterval(s.monitorInterval(taskDef)))
 			}
 		}
 	}()
 }
 
-func (s *taskMonitorImp) monitorBuiltinTask(taskDef *TaskDefinition) {
+func (s *taskMonitorImp) monitorInterval(taskDef *TaskDefinition) time.Duration {
+	if taskDef.schedule != nil {
+		// periodic task should be looped as soon as possible once finished, the next tick is decided by run_at
+		return s.scanInterval
+	}
+	return taskDef.loopInterval
+}
+
+func (s *taskMonitorImp) monitorLoopTask(taskDef *TaskDefinition) {
 	logger := s.logger()
 
 	newTask, err := s.assembler.AssembleTask(s.context, taskDef, taskDef.argument)
 	if err != nil {
-		logger.Errorf("[monitorBuiltinTask] assemble buitin task failed, err[%v], task_key[%v]", err, taskDef.key)
+		logger.Errorf("[monitorLoopTask] assemble loop task failed, err[%v], task_key[%v]", err, taskDef.key)
 		return
 	}
 	newTask.TaskStatus = TaskStatusInitialized
+	if taskDef.schedule != nil {
+		// periodic task is created at its first tick
+		newTask.RunAt = taskDef.schedule.next(newTask.RunAt)
+	}
 
-	if err := s.getDB().Transaction(func(tx *gorm.DB) error {
-		if task, err := s.dal.GetForUpdate(tx, taskDef.taskID); err != nil {
+	if err := s.dal.Transaction(s.getDB(), func(tx StoreTx) error {
+		task, err := s.dal.GetForUpdate(tx, taskDef.taskID)
+		if err != nil {
 			return err
 		} else if task == nil {
 			return ErrTaskNotFound
-		} else if !s.needLoopBuiltinTask(task, taskDef) {
+		} else if task.TaskKey != taskDef.key {
+			return fmt.Errorf("%w: task_id[%v] is occupied by task_key[%v]", ErrUnexpected, task.ID, task.TaskKey)
+		} else if !s.needLoopTask(task, taskDef) {
 			return nil
 		}
 
+		if taskDef.schedule != nil {
+			// exactly one execution per tick, missed ticks are skipped
+			lastTick := task.RunAt
+			if timeNow := time.Now(); timeNow.After(lastTick) {
+				lastTick = timeNow
+			}
+			newTask.RunAt = taskDef.schedule.next(lastTick)
+		}
+
 		// need loop
 		if rows, err := s.dal.Update(tx, newTask); err != nil {
 			return err
@@ -73,14 +102,15 @@ func (s *taskMonitorImp) monitorBuiltinTask(taskDef *TaskDefinition) {
 		_ = s.dal.Create(s.getDB(), newTask)
 		return
 	} else if err != nil {
-		logger.Errorf("[monitorBuiltinTask] update transaction failed, err[%v], task_key[%v]", err, taskDef.key)
+		logger.Errorf("[monitorLoopTask] update transaction failed, err[%v], task_key[%v]", err, taskDef.key)
 		return
 	}
 }
 
-func (s *taskMonitorImp) needLoopBuiltinTask(task *Task, taskDef *TaskDefinition) bool {
-	// normal loop if task_status is succeeded or failed
-	needNormalLoop := time.Since(task.UpdatedAt) >= taskDef.loopInterval && (task.TaskStatus == TaskStatusSucceeded || task.TaskStatus == TaskStatusFailed)
+func (s *taskMonitorImp) needLoopTask(task *Task, taskDef *TaskDefinition) bool {
+	// normal loop if task_status is succeeded, failed or canceled
+	needNormalLoop := time.Since(task.UpdatedAt) >= taskDef.loopInterval && (task.TaskStatus == TaskStatusSucceeded ||
+		task.TaskStatus == TaskStatusFailed || task.TaskStatus == TaskStatusCanceled)
 	// force loop if abnormal running found
 	needForceLoop := time.Since(task.UpdatedAt) >= s.runningTimeout && task.TaskStatus == TaskStatusRunning
 
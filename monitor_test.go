@@ -3,23 +3,54 @@ package gta
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/smartystreets/goconvey/convey"
 	"gorm.io/gorm"
 )
 
-func Test_taskMonitorImp_monitorBuiltinTask(t *testing.T) {
-	convey.Convey("Test_taskMonitorImp_monitorBuiltinTask", t, func() {
+func Test_taskMonitorImp_monitorLoopTask(t *testing.T) {
+	convey.Convey("Test_taskMonitorImp_monitorLoopTask", t, func() {
+		convey.Convey("periodic task", func() {
+			tc, _ := newOptions(testDB("Test_taskMonitorImp_monitorLoopTask"), "tasks")
+			tdal := &taskDALImp{options: tc}
+			mon := &taskMonitorImp{options: tc, assembler: &taskAssemblerImp{options: tc}, dal: tdal}
+			sch, _ := parseSchedule("@every 1h")
+			taskDef := &TaskDefinition{key: "t1", taskID: periodicTaskID("t1"), schedule: sch}
+
+			convey.Convey("create and loop", func() {
+				mon.monitorLoopTask(taskDef)
+				task, _ := tdal.Get(tc.getDB(), taskDef.taskID)
+				convey.So(task, convey.ShouldNotBeNil)
+				convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
+				convey.So(task.RunAt, convey.ShouldHappenAfter, time.Now().Add(time.Minute*59))
+
+				_, _ = tdal.UpdateStatusByIDs(tc.getDB(), []uint64{task.ID}, TaskStatusInitialized, TaskStatusSucceeded)
+				mon.monitorLoopTask(taskDef)
+				looped, _ := tdal.Get(tc.getDB(), taskDef.taskID)
+				convey.So(looped.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
+				convey.So(looped.RunAt, convey.ShouldHappenAfter, task.RunAt.Add(time.Minute*59))
+			})
+
+			convey.Convey("task id occupied", func() {
+				_ = tdal.Create(tc.getDB(), &Task{ID: taskDef.taskID, TaskKey: "t2", TaskStatus: TaskStatusSucceeded})
+				mon.monitorLoopTask(taskDef)
+				task, _ := tdal.Get(tc.getDB(), taskDef.taskID)
+				convey.So(task.TaskKey, convey.ShouldEqual, "t2")
+				convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+			})
+		})
+
 		convey.Convey("error", func() {
 			convey.Convey("assemble task error", func() {
 				tc, _ := newOptions(&gorm.DB{}, "tasks")
 				mon := &taskMonitorImp{options: tc, assembler: &taskAssemblerImp{options: tc}}
-				convey.So(func() { mon.monitorBuiltinTask(&TaskDefinition{ArgType: reflect.TypeOf(""), argument: 0}) }, convey.ShouldNotPanic)
+				convey.So(func() { mon.monitorLoopTask(&TaskDefinition{ArgType: reflect.TypeOf(""), argument: 0}) }, convey.ShouldNotPanic)
 			})
 			convey.Convey("dal error", func() {
-				tc, _ := newOptions(testDB("Test_taskMonitorImp_monitorBuiltinTask"), "not exist")
+				tc, _ := newOptions(testDB("Test_taskMonitorImp_monitorLoopTask"), "not exist")
 				mon := &taskMonitorImp{options: tc, assembler: &taskAssemblerImp{options: tc}, dal: &taskDALImp{options: tc}}
-				convey.So(func() { mon.monitorBuiltinTask(&TaskDefinition{ArgType: reflect.TypeOf(""), argument: ""}) }, convey.ShouldNotPanic)
+				convey.So(func() { mon.monitorLoopTask(&TaskDefinition{ArgType: reflect.TypeOf(""), argument: ""}) }, convey.ShouldNotPanic)
 			})
 		})
 	})
@@ -3,6 +3,7 @@ package gta
 import (
 	"context"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/panjf2000/ants/v2"
@@ -41,6 +42,41 @@ type options struct {
 	dryRun bool
 	// optional, goroutine pool size for scheduling tasks
 	poolSize int
+	// optional, pool workers reserved for tasks with positive priority
+	reservedPoolSize int
+	// optional, max number of initialized tasks claimed in a single scan, only limited by the free workers of the pool
+	// if zero
+	scanBatchSize int
+	// optional, identity of current instance recorded in the tasks it runs
+	instanceID string
+	// optional, lease timeout of running tasks, orphaned running tasks are reclaimed after the lease expires
+	leaseTimeout time.Duration
+	// optional, max times a running task can be reclaimed before it is marked failed
+	maxReclaimTimes int
+	// optional, default timeout of a single attempt, no timeout if zero
+	taskTimeout time.Duration
+	// optional, table which the terminally failed tasks are moved to, disabled if empty
+	deadLetterTable string
+	// optional, table of the token buckets shared by all instances for global rate limits
+	rateLimitTable string
+	// optional, table which the cleaned tasks are archived to, disabled if empty
+	archiveTable string
+	// optional, receiver of the cleaned tasks, disabled if nil
+	archiver Archiver
+	// optional, determine when a failed task can be cleaned, never cleaned if zero
+	failedStorageTimeout time.Duration
+	// optional, flag for cleaning the canceled tasks along with the succeeded ones after storageTimeout
+	cleanCanceled bool
+	// optional, max number of tasks cleaned in a batch by the builtin clean up task
+	cleanUpBatchSize int
+	// optional, interval between the batches cleaned by the builtin clean up task
+	cleanUpBatchInterval time.Duration
+	// optional, callback function for the progress of the builtin clean up task
+	cleanUpCallback func(logger Logger, progress CleanUpProgress)
+	// optional, storage of the tasks, the db and the tables above are used if nil
+	store Store
+	// optional, flag for verifying the schema of the task table when the TaskManager is created
+	schemaCheck bool
 
 	// optional, task register
 	taskRegister taskRegister
@@ -76,6 +112,52 @@ func (s *options) getDB() *gorm.DB {
 	return s.db
 }
 
+// toStoreTx returns the handle of the store for the db or transaction passed in by the callers, which carries the
+// transaction of a store not relying on gorm if it's started by TaskManager.Transaction.
+func (s *options) toStoreTx(tx *gorm.DB) StoreTx {
+	if tx != nil && tx.Statement != nil {
+		if storeTx, ok := tx.Get(storeTxKey); ok {
+			return storeTx
+		}
+	}
+	return tx
+}
+
+// toGormTx is the reverse of toStoreTx, which returns the transaction of the store as a *gorm.DB derived from db.
+func (s *options) toGormTx(db *gorm.DB, tx StoreTx) *gorm.DB {
+	if gormTx, ok := tx.(*gorm.DB); ok {
+		return gormTx
+	}
+	return db.Set(storeTxKey, tx)
+}
+
+// carrierDB returns the db to carry the builtin transactions, which is a stub without connection if no db is passed to
+// NewTaskManager.
+func (s *options) carrierDB() *gorm.DB {
+	if s.db != nil {
+		return s.db
+	}
+	return newStubDB()
+}
+
+// newStubDB returns a db without connection, which only carries the transactions of a store not relying on gorm.
+func newStubDB() *gorm.DB {
+	return (&gorm.DB{Config: &gorm.Config{}, Statement: &gorm.Statement{}}).Session(&gorm.Session{NewDB: true})
+}
+
+func (s *options) leaseEnabled() bool {
+	return s.leaseTimeout > 0
+}
+
+// newLease returns the lease owner and expire time for a task to be run by current instance, empty if lease disabled.
+func (s *options) newLease() (string, *time.Time) {
+	if !s.leaseEnabled() {
+		return "", nil
+	}
+	expireAt := time.Now().Add(s.leaseTimeout)
+	return s.instanceID, &expireAt
+}
+
 // Logger is a logging interface for logging necessary messages.
 type Logger interface {
 	Printf(format string, args ...interface{})
@@ -290,11 +372,227 @@ func WithPoolSize(size int) Option {
 	}
 }
 
+// WithReservedPoolSize set the reservedPoolSize option.
+func WithReservedPoolSize(size int) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.reservedPoolSize = size },
+		verifyFunc: func(opts *options) error {
+			if opts.reservedPoolSize < 0 || opts.reservedPoolSize >= opts.poolSize {
+				return fmt.Errorf("%w: reservedPoolSize", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithScanBatchSize set the scanBatchSize option. By default, a single scan claims as many tasks as the free workers of
+// the pool, and a positive size caps it further, e.g. to keep the claim transactions short.
+func WithScanBatchSize(size int) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.scanBatchSize = size },
+		verifyFunc: func(opts *options) error {
+			if opts.scanBatchSize <= 0 {
+				return fmt.Errorf("%w: scanBatchSize", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithInstanceID set the instanceID option.
+func WithInstanceID(id string) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.instanceID = id },
+		verifyFunc: func(opts *options) error {
+			if opts.instanceID == "" || len([]rune(opts.instanceID)) > varchar64MaxLenth {
+				return fmt.Errorf("%w: instanceID", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithLeaseTimeout set the leaseTimeout option.
+func WithLeaseTimeout(d time.Duration) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.leaseTimeout = d },
+		verifyFunc: func(opts *options) error {
+			if opts.leaseTimeout <= 0 {
+				return fmt.Errorf("%w: leaseTimeout", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithMaxReclaimTimes set the maxReclaimTimes option.
+func WithMaxReclaimTimes(n int) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.maxReclaimTimes = n },
+		verifyFunc: func(opts *options) error {
+			if opts.maxReclaimTimes < 0 {
+				return fmt.Errorf("%w: maxReclaimTimes", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithTaskTimeout set the taskTimeout option.
+func WithTaskTimeout(d time.Duration) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.taskTimeout = d },
+		verifyFunc: func(opts *options) error {
+			if opts.taskTimeout <= 0 {
+				return fmt.Errorf("%w: taskTimeout", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithDeadLetterTable set the deadLetterTable option.
+func WithDeadLetterTable(table string) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.deadLetterTable = table },
+		verifyFunc: func(opts *options) error {
+			if opts.deadLetterTable == "" || opts.deadLetterTable == opts.table {
+				return fmt.Errorf("%w: deadLetterTable", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithRateLimitTable set the rateLimitTable option.
+func WithRateLimitTable(table string) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.rateLimitTable = table },
+		verifyFunc: func(opts *options) error {
+			if opts.rateLimitTable == "" || opts.rateLimitTable == opts.table || opts.rateLimitTable == opts.deadLetterTable {
+				return fmt.Errorf("%w: rateLimitTable", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithArchiveTable set the archiveTable option. The cleaned tasks are moved to the archive table, which has the same
+// columns as the task table, instead of being deleted.
+func WithArchiveTable(table string) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.archiveTable = table },
+		verifyFunc: func(opts *options) error {
+			if opts.archiveTable == "" || opts.archiveTable == opts.table || opts.archiveTable == opts.deadLetterTable ||
+				opts.archiveTable == opts.rateLimitTable {
+				return fmt.Errorf("%w: archiveTable", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithArchiver set the archiver option. The cleaned tasks are passed to the archiver before they are deleted.
+func WithArchiver(archiver Archiver) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.archiver = archiver },
+		verifyFunc: func(opts *options) error {
+			if opts.archiver == nil {
+				return fmt.Errorf("%w: archiver", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithFailedStorageTimeout set the failedStorageTimeout option.
+func WithFailedStorageTimeout(d time.Duration) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.failedStorageTimeout = d },
+		verifyFunc: func(opts *options) error {
+			if opts.failedStorageTimeout <= 0 {
+				return fmt.Errorf("%w: failedStorageTimeout", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithCleanCanceled set the cleanCanceled option.
+func WithCleanCanceled(flag bool) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.cleanCanceled = flag },
+	}
+}
+
+// WithCleanUpBatchSize set the cleanUpBatchSize option.
+func WithCleanUpBatchSize(size int) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.cleanUpBatchSize = size },
+		verifyFunc: func(opts *options) error {
+			if opts.cleanUpBatchSize <= 0 {
+				return fmt.Errorf("%w: cleanUpBatchSize", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithCleanUpBatchInterval set the cleanUpBatchInterval option. The builtin clean up task sleeps for the interval
+// between batches to relieve the database and its replicas.
+func WithCleanUpBatchInterval(d time.Duration) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.cleanUpBatchInterval = d },
+		verifyFunc: func(opts *options) error {
+			if opts.cleanUpBatchInterval < 0 {
+				return fmt.Errorf("%w: cleanUpBatchInterval", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithCleanUpCallback set the cleanUpCallback option. The callback is called after each batch cleaned by the builtin
+// clean up task, e.g. to report metrics.
+func WithCleanUpCallback(f func(logger Logger, progress CleanUpProgress)) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.cleanUpCallback = f },
+		verifyFunc: func(opts *options) error {
+			if opts.cleanUpCallback == nil {
+				return fmt.Errorf("%w: cleanUpCallback", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithStore set the store option. The db passed to NewTaskManager can be nil if the store doesn't rely on it, e.g. the
+// MemoryStore.
+func WithStore(store Store) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.store = store },
+		verifyFunc: func(opts *options) error {
+			if opts.store == nil {
+				return fmt.Errorf("%w: store", ErrOption)
+			}
+			return nil
+		},
+	}
+}
+
+// WithSchemaCheck set the schemaCheck option. NewTaskManager panics if the task table doesn't match current release,
+// see VerifySchema. It's ignored if a store is set.
+func WithSchemaCheck(flag bool) Option {
+	return &option{
+		applyFunc: func(opts *options) { opts.schemaCheck = flag },
+	}
+}
+
 func withDB(db *gorm.DB) Option {
 	return &option{
 		applyFunc: func(opts *options) { opts.db = db },
 		verifyFunc: func(opts *options) error {
-			if opts.db == nil {
+			if opts.db == nil && opts.store == nil {
 				return fmt.Errorf("%w: db", ErrOption)
 			}
 			return nil
@@ -341,25 +639,46 @@ func newDefaultOptions() *options {
 			scanInterval:        defaultScanInterval,
 			instantScanInterval: defaultInstantScanInterval,
 		},
-		waitTimeout:   defaultWaitTimeout,
-		ctxMarshaler:  &defaultCtxMarshaler{},
-		checkCallback: defaultCheckCallback,
-		dryRun:        false,
-		poolSize:      defaultPoolSize,
-		taskRegister:  &taskRegisterImp{},
-		cancelFunc:    cancelFunc,
+		waitTimeout:          defaultWaitTimeout,
+		ctxMarshaler:         &defaultCtxMarshaler{},
+		checkCallback:        defaultCheckCallback,
+		dryRun:               false,
+		poolSize:             defaultPoolSize,
+		reservedPoolSize:     0,
+		scanBatchSize:        defaultScanBatchSize,
+		instanceID:           defaultInstanceID(),
+		leaseTimeout:         0,
+		maxReclaimTimes:      defaultMaxReclaimTimes,
+		taskTimeout:          0,
+		deadLetterTable:      "",
+		rateLimitTable:       "",
+		archiveTable:         "",
+		archiver:             nil,
+		failedStorageTimeout: 0,
+		cleanCanceled:        false,
+		cleanUpBatchSize:     defaultCleanUpBatchSize,
+		cleanUpBatchInterval: defaultCleanUpBatchInterval,
+		cleanUpCallback:      defaultCleanUpCallback,
+		store:                nil,
+		schemaCheck:          false,
+		taskRegister:         &taskRegisterImp{},
+		cancelFunc:           cancelFunc,
 	}
 }
 
 var (
-	defaultStorageTimeout      = time.Hour * 7 * 24
-	defaultWaitTimeout         = time.Second * 0
-	defaultScanInterval        = time.Second * 5
-	defaultInstantScanInterval = time.Millisecond * 100
-	defaultRunningTimeout      = time.Minute * 30
-	defaultInitializedTimeout  = time.Minute * 5
-	defaultPoolSize            = ants.DefaultAntsPoolSize
-	defaultRetryInterval       = time.Second
+	defaultStorageTimeout       = time.Hour * 7 * 24
+	defaultWaitTimeout          = time.Second * 0
+	defaultScanInterval         = time.Second * 5
+	defaultInstantScanInterval  = time.Millisecond * 100
+	defaultRunningTimeout       = time.Minute * 30
+	defaultInitializedTimeout   = time.Minute * 5
+	defaultPoolSize             = ants.DefaultAntsPoolSize
+	defaultRetryInterval        = time.Second
+	defaultMaxReclaimTimes      = 3
+	defaultScanBatchSize        = 0
+	defaultCleanUpBatchSize     = 500
+	defaultCleanUpBatchInterval = time.Millisecond * 100
 )
 
 type defaultCtxMarshaler struct{}
@@ -376,6 +695,18 @@ func defaultContextFactory() context.Context {
 	return context.Background()
 }
 
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	id := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	if r := []rune(id); len(r) > varchar64MaxLenth {
+		id = string(r[len(r)-varchar64MaxLenth:])
+	}
+	return id
+}
+
 func defaultLoggerFactory(ctx context.Context) Logger {
 	return logrus.NewEntry(logrus.New())
 }
@@ -389,3 +720,9 @@ func defaultCheckCallback(logger Logger, abnormalTasks []Task) {
 		logger.Warnf("[defaultCheckCallback] abnormal task found, id[%v], task_key[%v], task_status[%v]", at.ID, at.TaskKey, at.TaskStatus)
 	}
 }
+
+func defaultCleanUpCallback(logger Logger, progress CleanUpProgress) {
+	logger.Infof("[defaultCleanUpCallback] tasks cleaned, statuses[%v], batch[%v], cleaned[%v], total_cleaned[%v], "+
+		"archived[%v], elapsed[%v]", progress.Statuses, progress.Batches, progress.Cleaned, progress.TotalCleaned,
+		progress.Archived, progress.Elapsed)
+}
@@ -71,6 +71,89 @@ func Test_newOptions(t *testing.T) {
 			convey.So(err, convey.ShouldNotBeNil)
 		})
 
+		convey.Convey("invalid lease timeout", func() {
+			_, err := newOptions(defaultDB, defaultTable, WithLeaseTimeout(0))
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("invalid max reclaim times", func() {
+			_, err := newOptions(defaultDB, defaultTable, WithMaxReclaimTimes(-1))
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("invalid task timeout", func() {
+			_, err := newOptions(defaultDB, defaultTable, WithTaskTimeout(-time.Second))
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("invalid dead letter table", func() {
+			_, err := newOptions(defaultDB, defaultTable, WithDeadLetterTable(""))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, err = newOptions(defaultDB, defaultTable, WithDeadLetterTable(defaultTable))
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+		convey.Convey("invalid rate limit table", func() {
+			_, err := newOptions(defaultDB, defaultTable, WithRateLimitTable(""))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, err = newOptions(defaultDB, defaultTable, WithRateLimitTable(defaultTable))
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+		convey.Convey("invalid archive table", func() {
+			_, err := newOptions(defaultDB, defaultTable, WithArchiveTable(""))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, err = newOptions(defaultDB, defaultTable, WithArchiveTable("t1"), WithDeadLetterTable("t1"))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, err = newOptions(defaultDB, defaultTable, WithArchiver(nil))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, err = newOptions(defaultDB, defaultTable, WithFailedStorageTimeout(0))
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+		convey.Convey("invalid clean up batch", func() {
+			_, err := newOptions(defaultDB, defaultTable, WithCleanUpBatchSize(0))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, err = newOptions(defaultDB, defaultTable, WithCleanUpBatchInterval(-time.Second))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, err = newOptions(defaultDB, defaultTable, WithCleanUpCallback(nil))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			opts, err := newOptions(defaultDB, defaultTable, WithCleanUpBatchSize(100), WithCleanUpBatchInterval(0))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(opts.cleanUpBatchSize, convey.ShouldEqual, 100)
+			convey.So(opts.cleanUpBatchInterval, convey.ShouldEqual, 0)
+		})
+		convey.Convey("invalid reserved pool size", func() {
+			_, err := newOptions(defaultDB, defaultTable, WithReservedPoolSize(-1))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, err = newOptions(defaultDB, defaultTable, WithPoolSize(2), WithReservedPoolSize(2))
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("invalid scan batch size", func() {
+			_, err := newOptions(defaultDB, defaultTable, WithScanBatchSize(0))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			// only limited by the free workers of the pool by default
+			opts, err := newOptions(defaultDB, defaultTable)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(opts.scanBatchSize, convey.ShouldEqual, 0)
+		})
+
+		convey.Convey("store", func() {
+			_, err := newOptions(nil, defaultTable, WithStore(NewMemoryStore()))
+			convey.So(err, convey.ShouldBeNil)
+
+			_, err = newOptions(defaultDB, defaultTable, WithStore(nil))
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
 		convey.Convey("nil task register", func() {
 			_, err := newOptions(defaultDB, defaultTable, withTaskRegister(nil))
 			convey.So(err, convey.ShouldNotBeNil)
@@ -0,0 +1,192 @@
+package gta
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit limits how many tasks of a certain task key can be started per second with a token bucket.
+type RateLimit struct {
+	// tasks started per second, disabled if zero
+	Rate float64
+	// max tasks started at once, i.e. the capacity of the token bucket, Rate rounded up if zero
+	Burst int
+	// whether the token bucket is shared by all instances through the rate limit table, see WithRateLimitTable
+	Global bool
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+func (l RateLimit) verify() error {
+	if l.Rate < 0 || l.Burst < 0 {
+		return ErrDefInvalidRateLimit
+	}
+	return nil
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// refill returns the tokens in the bucket at now, which is refilled at Rate since refilledAt and capped by burst.
+func (l RateLimit) refill(tokens float64, refilledAt, now time.Time) float64 {
+	if elapsed := now.Sub(refilledAt); elapsed > 0 {
+		tokens += elapsed.Seconds() * l.Rate
+	}
+	return math.Min(tokens, l.burst())
+}
+
+// take returns how many of n tokens can be taken from the tokens, i.e. the whole ones available.
+func (l RateLimit) take(tokens float64, n int) int {
+	return int(math.Max(0, math.Min(float64(n), math.Floor(tokens))))
+}
+
+// delay returns how long to wait until a token is available, zero if there is one already.
+func (l RateLimit) delay(tokens float64) time.Duration {
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+}
+
+type taskRateLimiter interface {
+	SetLimit(key TaskKey, limit RateLimit)
+	Delay(tx StoreTx, key TaskKey) (time.Duration, error)
+	Take(tx StoreTx, key TaskKey, n int) (int, error)
+	GiveBack(key TaskKey, n int, committed bool) error
+}
+
+type taskRateLimiterImp struct {
+	*options
+	register taskRegister
+	dal      Store
+	// limits adjusted at runtime, which replace the ones in the task definitions
+	limitMap sync.Map
+	// token buckets of the keys limited in current instance only
+	bucketMap sync.Map
+}
+
+type tokenBucket struct {
+	mu         sync.Mutex
+	tokens     float64
+	refilledAt time.Time
+}
+
+func (s *taskRateLimiterImp) SetLimit(key TaskKey, limit RateLimit) {
+	s.limitMap.Store(key, limit)
+}
+
+// Delay returns how long to wait until a task of the key can be started, without taking the token.
+func (s *taskRateLimiterImp) Delay(tx StoreTx, key TaskKey) (time.Duration, error) {
+	limit := s.limit(key)
+	if !limit.enabled() || s.dryRun {
+		return 0, nil
+	}
+	if limit.Global {
+		token, err := s.dal.GetRateLimitToken(tx, key)
+		if err != nil || token == nil {
+			return 0, err
+		}
+		return limit.delay(limit.refill(token.Tokens, time.Unix(0, token.RefilledAt), time.Now())), nil
+	}
+
+	b := s.bucket(key, limit)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return limit.delay(limit.refill(b.tokens, b.refilledAt, time.Now())), nil
+}
+
+// Take takes at most n tokens available to start the tasks of the key, and returns the number of tokens taken. The
+// tokens of a global rate limit are taken in tx, so they are given back if tx is rolled back, while the ones of a local
+// rate limit are not, which should be given back by GiveBack.
+func (s *taskRateLimiterImp) Take(tx StoreTx, key TaskKey, n int) (int, error) {
+	limit := s.limit(key)
+	if !limit.enabled() || s.dryRun {
+		return n, nil
+	}
+	if limit.Global {
+		return s.takeGlobal(tx, key, limit, n)
+	}
+
+	b := s.bucket(key, limit)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens, b.refilledAt = limit.refill(b.tokens, b.refilledAt, now), now
+	taken := limit.take(b.tokens, n)
+	b.tokens -= float64(taken)
+	return taken, nil
+}
+
+// takeGlobal takes the tokens from the bucket shared by all instances, which is locked in tx.
+func (s *taskRateLimiterImp) takeGlobal(tx StoreTx, key TaskKey, limit RateLimit, n int) (taken int, err error) {
+	err = s.dal.Transaction(tx, func(tx StoreTx) error {
+		now := time.Now()
+		token, err := s.dal.LockRateLimitToken(tx, key)
+		if err != nil {
+			return err
+		}
+		token.Tokens, token.RefilledAt = limit.refill(token.Tokens, time.Unix(0, token.RefilledAt), now), now.UnixNano()
+		if taken = limit.take(token.Tokens, n); taken == 0 {
+			return nil
+		}
+		token.Tokens -= float64(taken)
+		_, err = s.dal.UpdateRateLimitToken(tx, token)
+		return err
+	})
+	return taken, err
+}
+
+// GiveBack gives back n tokens taken by Take for the tasks not started after all, e.g. the ones claimed by others.
+// committed tells whether the transaction taking the tokens is committed, otherwise the tokens of a global rate limit
+// are given back by the rollback already.
+func (s *taskRateLimiterImp) GiveBack(key TaskKey, n int, committed bool) error {
+	limit := s.limit(key)
+	if !limit.enabled() || s.dryRun || n <= 0 {
+		return nil
+	}
+	if limit.Global {
+		if !committed {
+			return nil
+		}
+		return s.dal.Transaction(s.getDB(), func(tx StoreTx) error {
+			now := time.Now()
+			token, err := s.dal.LockRateLimitToken(tx, key)
+			if err != nil {
+				return err
+			}
+			token.Tokens = limit.refill(token.Tokens+float64(n), time.Unix(0, token.RefilledAt), now)
+			token.RefilledAt = now.UnixNano()
+			_, err = s.dal.UpdateRateLimitToken(tx, token)
+			return err
+		})
+	}
+
+	b := s.bucket(key, limit)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens, b.refilledAt = limit.refill(b.tokens+float64(n), b.refilledAt, now), now
+	return nil
+}
+
+func (s *taskRateLimiterImp) limit(key TaskKey) RateLimit {
+	if value, ok := s.limitMap.Load(key); ok {
+		return value.(RateLimit)
+	}
+	if taskDef, err := s.register.GetDefinition(key); err == nil {
+		return taskDef.RateLimit
+	}
+	return RateLimit{}
+}
+
+func (s *taskRateLimiterImp) bucket(key TaskKey, limit RateLimit) *tokenBucket {
+	value, _ := s.bucketMap.LoadOrStore(key, &tokenBucket{tokens: limit.burst(), refilledAt: time.Now()})
+	return value.(*tokenBucket)
+}
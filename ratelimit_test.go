@@ -0,0 +1,138 @@
+package gta
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestRateLimit(t *testing.T) {
+	convey.Convey("TestRateLimit", t, func() {
+		convey.Convey("verify", func() {
+			convey.So(RateLimit{}.verify(), convey.ShouldBeNil)
+			convey.So(RateLimit{Rate: -1}.verify(), convey.ShouldEqual, ErrDefInvalidRateLimit)
+			convey.So(RateLimit{Rate: 1, Burst: -1}.verify(), convey.ShouldEqual, ErrDefInvalidRateLimit)
+		})
+
+		convey.Convey("burst", func() {
+			convey.So(RateLimit{Rate: 0.5}.burst(), convey.ShouldEqual, 1)
+			convey.So(RateLimit{Rate: 2.5}.burst(), convey.ShouldEqual, 3)
+			convey.So(RateLimit{Rate: 2.5, Burst: 10}.burst(), convey.ShouldEqual, 10)
+		})
+
+		convey.Convey("refill and delay", func() {
+			limit := RateLimit{Rate: 2, Burst: 4}
+			now := time.Now()
+			convey.So(limit.refill(0, now.Add(-time.Second), now), convey.ShouldEqual, 2)
+			convey.So(limit.refill(3, now.Add(-time.Second), now), convey.ShouldEqual, 4)
+			convey.So(limit.refill(1, now.Add(time.Second), now), convey.ShouldEqual, 1)
+			convey.So(limit.take(2.5, 3), convey.ShouldEqual, 2)
+			convey.So(limit.take(2.5, 1), convey.ShouldEqual, 1)
+			convey.So(limit.take(0.5, 1), convey.ShouldEqual, 0)
+			convey.So(limit.delay(1), convey.ShouldEqual, 0)
+			convey.So(limit.delay(0.5), convey.ShouldEqual, time.Millisecond*250)
+		})
+	})
+}
+
+func Test_taskRateLimiterImp(t *testing.T) {
+	convey.Convey("Test_taskRateLimiterImp", t, func() {
+		db := testDB("Test_taskRateLimiterImp")
+		_ = db.Table("tasks_rate_limit").AutoMigrate(&RateLimitToken{})
+		tc, _ := newOptions(db, "tasks", WithRateLimitTable("tasks_rate_limit"))
+		tr := &taskRegisterImp{}
+		handler := func(ctx context.Context, arg interface{}) (err error) { return nil }
+		_ = tr.Register("t1", TaskDefinition{Handler: handler, RateLimit: RateLimit{Rate: 1, Burst: 2}})
+		_ = tr.Register("t2", TaskDefinition{Handler: handler, RateLimit: RateLimit{Rate: 1, Burst: 2, Global: true}})
+		_ = tr.Register("t3", TaskDefinition{Handler: handler})
+		tdal := &taskDALImp{options: tc}
+		newLimiter := func() *taskRateLimiterImp { return &taskRateLimiterImp{options: tc, register: tr, dal: tdal} }
+
+		convey.Convey("local", func() {
+			trl := newLimiter()
+			// capped by the tokens available
+			taken, err := trl.Take(db, "t1", 3)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(taken, convey.ShouldEqual, 2)
+			delay, err := trl.Delay(db, "t1")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(delay, convey.ShouldBeBetween, 0, time.Second)
+			taken, err = trl.Take(db, "t1", 1)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(taken, convey.ShouldEqual, 0)
+
+			// not limited in another instance
+			taken, _ = newLimiter().Take(db, "t1", 1)
+			convey.So(taken, convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("global", func() {
+			trl1, trl2 := newLimiter(), newLimiter()
+			delay, err := trl1.Delay(db, "t2")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(delay, convey.ShouldEqual, 0)
+			taken, _ := trl1.Take(db, "t2", 1)
+			convey.So(taken, convey.ShouldEqual, 1)
+			taken, _ = trl2.Take(db, "t2", 2)
+			convey.So(taken, convey.ShouldEqual, 1)
+			delay, err = trl2.Delay(db, "t2")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(delay, convey.ShouldBeBetween, 0, time.Second)
+			taken, err = trl1.Take(db, "t2", 1)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(taken, convey.ShouldEqual, 0)
+		})
+
+		convey.Convey("global in transaction", func() {
+			trl := newLimiter()
+			err := tdal.Transaction(db, func(tx StoreTx) error {
+				taken, err := trl.Take(tx, "t2", 2)
+				convey.So(taken, convey.ShouldEqual, 2)
+				if err != nil {
+					return err
+				}
+				return ErrUnexpected
+			})
+			convey.So(err, convey.ShouldEqual, ErrUnexpected)
+			// given back once the transaction is rolled back
+			taken, _ := trl.Take(db, "t2", 2)
+			convey.So(taken, convey.ShouldEqual, 2)
+		})
+
+		convey.Convey("give back", func() {
+			trl := newLimiter()
+			taken, _ := trl.Take(db, "t1", 2)
+			convey.So(taken, convey.ShouldEqual, 2)
+			// capped by the burst
+			convey.So(trl.GiveBack("t1", 3, false), convey.ShouldBeNil)
+			taken, _ = trl.Take(db, "t1", 3)
+			convey.So(taken, convey.ShouldEqual, 2)
+
+			taken, _ = trl.Take(db, "t2", 2)
+			convey.So(taken, convey.ShouldEqual, 2)
+			// the global tokens are given back by the rollback if not committed
+			convey.So(trl.GiveBack("t2", 1, false), convey.ShouldBeNil)
+			taken, _ = trl.Take(db, "t2", 1)
+			convey.So(taken, convey.ShouldEqual, 0)
+			convey.So(trl.GiveBack("t2", 1, true), convey.ShouldBeNil)
+			taken, _ = trl.Take(db, "t2", 2)
+			convey.So(taken, convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("unlimited and adjusted", func() {
+			trl := newLimiter()
+			taken, _ := trl.Take(db, "t3", 10)
+			convey.So(taken, convey.ShouldEqual, 10)
+			trl.SetLimit("t3", RateLimit{Rate: 1})
+			taken, _ = trl.Take(db, "t3", 10)
+			convey.So(taken, convey.ShouldEqual, 1)
+			taken, _ = trl.Take(db, "t3", 1)
+			convey.So(taken, convey.ShouldEqual, 0)
+			trl.SetLimit("t3", RateLimit{})
+			taken, _ = trl.Take(db, "t3", 1)
+			convey.So(taken, convey.ShouldEqual, 1)
+		})
+	})
+}
@@ -6,14 +6,17 @@ import (
 )
 
 const (
-	varchar64MaxLenth = 64
+	varchar64MaxLenth   = 64
+	varchar128MaxLength = 128
 )
 
 type taskRegister interface {
 	Register(key TaskKey, def TaskDefinition) error
+	RegisterPeriodic(key TaskKey, def PeriodicDefinition) error
 	GetDefinition(key TaskKey) (*TaskDefinition, error)
 	GroupKeysByInitTimeoutSensitivity() ([]TaskKey, []TaskKey)
 	GetBuiltInKeys() []TaskKey
+	GetLoopKeys() []TaskKey
 }
 
 type taskRegisterImp struct {
@@ -27,12 +30,26 @@ func (s *taskRegisterImp) Register(key TaskKey, def TaskDefinition) error {
 	if err := def.init(key); err != nil {
 		return fmt.Errorf("definition validate error: %w, task_key: %v", err, key)
 	}
+	if def.taskID != 0 {
+		if key, found := s.findKeyByTaskID(def.taskID); found && key != def.key {
+			return fmt.Errorf("definition validate error: %w, task_key: %v, conflicted task_key: %v",
+				ErrDefDuplicatedPrimaryKey, def.key, key)
+		}
+	}
 	if _, loaded := s.defMap.LoadOrStore(def.key, &def); loaded {
 		return fmt.Errorf("definition already registered, task_key: %v", def.key)
 	}
 	return nil
 }
 
+func (s *taskRegisterImp) RegisterPeriodic(key TaskKey, def PeriodicDefinition) error {
+	taskDef, err := def.taskDefinition(key)
+	if err != nil {
+		return fmt.Errorf("definition validate error: %w, task_key: %v", err, key)
+	}
+	return s.Register(key, taskDef)
+}
+
 func (s *taskRegisterImp) GetDefinition(key TaskKey) (*TaskDefinition, error) {
 	value, ok := s.defMap.Load(key)
 	if !ok {
@@ -64,3 +81,27 @@ func (s *taskRegisterImp) GetBuiltInKeys() []TaskKey {
 	})
 	return res
 }
+
+func (s *taskRegisterImp) GetLoopKeys() []TaskKey {
+	res := make([]TaskKey, 0)
+	s.defMap.Range(func(key, value interface{}) bool {
+		if def := value.(*TaskDefinition); def.looped() {
+			res = append(res, key.(TaskKey))
+		}
+		return true
+	})
+	return res
+}
+
+func (s *taskRegisterImp) findKeyByTaskID(taskID uint64) (TaskKey, bool) {
+	var res TaskKey
+	var found bool
+	s.defMap.Range(func(key, value interface{}) bool {
+		if def := value.(*TaskDefinition); def.taskID == taskID {
+			res, found = key.(TaskKey), true
+			return false
+		}
+		return true
+	})
+	return res, found
+}
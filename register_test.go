@@ -2,6 +2,7 @@ package gta
 
 import (
 	"context"
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -122,3 +123,44 @@ func Test_taskRegisterImp_GetBuiltInKeys(t *testing.T) {
 		convey.So(res, convey.ShouldHaveLength, 1)
 	})
 }
+
+func Test_taskRegisterImp_RegisterPeriodic(t *testing.T) {
+	convey.Convey("Test_taskRegisterImp_RegisterPeriodic", t, func() {
+		handler := func(ctx context.Context, arg interface{}) (err error) { return nil }
+		convey.Convey("normal", func() {
+			tr := taskRegisterImp{}
+			err := tr.RegisterPeriodic("key1", PeriodicDefinition{TaskDefinition: TaskDefinition{Handler: handler}, Schedule: "*/5 * * * *"})
+			convey.So(err, convey.ShouldBeNil)
+			_ = tr.Register("key2", TaskDefinition{Handler: handler})
+			convey.So(tr.GetLoopKeys(), convey.ShouldResemble, []TaskKey{"key1"})
+			convey.So(tr.GetBuiltInKeys(), convey.ShouldHaveLength, 0)
+			taskDef, _ := tr.GetDefinition("key1")
+			convey.So(taskDef.taskID, convey.ShouldEqual, periodicTaskID("key1"))
+		})
+
+		convey.Convey("invalid schedule", func() {
+			tr := taskRegisterImp{}
+			err := tr.RegisterPeriodic("key1", PeriodicDefinition{TaskDefinition: TaskDefinition{Handler: handler}, Schedule: "* * *"})
+			convey.So(errors.Is(err, ErrDefInvalidSchedule), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("duplicated task id", func() {
+			tr := taskRegisterImp{}
+			_ = tr.Register("builtin", TaskDefinition{Handler: handler, builtin: true, taskID: periodicTaskID("key1"), loopInterval: time.Second, argument: 0})
+			err := tr.RegisterPeriodic("key1", PeriodicDefinition{TaskDefinition: TaskDefinition{Handler: handler}, Schedule: "@hourly"})
+			convey.So(errors.Is(err, ErrDefDuplicatedPrimaryKey), convey.ShouldBeTrue)
+
+			// resolved by an explicit ID
+			err = tr.RegisterPeriodic("key1", PeriodicDefinition{TaskDefinition: TaskDefinition{Handler: handler}, Schedule: "@hourly", ID: 1000})
+			convey.So(err, convey.ShouldBeNil)
+			taskDef, _ := tr.GetDefinition("key1")
+			convey.So(taskDef.taskID, convey.ShouldEqual, 1000)
+		})
+
+		convey.Convey("invalid task id", func() {
+			tr := taskRegisterImp{}
+			err := tr.RegisterPeriodic("key1", PeriodicDefinition{TaskDefinition: TaskDefinition{Handler: handler}, Schedule: "@hourly", ID: 9999})
+			convey.So(errors.Is(err, ErrDefInvalidPrimaryKey), convey.ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package gta
+
+// Saga is a sequence of steps run one by one, each of which has a forward task and an optional compensating task. Once
+// a step terminally failed or was canceled, the compensating tasks of the previous succeeded steps are run in reverse
+// order. A saga is created as a workflow, so its state is persisted in the task table along with the tasks.
+type Saga struct {
+	steps []sagaStep
+}
+
+type sagaStep struct {
+	forward      TaskKey
+	compensation TaskKey
+	arg          interface{}
+}
+
+// NewSaga creates an empty saga.
+func NewSaga() *Saga {
+	return &Saga{}
+}
+
+// AddStep adds a step to the saga, both the forward task and the compensating task are created with the argument. The
+// compensation can be empty if there is nothing to compensate. Note that the compensation of the last step is never run
+// since there is no later step to fail.
+func (s *Saga) AddStep(forward TaskKey, compensation TaskKey, arg interface{}) *Saga {
+	s.steps = append(s.steps, sagaStep{forward: forward, compensation: compensation, arg: arg})
+	return s
+}
+
+// workflow converts the saga to a workflow, in which the forward tasks depend on their previous ones and the
+// compensating tasks depend on the ones of their next steps.
+func (s *Saga) workflow() *Workflow {
+	wf := NewWorkflow()
+	forwards := make([]WorkflowNode, len(s.steps))
+	for i, step := range s.steps {
+		if i == 0 {
+			forwards[i] = wf.Add(step.forward, step.arg)
+		} else {
+			forwards[i] = wf.Add(step.forward, step.arg, forwards[i-1])
+		}
+	}
+	var parents []WorkflowNode
+	for i := len(s.steps) - 2; i >= 0; i-- {
+		if s.steps[i].compensation == "" {
+			continue
+		}
+		parents = []WorkflowNode{wf.addCompensation(s.steps[i].compensation, s.steps[i].arg, forwards[i], parents...)}
+	}
+	return wf
+}
+
+// sagaStatus returns whether any forward step of the saga failed or was canceled, and whether all of them succeeded.
+func sagaStatus(tasks []Task, statusMap map[uint64]TaskStatus) (failed bool, succeeded bool) {
+	succeeded = true
+	for _, t := range tasks {
+		if t.Extra.Compensates != 0 {
+			continue
+		}
+		switch statusMap[t.ID] {
+		case TaskStatusSucceeded:
+		case TaskStatusFailed, TaskStatusCanceled:
+			failed = true
+		default:
+			succeeded = false
+		}
+	}
+	return failed, succeeded && !failed
+}
@@ -0,0 +1,24 @@
+package gta
+
+import (
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestSaga_workflow(t *testing.T) {
+	convey.Convey("TestSaga_workflow", t, func() {
+		wf := NewSaga().AddStep("f1", "c1", 1).AddStep("f2", "", 2).AddStep("f3", "c3", 3).
+			AddStep("f4", "c4", 4).workflow()
+		convey.So(wf.verify(), convey.ShouldBeNil)
+		convey.So(wf.nodes, convey.ShouldResemble, []workflowNode{
+			{key: "f1", arg: 1},
+			{key: "f2", arg: 2, parents: []WorkflowNode{0}},
+			{key: "f3", arg: 3, parents: []WorkflowNode{1}},
+			{key: "f4", arg: 4, parents: []WorkflowNode{2}},
+			{key: "c3", arg: 3, compensating: true, compensates: 2},
+			{key: "c1", arg: 1, parents: []WorkflowNode{4}, compensating: true, compensates: 0},
+		})
+		convey.So(NewSaga().workflow().verify(), convey.ShouldNotBeNil)
+	})
+}
@@ -1,7 +1,9 @@
 package gta
 
 import (
-	"sync/atomic"
+	"fmt"
+	"math"
+	"sort"
 	"time"
 )
 
@@ -11,10 +13,11 @@ type taskScanner interface {
 
 type taskScannerImp struct {
 	*options
-	register    taskRegister
-	dal         taskDAL
-	scheduler   taskScheduler
-	instantScan atomic.Value
+	register  taskRegister
+	dal       Store
+	scheduler taskScheduler
+	// wakeUp is notified once an initialized task is created or a worker is freed in current instance
+	wakeUp signal
 }
 
 func (s *taskScannerImp) GoScanAndSchedule() {
@@ -22,73 +25,264 @@ func (s *taskScannerImp) GoScanAndSchedule() {
 	logger.Infof("[GoScanAndSchedule] scan and run start, scan interval[%v], instant scan interval[%v]", s.scanInterval, s.instantScanInterval)
 	go func() {
 		defer panicHandler()
+		idleScans := 0
 		for {
 			select {
 			case <-s.done():
 				return
 			default:
-				s.scanAndSchedule()
-				time.Sleep(s.randomScanInterval())
+			}
+			if s.scanAndSchedule() {
+				idleScans = 0
+			} else {
+				idleScans++
+			}
+
+			timer := time.NewTimer(s.backoffInterval(idleScans))
+			select {
+			case <-s.done():
+				timer.Stop()
+				return
+			case <-s.wakeUp:
+				// something changed in current instance, scan again soon
+				timer.Stop()
+				idleScans = 0
+			case <-timer.C:
 			}
 		}
 	}()
 }
 
-func (s *taskScannerImp) scanAndSchedule() {
+// scanAndSchedule claims the initialized tasks within the free capacity and schedules them, true is returned if any
+// task is claimed.
+func (s *taskScannerImp) scanAndSchedule() bool {
 	logger := s.logger()
 
-	if !s.scheduler.CanSchedule() {
-		// the schedule has reached its capacity limit
-		s.swishOffInstantScan()
-		return
+	if !s.scheduler.CanSchedule(1) {
+		// the schedule has reached its capacity limit, wait for a worker to be freed
+		return false
+	}
+	minPriority, reservedOnly := math.MinInt32, !s.scheduler.CanSchedule(0)
+	capacity := s.scheduler.Capacity(0)
+	if reservedOnly {
+		// only the reserved workers are free, claim tasks with positive priority only
+		minPriority, capacity = 1, s.scheduler.Capacity(1)
 	}
 
-	task, err := s.claimInitializedTask()
-	if err != nil {
-		// no task remained or other error occurred, i.e. the db has gone
-		if err != ErrTaskNotFound {
+	if s.scanBatchSize > 0 {
+		capacity = int(minInt64(int64(capacity), int64(s.scanBatchSize)))
+	}
+	var tasks []*Task
+	if s.leaseEnabled() {
+		// the orphaned running tasks are reclaimed first, and the initialized tasks fill the remaining capacity
+		reclaimed, err := s.claimLeaseExpiredTasks(minPriority, capacity)
+		if err != nil {
+			logger.Errorf("[scanAndSchedule] claim lease expired task err, err[%v]", err)
+		}
+		tasks, capacity = reclaimed, capacity-len(reclaimed)
+	}
+	if capacity > 0 {
+		claimed, err := s.claimInitializedTasks(minPriority, capacity)
+		if err != nil && err != ErrTaskNotFound {
+			// other error than no task remained occurred, i.e. the db has gone
 			logger.Errorf("[scanAndSchedule] claim task err, err[%v]", err)
 		}
-		s.swishOffInstantScan()
-		return
-	} else if task != nil {
+		tasks = append(tasks, claimed...)
+	}
+	for _, task := range tasks {
 		s.scheduler.GoScheduleTask(task)
 	}
+	return len(tasks) > 0
+}
+
+// backoffInterval returns the interval before the next scan, which doubles from instantScanInterval with each idle
+// scan in a row, and never exceeds scanInterval.
+func (s *taskScannerImp) backoffInterval(idleScans int) time.Duration {
+	interval := s.instantScanInterval
+	for i := 0; i < idleScans && interval < s.scanInterval; i++ {
+		interval *= 2
+	}
+	if interval > s.scanInterval {
+		interval = s.scanInterval
+	}
+	return randomInterval(interval)
+}
+
+// claimInitializedTasks claims at most limit initialized tasks in a single transaction.
+func (s *taskScannerImp) claimInitializedTasks(minPriority int, limit int) ([]*Task, error) {
+	sensitiveKeys, insensitiveKeys := s.register.GroupKeysByInitTimeoutSensitivity()
+	if len(sensitiveKeys)+len(insensitiveKeys) > 0 {
+		// skip the keys reached their concurrency or rate limits, so that the tasks of other keys won't be blocked
+		var err error
+		if sensitiveKeys, err = s.filterSaturatedKeys(sensitiveKeys); err != nil {
+			return nil, err
+		}
+		if insensitiveKeys, err = s.filterSaturatedKeys(insensitiveKeys); err != nil {
+			return nil, err
+		}
+		if len(sensitiveKeys)+len(insensitiveKeys) == 0 {
+			return nil, ErrTaskNotFound
+		}
+	}
+	// with SKIP LOCKED, the candidates are selected in the claim transaction, so that the instances claim different
+	// tasks without contention
+	skipLocked := s.dal.SupportsSkipLocked(s.getDB())
+	var candidates []Task
+	if !skipLocked {
+		var err error
+		if candidates, err = s.dal.GetInitializedSlice(s.getDB(), sensitiveKeys, s.initializedTimeout, insensitiveKeys,
+			minPriority, limit); err != nil {
+			return nil, err
+		} else if len(candidates) == 0 {
+			// no initialized tasks remained
+			return nil, ErrTaskNotFound
+		}
+	}
+
+	select {
+	case <-s.done():
+		// abort claim when cancel signal received
+		return nil, nil
+	default:
+		leaseOwner, leaseExpireAt := s.newLease()
+		var takenIDs, claimedIDs []uint64
+		err := s.dal.Transaction(s.getDB(), func(tx StoreTx) (err error) {
+			if skipLocked {
+				if candidates, err = s.dal.GetInitializedSliceForUpdate(tx, sensitiveKeys, s.initializedTimeout,
+					insensitiveKeys, minPriority, limit); err != nil {
+					return err
+				} else if len(candidates) == 0 {
+					// no initialized tasks remained, or all of them are being claimed by others
+					return ErrTaskNotFound
+				}
+			}
+			// check the concurrency and rate limits again inside the claim transaction, and take the rate limit tokens
+			// of the tasks to be claimed
+			if takenIDs, err = s.takeKeyCapacities(tx, candidates, false); err != nil {
+				return err
+			}
+			if len(takenIDs) == 0 {
+				return nil
+			}
+			claimedIDs, err = s.dal.UpdateInitializedToRunningByIDs(tx, takenIDs, leaseOwner, leaseExpireAt)
+			return err
+		})
+		// the tokens taken for the tasks claimed by others, or all of them if rolled back, are given back
+		s.giveBackKeyCapacities(candidates, takenIDs, claimedIDs, err == nil)
+		if err == ErrZeroRowsAffected || err == ErrStoreConflict {
+			// tasks are claimed by others, ignore error
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
 
-	s.swishOnInstantScan()
+		claimedSet := make(map[uint64]struct{}, len(claimedIDs))
+		for _, id := range claimedIDs {
+			claimedSet[id] = struct{}{}
+		}
+		tasks := make([]*Task, 0, len(claimedIDs))
+		for i := range candidates {
+			// the tasks claimed by others or exceeding the limits are skipped
+			if _, ok := claimedSet[candidates[i].ID]; ok {
+				task := &candidates[i]
+				task.TaskStatus, task.LeaseOwner, task.LeaseExpireAt = TaskStatusRunning, leaseOwner, leaseExpireAt
+				tasks = append(tasks, task)
+			}
+		}
+		return tasks, nil
+	}
 }
 
-func (s *taskScannerImp) randomScanInterval() time.Duration {
-	if s.needInstantScan() {
-		return randomInterval(s.instantScanInterval)
+// takeKeyCapacities returns the IDs of the tasks which can be claimed in tx without exceeding the concurrency and rate
+// limits of their keys, and takes the rate limit tokens of them. running tells whether the tasks are the running ones to
+// be reclaimed.
+func (s *taskScannerImp) takeKeyCapacities(tx StoreTx, tasks []Task, running bool) ([]uint64, error) {
+	capacityMap := make(map[TaskKey]int)
+	keys := make([]TaskKey, 0)
+	for _, task := range tasks {
+		if _, ok := capacityMap[task.TaskKey]; !ok {
+			keys = append(keys, task.TaskKey)
+		}
+		capacityMap[task.TaskKey]++
 	}
-	return randomInterval(s.scanInterval)
+	// the rows of the keys are locked in the same order among instances
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for i, key := range keys {
+		if taskDef, _ := s.register.GetDefinition(key); taskDef != nil {
+			n, reclaimed := capacityMap[key], 0
+			if running {
+				reclaimed = n
+			}
+			var err error
+			if capacityMap[key], err = s.scheduler.TakeKeyCapacity(tx, key, n, reclaimed); err != nil {
+				// tx is rolled back on error, so only the local tokens taken for the keys before are given back
+				for _, takenKey := range keys[:i] {
+					s.giveBackKeyCapacity(takenKey, capacityMap[takenKey], false)
+				}
+				return nil, err
+			}
+		}
+	}
+	ids := make([]uint64, 0, len(tasks))
+	for _, task := range tasks {
+		if capacityMap[task.TaskKey] > 0 {
+			capacityMap[task.TaskKey]--
+			ids = append(ids, task.ID)
+		}
+	}
+	return ids, nil
 }
 
-func (s *taskScannerImp) needInstantScan() bool {
-	iv := s.instantScan.Load()
-	if iv == nil {
-		return false
+// giveBackKeyCapacities gives back the rate limit tokens taken for the tasks of takenIDs not in claimedIDs, or all of
+// them if the claim transaction isn't committed.
+func (s *taskScannerImp) giveBackKeyCapacities(tasks []Task, takenIDs []uint64, claimedIDs []uint64, committed bool) {
+	if len(takenIDs) == 0 {
+		return
+	}
+	takenSet, claimedSet := newIDSet(takenIDs), newIDSet(claimedIDs)
+	unclaimedMap := make(map[TaskKey]int)
+	for _, task := range tasks {
+		if takenSet.has(task.ID) && (!committed || !claimedSet.has(task.ID)) {
+			unclaimedMap[task.TaskKey]++
+		}
+	}
+	for key, n := range unclaimedMap {
+		s.giveBackKeyCapacity(key, n, committed)
 	}
-	return iv.(bool)
 }
 
-func (s *taskScannerImp) swishOffInstantScan() {
-	s.instantScan.Store(false)
+func (s *taskScannerImp) giveBackKeyCapacity(key TaskKey, n int, committed bool) {
+	if err := s.scheduler.GiveBackKeyCapacity(key, n, committed); err != nil {
+		s.logger().Errorf("[giveBackKeyCapacity] give back rate limit tokens failed, err[%v], task_key[%v], len[%v]", err, key, n)
+	}
 }
 
-func (s *taskScannerImp) swishOnInstantScan() {
-	s.instantScan.Store(true)
+// filterSaturatedKeys returns the keys whose tasks can be claimed without exceeding their concurrency and rate limits.
+func (s *taskScannerImp) filterSaturatedKeys(keys []TaskKey) ([]TaskKey, error) {
+	res := make([]TaskKey, 0, len(keys))
+	for _, key := range keys {
+		if ok, err := s.scheduler.CanScheduleKey(s.getDB(), key); err != nil {
+			return nil, err
+		} else if ok {
+			res = append(res, key)
+		}
+	}
+	return res, nil
 }
 
-func (s *taskScannerImp) claimInitializedTask() (*Task, error) {
+// claimLeaseExpiredTasks reclaims at most limit running tasks whose lease expired in a single transaction, which are
+// limited by the concurrency and rate limits of their keys like the initialized ones. The ordering keys are not checked,
+// since a running task is the one to be run of its ordering key already. The tasks exceeding max reclaim times are
+// taken over and failed instead, which are not returned.
+func (s *taskScannerImp) claimLeaseExpiredTasks(minPriority int, limit int) ([]*Task, error) {
+	logger := s.logger()
+
 	sensitiveKeys, insensitiveKeys := s.register.GroupKeysByInitTimeoutSensitivity()
-	task, err := s.dal.GetInitialized(s.getDB(), sensitiveKeys, s.initializedTimeout, insensitiveKeys)
-	if err != nil {
+	candidates, err := s.dal.GetLeaseExpiredSlice(s.getDB(), append(sensitiveKeys, insensitiveKeys...), minPriority,
+		limit)
+	if err != nil || len(candidates) == 0 {
+		// no orphaned running tasks remained or other error occurred
 		return nil, err
-	} else if task == nil {
-		// no initialized tasks remained
-		return nil, ErrTaskNotFound
 	}
 
 	select {
@@ -96,13 +290,87 @@ func (s *taskScannerImp) claimInitializedTask() (*Task, error) {
 		// abort claim when cancel signal received
 		return nil, nil
 	default:
-		if rowsAffected, err := s.dal.UpdateStatusByIDs(s.getDB(), []uint64{task.ID}, task.TaskStatus, TaskStatusRunning); err != nil {
-			return nil, err
-		} else if rowsAffected == 0 {
-			// task is claimed by others, ignore error
+		var reclaimed, failed []*Task
+		var failedErrs []error
+		var toRun []Task
+		var takenIDs []uint64
+		err := s.dal.Transaction(s.getDB(), func(tx StoreTx) (err error) {
+			reclaimed, failed, failedErrs = nil, nil, nil
+			// the tasks exceeding max reclaim times are not run, which take no capacity
+			toRun = make([]Task, 0, len(candidates))
+			for _, task := range candidates {
+				if task.Extra.Reclaims < s.maxReclaimTimes {
+					toRun = append(toRun, task)
+				}
+			}
+			if takenIDs, err = s.takeKeyCapacities(tx, toRun, true); err != nil {
+				return err
+			}
+			idSet := make(map[uint64]struct{}, len(takenIDs))
+			for _, id := range takenIDs {
+				idSet[id] = struct{}{}
+			}
+			for i := range candidates {
+				task := candidates[i]
+				_, ok := idSet[task.ID]
+				if task.Extra.Reclaims < s.maxReclaimTimes && !ok {
+					// exceeding the limits of its key, left to the next scan
+					continue
+				}
+				oriLeaseOwner := task.LeaseOwner
+				ok, leaseErr := s.takeOverLeaseExpired(&task)
+				if rowsAffected, err := s.dal.UpdateLeaseExpired(tx, oriLeaseOwner, &task); err != nil {
+					return err
+				} else if rowsAffected == 0 {
+					// task is reclaimed or renewed by others, ignore it
+					continue
+				}
+				if ok {
+					logger.Warnf("[claimLeaseExpiredTasks] lease expired task reclaimed, reclaim times[%v], previous owner[%v], task_key[%v], task_id[%v]", task.Extra.Reclaims, oriLeaseOwner, task.TaskKey, task.ID)
+					reclaimed = append(reclaimed, &task)
+				} else {
+					failed, failedErrs = append(failed, &task), append(failedErrs, leaseErr)
+				}
+			}
+			return nil
+		})
+		// the tokens taken for the tasks reclaimed or renewed by others, or all of them if rolled back, are given back
+		reclaimedIDs := make([]uint64, 0, len(reclaimed))
+		for _, task := range reclaimed {
+			reclaimedIDs = append(reclaimedIDs, task.ID)
+		}
+		s.giveBackKeyCapacities(toRun, takenIDs, reclaimedIDs, err == nil)
+		if err == ErrZeroRowsAffected || err == ErrStoreConflict {
+			// tasks are reclaimed by others, ignore error
 			return nil, nil
+		} else if err != nil {
+			return nil, err
 		}
-		task.TaskStatus = TaskStatusRunning
-		return task, nil
+
+		for i, task := range failed {
+			logger.Errorf("[claimLeaseExpiredTasks] lease expired and max reclaim times exceeded, task marked failed, reclaim times[%v], task_key[%v], task_id[%v]", task.Extra.Reclaims, task.TaskKey, task.ID)
+			s.scheduler.FailTask(task, failedErrs[i])
+		}
+		return reclaimed, nil
+	}
+}
+
+// takeOverLeaseExpired records the attempt of the previous owner as a failed one and leases the task to current
+// instance, and returns whether the task is reclaimed to run again and the error of the lost attempt. The task is taken
+// over in either case, so that the one exceeding max reclaim times is failed by current instance as its lease owner.
+func (s *taskScannerImp) takeOverLeaseExpired(task *Task) (bool, error) {
+	leaseErr := fmt.Errorf("%w at %v", ErrLeaseExpired, task.LeaseExpireAt.Format(time.RFC3339))
+	task.Extra.addAttempt(TaskAttempt{
+		Attempt:    task.Extra.Attempts + 1,
+		Instance:   task.LeaseOwner,
+		FinishedAt: time.Now(),
+		Error:      leaseErr.Error(),
+	})
+	reclaimed := task.Extra.Reclaims < s.maxReclaimTimes
+	if reclaimed {
+		task.Extra.Reclaims++
 	}
+	task.TaskStatus = TaskStatusRunning
+	task.LeaseOwner, task.LeaseExpireAt = s.newLease()
+	return reclaimed, leaseErr
 }
@@ -1,49 +1,269 @@
 package gta
 
 import (
+	"math"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/panjf2000/ants/v2"
 	"github.com/smartystreets/goconvey/convey"
 )
 
-func Test_taskScannerImp_claimInitializedTask(t *testing.T) {
-	convey.Convey("Test_taskScannerImp_claimInitializedTask", t, func() {
+func Test_taskScannerImp_claimInitializedTasks(t *testing.T) {
+	convey.Convey("Test_taskScannerImp_claimInitializedTasks", t, func() {
 		convey.Convey("ctx cancelled", func() {
-			tc, _ := newOptions(testDB("Test_taskScannerImp_claimInitializedTask"), "tasks")
+			tc, _ := newOptions(testDB("Test_taskScannerImp_claimInitializedTasks"), "tasks")
 			tr := &taskRegisterImp{}
 			tdal := &taskDALImp{options: tc}
-			tscn := &taskScannerImp{options: tc, register: tr, dal: tdal}
+			tsch := &taskSchedulerImp{options: tc, register: tr, dal: tdal, limiter: &taskRateLimiterImp{options: tc, register: tr, dal: tdal}}
+			tscn := &taskScannerImp{options: tc, register: tr, dal: tdal, scheduler: tsch}
 			_ = tr.Register("t1", TaskDefinition{Handler: testWrappedHandler()})
 			_ = tdal.Create(tc.getDB(), &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized})
 			tc.cancel()
-			task, err := tscn.claimInitializedTask()
+			tasks, err := tscn.claimInitializedTasks(math.MinInt32, 1)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(tasks, convey.ShouldBeEmpty)
+		})
+
+		convey.Convey("batch", func() {
+			db := testDB("Test_taskScannerImp_claimInitializedTasks")
+			_ = db.Table("tasks_rate_limit").AutoMigrate(&RateLimitToken{})
+			tc, _ := newOptions(db, "tasks", WithRateLimitTable("tasks_rate_limit"))
+			tr := &taskRegisterImp{}
+			tdal := &taskDALImp{options: tc}
+			tsch := &taskSchedulerImp{options: tc, register: tr, dal: tdal, limiter: &taskRateLimiterImp{options: tc, register: tr, dal: tdal}}
+			tscn := &taskScannerImp{options: tc, register: tr, dal: tdal, scheduler: tsch}
+			_ = tr.Register("t1", TaskDefinition{Handler: testWrappedHandler()})
+			_ = tr.Register("t2", TaskDefinition{Handler: testWrappedHandler(), MaxGlobalConcurrency: 1})
+			for _, key := range []TaskKey{"t1", "t2", "t1", "t2", "t1"} {
+				_ = tdal.Create(tc.getDB(), &Task{TaskKey: key, TaskStatus: TaskStatusInitialized})
+			}
+			tasks, err := tscn.claimInitializedTasks(math.MinInt32, 2)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(tasks, convey.ShouldHaveLength, 2)
+			convey.So(tasks[0].ID, convey.ShouldEqual, 10001)
+			convey.So(tasks[1].TaskStatus, convey.ShouldEqual, TaskStatusRunning)
+			// the max global concurrency of t2 is reached
+			tasks, err = tscn.claimInitializedTasks(math.MinInt32, 10)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(tasks, convey.ShouldHaveLength, 2)
+			convey.So(tasks[0].ID, convey.ShouldEqual, 10003)
+			convey.So(tasks[1].ID, convey.ShouldEqual, 10005)
+			_, err = tscn.claimInitializedTasks(math.MinInt32, 10)
+			convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+		})
+
+		convey.Convey("rate limited batch", func() {
+			tc, _ := newOptions(testDB("Test_taskScannerImp_claimInitializedTasks"), "tasks")
+			tr := &taskRegisterImp{}
+			tdal := &taskDALImp{options: tc}
+			tsch := &taskSchedulerImp{options: tc, register: tr, dal: tdal, limiter: &taskRateLimiterImp{options: tc, register: tr, dal: tdal}}
+			tscn := &taskScannerImp{options: tc, register: tr, dal: tdal, scheduler: tsch}
+			_ = tr.Register("t1", TaskDefinition{Handler: testWrappedHandler(), RateLimit: RateLimit{Rate: 0.1, Burst: 2}})
+			for i := 0; i < 3; i++ {
+				_ = tdal.Create(tc.getDB(), &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized})
+			}
+			// capped by the tokens taken in the claim transaction
+			tasks, err := tscn.claimInitializedTasks(math.MinInt32, 10)
 			convey.So(err, convey.ShouldBeNil)
-			convey.So(task, convey.ShouldBeNil)
+			convey.So(tasks, convey.ShouldHaveLength, 2)
+			_, err = tscn.claimInitializedTasks(math.MinInt32, 10)
+			convey.So(err, convey.ShouldEqual, ErrTaskNotFound)
+		})
+
+		convey.Convey("rate limited batch claimed concurrently", func() {
+			store := &testInterleavedStore{Store: NewMemoryStore()}
+			tc, _ := newOptions(nil, "tasks", WithStore(store))
+			tr := &taskRegisterImp{}
+			trl := &taskRateLimiterImp{options: tc, register: tr, dal: store}
+			tsch := &taskSchedulerImp{options: tc, register: tr, dal: store, limiter: trl}
+			_ = tr.Register("t1", TaskDefinition{Handler: testWrappedHandler(), RateLimit: RateLimit{Rate: 0.1, Burst: 3}})
+			for i := 0; i < 3; i++ {
+				_ = store.Create(tc.getDB(), &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized})
+			}
+
+			convey.Convey("rolled back", func() {
+				tscn := &taskScannerImp{options: tc, register: tr, dal: store, scheduler: tsch}
+				// another instance claims one of the tasks after the tokens are taken, and commits first
+				store.interleave = func() {
+					_, _ = store.UpdateInitializedToRunningByIDs(tc.getDB(), []uint64{10002}, "i2", nil)
+				}
+				tasks, err := tscn.claimInitializedTasks(math.MinInt32, 2)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(tasks, convey.ShouldBeEmpty)
+				// all of the tokens taken are given back
+				taken, _ := trl.Take(tc.getDB(), "t1", 3)
+				convey.So(taken, convey.ShouldEqual, 3)
+			})
+
+			convey.Convey("partially claimed", func() {
+				tscn := &taskScannerImp{options: tc, register: tr, dal: &testPartialClaimStore{Store: store}, scheduler: tsch}
+				tasks, err := tscn.claimInitializedTasks(math.MinInt32, 2)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(tasks, convey.ShouldHaveLength, 1)
+				// the token taken for the task not claimed is given back
+				taken, _ := trl.Take(tc.getDB(), "t1", 3)
+				convey.So(taken, convey.ShouldEqual, 2)
+			})
+		})
+
+		convey.Convey("max global concurrency claimed concurrently", func() {
+			store := &testInterleavedStore{Store: NewMemoryStore()}
+			tc, _ := newOptions(nil, "tasks", WithStore(store), WithRateLimitTable("tasks_rate_limit"))
+			tr := &taskRegisterImp{}
+			tsch := &taskSchedulerImp{options: tc, register: tr, dal: store, limiter: &taskRateLimiterImp{options: tc, register: tr, dal: store}}
+			tscn := &taskScannerImp{options: tc, register: tr, dal: store, scheduler: tsch}
+			_ = tr.Register("t1", TaskDefinition{Handler: testWrappedHandler(), MaxGlobalConcurrency: 1})
+			_ = store.Create(tc.getDB(), &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized})
+			_ = store.Create(tc.getDB(), &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized})
+			var err error
+			// another instance claims the other task of the key after the running tasks are counted, and commits first
+			store.interleave = func() {
+				err = store.Transaction(tc.getDB(), func(tx StoreTx) error {
+					if capacity, err := tsch.KeyCapacity(tx, "t1"); err != nil || capacity <= 0 {
+						return err
+					}
+					_, err := store.UpdateInitializedToRunningByIDs(tx, []uint64{10002}, "i2", nil)
+					return err
+				})
+			}
+			tasks, claimErr := tscn.claimInitializedTasks(math.MinInt32, 1)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(claimErr, convey.ShouldBeNil)
+			convey.So(tasks, convey.ShouldBeEmpty)
+			count, _ := store.CountRunningByKeyForUpdate(tc.getDB(), "t1")
+			convey.So(count, convey.ShouldEqual, 1)
 		})
 
 		convey.Convey("error", func() {
-			tc, _ := newOptions(testDB("Test_taskScannerImp_claimInitializedTask"), "not exist")
+			tc, _ := newOptions(testDB("Test_taskScannerImp_claimInitializedTasks"), "not exist")
 			tr := &taskRegisterImp{}
 			tdal := &taskDALImp{options: tc}
 			tscn := &taskScannerImp{options: tc, register: tr, dal: tdal}
-			_, err := tscn.claimInitializedTask()
+			_, err := tscn.claimInitializedTasks(math.MinInt32, 1)
 			convey.So(err, convey.ShouldNotBeNil)
 		})
 
 	})
 }
 
+func Test_taskScannerImp_claimLeaseExpiredTasks(t *testing.T) {
+	convey.Convey("Test_taskScannerImp_claimLeaseExpiredTasks", t, func() {
+		db := testDB("Test_taskScannerImp_claimLeaseExpiredTasks")
+		_ = db.Table("tasks_rate_limit").AutoMigrate(&RateLimitToken{})
+		tc, _ := newOptions(db, "tasks", WithRateLimitTable("tasks_rate_limit"), WithLeaseTimeout(time.Minute))
+		tr := &taskRegisterImp{}
+		tdal := &taskDALImp{options: tc}
+		tsch := &taskSchedulerImp{options: tc, register: tr, dal: tdal, limiter: &taskRateLimiterImp{options: tc, register: tr, dal: tdal}}
+		tscn := &taskScannerImp{options: tc, register: tr, dal: tdal, scheduler: tsch}
+		_ = tr.Register("t1", TaskDefinition{Handler: testWrappedHandler()})
+		_ = tr.Register("t2", TaskDefinition{Handler: testWrappedHandler(), MaxGlobalConcurrency: 1})
+		_ = tr.Register("t3", TaskDefinition{Handler: testWrappedHandler(), RateLimit: RateLimit{Rate: 0.1, Burst: 1}})
+		expired := time.Now().Add(-time.Second)
+		for _, key := range []TaskKey{"t1", "t2", "t3", "t3"} {
+			_ = tdal.Create(tc.getDB(), &Task{TaskKey: key, TaskStatus: TaskStatusRunning, LeaseOwner: "crashed",
+				LeaseExpireAt: &expired})
+		}
+
+		convey.Convey("batch", func() {
+			// the orphan of t2 is counted by its max global concurrency already, while t3 is rate limited
+			tasks, err := tscn.claimLeaseExpiredTasks(math.MinInt32, 10)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(tasks, convey.ShouldHaveLength, 3)
+			convey.So(tasks[1].TaskKey, convey.ShouldEqual, "t2")
+			convey.So(tasks[1].TaskStatus, convey.ShouldEqual, TaskStatusRunning)
+			convey.So(tasks[1].LeaseOwner, convey.ShouldEqual, tc.instanceID)
+			convey.So(tasks[1].Extra.Reclaims, convey.ShouldEqual, 1)
+			tasks, err = tscn.claimLeaseExpiredTasks(math.MinInt32, 10)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(tasks, convey.ShouldBeEmpty)
+			task, _ := tdal.Get(tc.getDB(), 10004)
+			convey.So(task.LeaseOwner, convey.ShouldEqual, "crashed")
+		})
+
+		convey.Convey("limit", func() {
+			tasks, err := tscn.claimLeaseExpiredTasks(math.MinInt32, 1)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(tasks, convey.ShouldHaveLength, 1)
+			convey.So(tasks[0].ID, convey.ShouldEqual, 10001)
+		})
+	})
+}
+
 func Test_taskScannerImp_scanAndSchedule(t *testing.T) {
 	convey.Convey("Test_taskScannerImp_scanAndSchedule", t, func() {
+		convey.Convey("reclaim with initialized tasks remained", func() {
+			tc, _ := newOptions(testDB("Test_taskScannerImp_scanAndSchedule"), "tasks", WithLeaseTimeout(time.Minute))
+			tr := tc.taskRegister
+			tdal := &taskDALImp{options: tc}
+			pool, _ := ants.NewPool(tc.poolSize, ants.WithNonblocking(true))
+			tsch := &taskSchedulerImp{options: tc, register: tr, dal: tdal, assembler: &taskAssemblerImp{options: tc},
+				pool: pool, limiter: &taskRateLimiterImp{options: tc, register: tr, dal: tdal}}
+			tscn := &taskScannerImp{options: tc, register: tr, dal: tdal, scheduler: tsch}
+			var t1Run int64
+			_ = tr.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run)})
+			expired := time.Now().Add(-time.Second)
+			_ = tdal.Create(tc.getDB(), &Task{TaskKey: "t1", TaskStatus: TaskStatusRunning, LeaseOwner: "crashed",
+				LeaseExpireAt: &expired})
+			_ = tdal.Create(tc.getDB(), &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized})
+			_ = tdal.Create(tc.getDB(), &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized})
+			// the orphan is reclaimed in the same scan as the initialized tasks
+			convey.So(tscn.scanAndSchedule(), convey.ShouldBeTrue)
+			time.Sleep(time.Second)
+			convey.So(atomic.LoadInt64(&t1Run), convey.ShouldEqual, 3)
+			task, _ := tdal.Get(tc.getDB(), 10001)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusSucceeded)
+		})
+
 		convey.Convey("error", func() {
 			tc, _ := newOptions(testDB("Test_taskScannerImp_scanAndSchedule"), "not exist")
 			tr := &taskRegisterImp{}
 			tdal := &taskDALImp{options: tc}
 			pool, _ := ants.NewPool(1)
-			tsch := &taskSchedulerImp{pool: pool}
+			tsch := &taskSchedulerImp{options: tc, pool: pool}
 			tscn := &taskScannerImp{options: tc, register: tr, dal: tdal, scheduler: tsch}
 			convey.So(func() { tscn.scanAndSchedule() }, convey.ShouldNotPanic)
 		})
 	})
 }
+
+func Test_taskScannerImp_backoffInterval(t *testing.T) {
+	convey.Convey("Test_taskScannerImp_backoffInterval", t, func() {
+		tc, _ := newOptions(testDB("Test_taskScannerImp_backoffInterval"), "tasks",
+			WithScanInterval(time.Second), WithInstantScanInterval(100*time.Millisecond))
+		tscn := &taskScannerImp{options: tc}
+		maxInterval := func(d time.Duration) time.Duration { return time.Duration(float64(d) * (1 + randomIntervalFactor)) }
+		convey.So(tscn.backoffInterval(0), convey.ShouldBeLessThan, maxInterval(100*time.Millisecond))
+		convey.So(tscn.backoffInterval(2), convey.ShouldBeGreaterThanOrEqualTo, 400*time.Millisecond)
+		convey.So(tscn.backoffInterval(2), convey.ShouldBeLessThan, maxInterval(400*time.Millisecond))
+		convey.So(tscn.backoffInterval(100), convey.ShouldBeGreaterThanOrEqualTo, time.Second)
+		convey.So(tscn.backoffInterval(100), convey.ShouldBeLessThan, maxInterval(time.Second))
+	})
+}
+
+// testInterleavedStore runs interleave once right before the first claim is written, as if another claim ran in the
+// meantime.
+type testInterleavedStore struct {
+	Store
+	interleave func()
+}
+
+func (s *testInterleavedStore) UpdateInitializedToRunningByIDs(tx StoreTx, ids []uint64, leaseOwner string,
+	leaseExpireAt *time.Time) ([]uint64, error) {
+	if interleave := s.interleave; interleave != nil {
+		s.interleave = nil
+		interleave()
+	}
+	return s.Store.UpdateInitializedToRunningByIDs(tx, ids, leaseOwner, leaseExpireAt)
+}
+
+// testPartialClaimStore claims the first of the tasks only, as if the others were claimed by others in the meantime.
+type testPartialClaimStore struct {
+	Store
+}
+
+func (s *testPartialClaimStore) UpdateInitializedToRunningByIDs(tx StoreTx, ids []uint64, leaseOwner string,
+	leaseExpireAt *time.Time) ([]uint64, error) {
+	return s.Store.UpdateInitializedToRunningByIDs(tx, ids[:1], leaseOwner, leaseExpireAt)
+}
@@ -0,0 +1,176 @@
+package gta
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scheduleEveryPrefix = "@every "
+)
+
+// schedule describes the ticks of a periodic task.
+type schedule interface {
+	// next returns the first tick strictly after t.
+	next(t time.Time) time.Time
+}
+
+// everySchedule ticks at a fixed interval.
+type everySchedule struct {
+	interval time.Duration
+}
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Add(s.interval).Truncate(time.Second)
+}
+
+// cronSchedule ticks according to a standard 5-field cron expression, each field is a bit set of matched values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// dom and dow are OR-ed if both of them are restricted, which is the same as the standard cron
+	domRestricted, dowRestricted bool
+}
+
+type cronField struct {
+	min, max int
+}
+
+var (
+	cronMinute = cronField{0, 59}
+	cronHour   = cronField{0, 23}
+	cronDom    = cronField{1, 31}
+	cronMonth  = cronField{1, 12}
+	cronDow    = cronField{0, 7}
+
+	cronDescriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// parseSchedule parses a cron expression like "*/5 * * * *", a descriptor like "@daily" or a fixed interval like
+// "@every 1m30s".
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, scheduleEveryPrefix) {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, scheduleEveryPrefix)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval: %w", err)
+		}
+		if interval < time.Second {
+			return nil, fmt.Errorf("interval should not be less than 1s: %v", interval)
+		}
+		return everySchedule{interval: interval}, nil
+	}
+	if expr, ok := cronDescriptors[spec]; ok {
+		spec = expr
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, found %d: %s", len(fields), spec)
+	}
+	var s cronSchedule
+	var err error
+	if s.minute, err = cronMinute.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if s.hour, err = cronHour.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if s.dom, err = cronDom.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if s.month, err = cronMonth.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if s.dow, err = cronDow.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	// both 0 and 7 stand for sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domRestricted, s.dowRestricted = !strings.HasPrefix(fields[2], "*"), !strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parse parses a field like "*", "*/5", "1-10/2" or "1,3,5" to a bit set.
+func (f cronField) parse(field string) (uint64, error) {
+	var res uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			rangePart = part[:i]
+		}
+
+		start, end := f.min, f.max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value: %s", part)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value: %s", part)
+				}
+			} else if step > 1 {
+				end = f.max
+			}
+		}
+		if start < f.min || end > f.max || start > end {
+			return 0, fmt.Errorf("value out of range [%d, %d]: %s", f.min, f.max, part)
+		}
+		for v := start; v <= end; v += step {
+			res |= 1 << uint(v)
+		}
+	}
+	return res, nil
+}
+
+func (s cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// there must be a tick in 5 years if the expression is valid, otherwise it's an impossible date like "0 0 30 2 *"
+	deadline := t.AddDate(5, 0, 0)
+	for t.Before(deadline) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s cronSchedule) matchDay(t time.Time) bool {
+	domMatched, dowMatched := s.dom&(1<<uint(t.Day())) != 0, s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domMatched || dowMatched
+	}
+	return domMatched && dowMatched
+}
@@ -0,0 +1,56 @@
+package gta
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func Test_parseSchedule(t *testing.T) {
+	convey.Convey("Test_parseSchedule", t, func() {
+		base := time.Date(2021, 5, 1, 10, 2, 30, 0, time.UTC) // saturday
+
+		convey.Convey("every", func() {
+			sch, err := parseSchedule("@every 1m30s")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(sch.next(base), convey.ShouldEqual, base.Add(time.Minute+30*time.Second))
+		})
+
+		convey.Convey("cron", func() {
+			cases := []struct {
+				spec string
+				next time.Time
+			}{
+				{"* * * * *", time.Date(2021, 5, 1, 10, 3, 0, 0, time.UTC)},
+				{"*/5 * * * *", time.Date(2021, 5, 1, 10, 5, 0, 0, time.UTC)},
+				{"0 9-17/4 * * *", time.Date(2021, 5, 1, 13, 0, 0, 0, time.UTC)},
+				{"30 8 * * 1-5", time.Date(2021, 5, 3, 8, 30, 0, 0, time.UTC)},
+				{"0 0 1,15 * *", time.Date(2021, 5, 15, 0, 0, 0, 0, time.UTC)},
+				{"0 0 15 * 7", time.Date(2021, 5, 2, 0, 0, 0, 0, time.UTC)},
+				{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+				{"@daily", time.Date(2021, 5, 2, 0, 0, 0, 0, time.UTC)},
+				{"@hourly", time.Date(2021, 5, 1, 11, 0, 0, 0, time.UTC)},
+			}
+			for _, c := range cases {
+				sch, err := parseSchedule(c.spec)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(sch.next(base), convey.ShouldEqual, c.next)
+			}
+		})
+
+		convey.Convey("impossible date", func() {
+			sch, err := parseSchedule("0 0 30 2 *")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(sch.next(base).IsZero(), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("error", func() {
+			for _, spec := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "a * * * *", "5-1 * * * *",
+				"@every 1ms", "@every x", "@unknown"} {
+				_, err := parseSchedule(spec)
+				convey.So(err, convey.ShouldNotBeNil)
+			}
+		})
+	})
+}
@@ -2,10 +2,13 @@ package gta
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/panjf2000/ants/v2"
@@ -13,30 +16,59 @@ import (
 )
 
 const (
-	transactionKey = "gta:transaction"
+	transactionKey  = "gta:transaction"
+	storeTxKey      = "gta:store_transaction"
+	maxCancelTimes  = 3
+	createBatchSize = 500
+	// stopGracePeriod is the least time Stop waits for the canceled tasks to return
+	stopGracePeriod = 5 * time.Second
 )
 
 type taskScheduler interface {
 	Transaction(fc func(tx *gorm.DB) error) error
-	CreateTask(tx *gorm.DB, ctxIn context.Context, key TaskKey, arg interface{}) error
+	CreateTask(tx *gorm.DB, ctxIn context.Context, key TaskKey, arg interface{}, opts RunOptions) (uint64, error)
+	CreateTasks(tx *gorm.DB, ctxIn context.Context, key TaskKey, args []interface{}) ([]uint64, error)
 	Stop(wait bool)
 	GoScheduleTask(task *Task)
-	CanSchedule() bool
+	GoRenewLeases()
+	GoWatchCancellation()
+	CancelTask(id uint64) error
+	FailTask(task *Task, err error)
+	AdvanceWorkflow(task *Task)
+	AdvanceWorkflowByID(workflowID uint64) error
+	Capacity(priority int) int
+	CanSchedule(priority int) bool
+	KeyCapacity(tx StoreTx, key TaskKey) (int, error)
+	CanScheduleKey(tx StoreTx, key TaskKey) (bool, error)
+	TakeKeyCapacity(tx StoreTx, key TaskKey, n int, running int) (int, error)
+	GiveBackKeyCapacity(key TaskKey, n int, committed bool) error
 }
 
 type taskSchedulerImp struct {
 	*options
 	register   taskRegister
-	dal        taskDAL
+	dal        Store
 	assembler  taskAssembler
+	limiter    taskRateLimiter
+	archiver   taskArchiver
 	pool       *ants.Pool
 	runningMap sync.Map
+	// runningMu serializes marking and unmarking, since a task may be claimed again before it's unmarked
+	runningMu sync.Mutex
+	// running count of each task key in current instance
+	keyRunningMap sync.Map
+	// scanSignal wakes up the scan process once an initialized task is created or a worker is freed
+	scanSignal signal
+	// finishSignal is notified once a task stops running in current instance
+	finishSignal signal
 }
 
 func (s *taskSchedulerImp) Transaction(fc func(tx *gorm.DB) error) error {
-	db := s.getDB().Set(transactionKey, &sync.Map{})
+	db := s.carrierDB().Set(transactionKey, &sync.Map{})
 
-	if err := db.Transaction(fc); err != nil {
+	if err := s.dal.Transaction(s.toStoreTx(db), func(tx StoreTx) error {
+		return fc(s.toGormTx(db, tx))
+	}); err != nil {
 		return err
 	}
 
@@ -49,67 +81,247 @@ func (s *taskSchedulerImp) Transaction(fc func(tx *gorm.DB) error) error {
 	return nil
 }
 
-func (s *taskSchedulerImp) CreateTask(tx *gorm.DB, ctxIn context.Context, key TaskKey, arg interface{}) error {
+func (s *taskSchedulerImp) CreateTask(tx *gorm.DB, ctxIn context.Context, key TaskKey, arg interface{},
+	opts RunOptions) (uint64, error) {
 	logger := s.loggerFactory(ctxIn)
+	stx := s.toStoreTx(tx)
 
+	if err := opts.verify(); err != nil {
+		return 0, err
+	}
 	taskDef, err := s.register.GetDefinition(key)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	task, err := s.assembler.AssembleTask(ctxIn, taskDef, arg)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if !opts.RunAt.IsZero() {
+		task.RunAt = opts.RunAt
+	}
+	if opts.Priority != nil {
+		task.Priority = *opts.Priority
+	}
+	if opts.OrderingKey != "" && !s.dryRun {
+		task.OrderingKey = &opts.OrderingKey
+	}
+	if opts.workflowID != 0 {
+		task.WorkflowID, task.DependsOn = &opts.workflowID, opts.dependsOn
+		task.Extra.Compensates, task.Extra.GroupCompletion = opts.compensates, opts.groupCompletion
+	}
+	if len(task.DependsOn) > 0 || task.Extra.Compensates != 0 || task.Extra.GroupCompletion {
+		// the task is promoted to 'initialized' once all its parents succeeded, once the saga failed for a
+		// compensating task, or once all the members finished for a group completion task
+		if err := s.createPendingTask(stx, task); err != nil {
+			return s.handleCreateErr(task, err)
+		}
+		logger.Infof("[CreateTask] async task created in transaction, task_key[%v], task_id[%v], task_status[%v], depends_on[%v]", key, task.ID, task.TaskStatus, task.DependsOn)
+		return task.ID, nil
+	}
+	if opts.DedupKey != "" && !s.dryRun {
+		if id, err := s.checkDuplicated(stx, key, opts); err != nil {
+			return id, err
+		}
+		task.DedupKey = &opts.DedupKey
 	}
 
 	select {
 	case <-s.done():
 		// may still accept create task requests when cancel signal is received
-		if err := s.createInitializedTask(tx, task); err != nil {
-			return err
+		if err := s.createInitializedTask(stx, task); err != nil {
+			return s.handleCreateErr(task, err)
 		}
 	default:
-		if toScheduleTasks, ok := tx.Get(transactionKey); ok {
+		if s.dryRun {
+			// assign a dummy id to this task in dry run mode
+			task.ID = rand.Uint64()
+			task.TaskStatus = TaskStatusRunning
+		}
+
+		if toScheduleTasks, ok := tx.Get(transactionKey); ok && !isDelayedTask(task) {
 			// buitin transaction, try to create running task
 			if !s.dryRun {
-				if s.CanSchedule() {
-					if err := s.createRunningTask(tx, task); err != nil {
-						return err
+				canSchedule, err := s.canRunAtOnce(stx, task)
+				if err != nil {
+					return 0, err
+				}
+				if canSchedule {
+					if err := s.createRunningTask(stx, task); err != nil {
+						return s.handleCreateErr(task, err)
 					}
 					toScheduleTasks.(*sync.Map).Store(task.ID, task)
 				} else {
-					if err := s.createInitializedTask(tx, task); err != nil {
-						return err
+					if err := s.createInitializedTask(stx, task); err != nil {
+						return s.handleCreateErr(task, err)
 					}
 				}
 			} else {
-				// assign a dummy id to this task in dry run mode
-				task.ID = rand.Uint64()
-				task.TaskStatus = TaskStatusRunning
 				// task will be scheduled after the transaction succeeded
 				toScheduleTasks.(*sync.Map).Store(task.ID, task)
 			}
 		} else {
-			// not builtin transaction, create initialized task
+			// not builtin transaction or delayed task, create initialized task
 			if !s.dryRun {
-				if err := s.createInitializedTask(tx, task); err != nil {
-					return err
+				if err := s.createInitializedTask(stx, task); err != nil {
+					return s.handleCreateErr(task, err)
 				}
+				// the task may not be visible until the transaction is committed, but the scan process will retry
+				// with short intervals after waking up
+				s.scanSignal.notify()
 			} else {
-				logger.Warnf("[CreateTask] Using dry run mode in non-builtin transaction, this task may be scheduled before the transaction is committed!")
-				// assign a dummy id to this task in dry run mode
-				task.ID = rand.Uint64()
-				task.TaskStatus = TaskStatusRunning
+				logger.Warnf("[CreateTask] Using dry run mode in non-builtin transaction or with delayed task, this task may be scheduled before the transaction is committed!")
 				go func() {
 					// wait for committing the transaction in dry run mode
 					time.Sleep(time.Millisecond * 500)
+					time.Sleep(time.Until(task.RunAt))
 					// note that the task will still be scheduled when the transaction is rolled back in dry run mode
 					s.GoScheduleTask(task)
 				}()
 			}
 		}
 	}
-	logger.Infof("[CreateTask] async task created in transaction, task_key[%v], task_id[%v], task_status[%v]", key, task.ID, task.TaskStatus)
-	return nil
+	if opts.workflowRoot && !s.dryRun {
+		// the ID of the first task is used as the workflow ID
+		workflowID := task.ID
+		if _, err := s.dal.UpdateWorkflowID(stx, task.ID, workflowID); err != nil {
+			return 0, err
+		}
+		task.WorkflowID = &workflowID
+	}
+	logger.Infof("[CreateTask] async task created in transaction, task_key[%v], task_id[%v], task_status[%v], run_at[%v]", key, task.ID, task.TaskStatus, task.RunAt)
+	return task.ID, nil
+}
+
+// CreateTasks creates the tasks of a key in batches with multi-row inserts. In the builtin transaction, the tasks within
+// the free capacity of current instance are run once the transaction is committed, and the others are left to the scan
+// process.
+func (s *taskSchedulerImp) CreateTasks(tx *gorm.DB, ctxIn context.Context, key TaskKey, args []interface{}) ([]uint64,
+	error) {
+	logger := s.loggerFactory(ctxIn)
+	stx := s.toStoreTx(tx)
+
+	taskIDs := make([]uint64, 0, len(args))
+	if len(args) == 0 {
+		return taskIDs, nil
+	} else if s.dryRun {
+		// nothing is inserted in dry run mode
+		for _, arg := range args {
+			taskID, err := s.CreateTask(tx, ctxIn, key, arg, RunOptions{})
+			if err != nil {
+				return nil, err
+			}
+			taskIDs = append(taskIDs, taskID)
+		}
+		return taskIDs, nil
+	}
+
+	taskDef, err := s.register.GetDefinition(key)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*Task, 0, len(args))
+	for _, arg := range args {
+		task, err := s.assembler.AssembleTask(ctxIn, taskDef, arg)
+		if err != nil {
+			return nil, err
+		}
+		task.TaskStatus = TaskStatusInitialized
+		tasks = append(tasks, task)
+	}
+
+	toScheduleTasks, builtin := tx.Get(transactionKey)
+	capacity := 0
+	select {
+	case <-s.done():
+		// may still accept create task requests when cancel signal is received
+	default:
+		if builtin {
+			if capacity, err = s.runAtOnceCapacity(stx, taskDef, toScheduleTasks.(*sync.Map), len(tasks)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i := 0; i < capacity && i < len(tasks); i++ {
+		tasks[i].TaskStatus = TaskStatusRunning
+		tasks[i].LeaseOwner, tasks[i].LeaseExpireAt = s.newLease()
+	}
+	if err := s.dal.CreateInBatches(stx, tasks, createBatchSize); err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		if task.TaskStatus == TaskStatusRunning {
+			toScheduleTasks.(*sync.Map).Store(task.ID, task)
+		}
+		taskIDs = append(taskIDs, task.ID)
+	}
+	if capacity < len(tasks) {
+		s.scanSignal.notify()
+	}
+	logger.Infof("[CreateTasks] async tasks created in transaction, task_key[%v], len[%v], running len[%v]", key, len(tasks), minInt64(int64(capacity), int64(len(tasks))))
+	return taskIDs, nil
+}
+
+// runAtOnceCapacity returns how many of the n tasks of the key created in the builtin transaction can be run once the
+// transaction is committed, i.e. the free workers not taken by the tasks created before in the transaction, which is
+// also limited by the concurrency and rate limits of the key.
+func (s *taskSchedulerImp) runAtOnceCapacity(tx StoreTx, taskDef *TaskDefinition, toScheduleTasks *sync.Map,
+	n int) (int, error) {
+	capacity := s.Capacity(taskDef.Priority)
+	toScheduleTasks.Range(func(key, value interface{}) bool {
+		capacity--
+		return true
+	})
+	if capacity <= 0 {
+		return 0, nil
+	}
+	return s.TakeKeyCapacity(tx, taskDef.key, int(minInt64(int64(capacity), int64(n))), 0)
+}
+
+// canRunAtOnce returns whether the task created in the builtin transaction can be run once the transaction is
+// committed, otherwise it's left to the scan process.
+func (s *taskSchedulerImp) canRunAtOnce(tx StoreTx, task *Task) (bool, error) {
+	if !s.CanSchedule(task.Priority) {
+		return false, nil
+	}
+	if task.OrderingKey != nil {
+		// the tasks of an ordering key are only claimed by the scan process, since the ones created by the transactions
+		// not committed yet can't be seen or locked here
+		return false, nil
+	}
+	capacity, err := s.TakeKeyCapacity(tx, task.TaskKey, 1, 0)
+	return capacity > 0, err
+}
+
+// checkDuplicated returns the ID of the existing task with the same dedup key inside the dedup window, or releases the
+// dedup key of the existing task if the window has passed.
+func (s *taskSchedulerImp) checkDuplicated(tx StoreTx, key TaskKey, opts RunOptions) (uint64, error) {
+	existing, err := s.dal.GetByDedupKey(tx, key, opts.DedupKey)
+	if err != nil {
+		return 0, err
+	} else if existing == nil {
+		return 0, nil
+	}
+	if opts.DedupWindow <= 0 || time.Since(existing.CreatedAt) < opts.DedupWindow {
+		return existing.ID, fmt.Errorf("%w: dedup_key[%v], task_id[%v]", ErrDuplicateTask, opts.DedupKey, existing.ID)
+	}
+	if _, err := s.dal.UpdateDedupKeyToNull(tx, existing.ID); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// handleCreateErr distinguishes the unique key conflict caused by a concurrent creation with the same dedup key. The
+// existing task is looked up outside the transaction, which may be aborted by the error, e.g. in PostgreSQL, or can't
+// see the task committed after its snapshot was taken, e.g. in MySQL with REPEATABLE READ.
+func (s *taskSchedulerImp) handleCreateErr(task *Task, err error) (uint64, error) {
+	if task.DedupKey == nil {
+		return 0, err
+	}
+	if existing, _ := s.dal.GetByDedupKey(s.getDB(), task.TaskKey, *task.DedupKey); existing != nil {
+		return existing.ID, fmt.Errorf("%w: dedup_key[%v], task_id[%v]", ErrDuplicateTask, *task.DedupKey, existing.ID)
+	}
+	return 0, err
 }
 
 func (s *taskSchedulerImp) Stop(wait bool) {
@@ -121,20 +333,34 @@ func (s *taskSchedulerImp) Stop(wait bool) {
 	if len(taskIDs) <= 0 {
 		return
 	}
-	// loop check and wait
-	waitStart := time.Now()
+	// wait until all the running tasks finished or the timeout is reached
+	var timeout <-chan time.Time
+	if !wait {
+		timeout = time.After(stopGracePeriod)
+	} else if s.waitTimeout > stopGracePeriod {
+		timeout = time.After(s.waitTimeout)
+	} else if s.waitTimeout > 0 {
+		// the canceled tasks are always given the grace period to return
+		timeout = time.After(stopGracePeriod)
+	}
 	for {
 		logger.Infof("[Stop] current running tasks len[%v], waiting...", len(taskIDs))
-		time.Sleep(5 * time.Second)
+		timedOut := false
+		select {
+		case <-s.finishSignal:
+		case <-timeout:
+			timedOut = true
+		}
 
 		taskIDs = s.runningTaskIDs()
 		if len(taskIDs) <= 0 {
 			logger.Infof("[Stop] current running tasks finished")
 			return
-		} else if !wait || (s.waitTimeout > 0 && time.Since(waitStart) > s.waitTimeout) {
+		} else if timedOut {
 			if !s.dryRun {
-				// change remaining tasks status to initialized
-				rowsAffected, err := s.dal.UpdateStatusByIDs(s.getDB(), taskIDs, TaskStatusRunning, TaskStatusInitialized)
+				// change remaining tasks status to initialized, except the ones reclaimed by others after the lease expired
+				leaseOwner, _ := s.newLease()
+				rowsAffected, err := s.dal.UpdateRunningToInitializedByLeaseOwner(s.getDB(), taskIDs, leaseOwner)
 				if err != nil {
 					logger.Errorf("[Stop] update task status from running to initialized failed, err[%v]", err)
 					return
@@ -155,11 +381,18 @@ func (s *taskSchedulerImp) GoScheduleTask(task *Task) {
 		logger.Errorf("[GoScheduleTask] invalid task status, task_key[%v], task_status[%v]", task.TaskKey, task.TaskStatus)
 		return
 	}
-	s.markRunning(task)
+	canceler, ok := s.markRunning(task)
+	if !ok {
+		// MaxConcurrency in current instance is reached, leave the task to the scan process
+		s.suspendTask(task, task.RunAt, "max concurrency reached")
+		return
+	}
 
 	f := func() {
 		defer panicHandler()
-		s.scheduleTask(task)
+		// the worker is freed once this function returns
+		defer s.scanSignal.notify()
+		s.scheduleTask(task, canceler)
 	}
 
 	if err := s.pool.Submit(f); err == ants.ErrPoolOverload {
@@ -168,53 +401,289 @@ func (s *taskSchedulerImp) GoScheduleTask(task *Task) {
 		// scan process so that we won't enter this branch in most cases.
 		go f()
 	} else if err != nil {
-		s.unmarkRunning(task)
+		s.unmarkRunning(task, canceler)
 		logger.Errorf("[GoScheduleTask] schedule task failed, err[%v], task_key[%v], task_id[%v]", err, task.TaskKey, task.ID)
 		return
 	}
 }
 
-func (s *taskSchedulerImp) CanSchedule() bool {
-	return s.pool.Free() > 0
+// suspendTask changes the running task which is not submitted to the pool back to 'initialized', so that it can be
+// claimed by the scan process after runAt.
+func (s *taskSchedulerImp) suspendTask(task *Task, runAt time.Time, reason string) {
+	logger := s.logger()
+	if _, err := s.dal.UpdateRunningToRetry(s.getDB(), task.ID, task.LeaseOwner, runAt, task.Extra); err != nil {
+		logger.Errorf("[suspendTask] change task status to initialized failed, err[%v], task_key[%v], task_id[%v]", err, task.TaskKey, task.ID)
+		return
+	}
+	logger.Warnf("[suspendTask] %v, task changed to initialized, run_at[%v], task_key[%v], task_id[%v]", reason, runAt, task.TaskKey, task.ID)
 }
 
-func (s *taskSchedulerImp) scheduleTask(task *Task) {
+func (s *taskSchedulerImp) GoRenewLeases() {
+	logger := s.logger()
+	renewInterval := s.leaseTimeout / 3
+	logger.Infof("[GoRenewLeases] lease renewal start, lease timeout[%v], renew interval[%v]", s.leaseTimeout, renewInterval)
+	go func() {
+		defer panicHandler()
+		for {
+			taskIDs := s.runningTaskIDs()
+			select {
+			case <-s.done():
+				// keep renewing until all running tasks finished in the stop process
+				if len(taskIDs) <= 0 {
+					return
+				}
+			default:
+			}
+			if len(taskIDs) > 0 {
+				if _, err := s.dal.UpdateLeaseByIDs(s.getDB(), taskIDs, s.instanceID, time.Now().Add(s.leaseTimeout)); err != nil {
+					logger.Errorf("[GoRenewLeases] renew leases failed, err[%v], running tasks len[%v]", err, len(taskIDs))
+				}
+			}
+			time.Sleep(renewInterval)
+		}
+	}()
+}
+
+func (s *taskSchedulerImp) GoWatchCancellation() {
+	logger := s.logger()
+	logger.Infof("[GoWatchCancellation] cancellation watch start, watch interval[%v]", s.scanInterval)
+	go func() {
+		defer panicHandler()
+		for {
+			taskIDs := s.runningTaskIDs()
+			select {
+			case <-s.done():
+				// keep watching until all running tasks finished in the stop process
+				if len(taskIDs) <= 0 {
+					return
+				}
+			default:
+			}
+			if len(taskIDs) > 0 {
+				s.watchCancellation(taskIDs)
+			}
+			time.Sleep(randomInterval(s.scanInterval))
+		}
+	}()
+}
+
+func (s *taskSchedulerImp) watchCancellation(taskIDs []uint64) {
+	logger := s.logger()
+	canceledIDs, err := s.dal.GetCancelRequestedIDs(s.getDB(), taskIDs)
+	if err != nil {
+		logger.Errorf("[watchCancellation] get cancel requested tasks failed, err[%v]", err)
+		return
+	}
+	for _, id := range canceledIDs {
+		if s.cancelRunning(id) {
+			logger.Warnf("[watchCancellation] running task canceled, task_id[%v]", id)
+		}
+	}
+}
+
+func (s *taskSchedulerImp) CancelTask(id uint64) error {
+	logger := s.logger()
+	if s.dryRun {
+		// only the tasks running in current instance can be canceled in dry run mode
+		if !s.cancelRunning(id) {
+			return ErrTaskNotFound
+		}
+		return nil
+	}
+
+	// the task status may be changed concurrently, e.g. claimed by the scan process, so try a few more times
+	for i := 0; i < maxCancelTimes; i++ {
+		task, err := s.dal.Get(s.getDB(), id)
+		if err != nil {
+			return err
+		} else if task == nil {
+			return ErrTaskNotFound
+		}
+
+		var rowsAffected int64
+		switch task.TaskStatus {
+		case TaskStatusPending, TaskStatusInitialized:
+			canceledAt := time.Now()
+			task.Extra.CanceledAt = &canceledAt
+			if rowsAffected, err = s.dal.UpdateStatusAndExtraByID(s.getDB(), id, task.TaskStatus, TaskStatusCanceled, task.Extra); err == nil && rowsAffected > 0 {
+				task.TaskStatus = TaskStatusCanceled
+				s.AdvanceWorkflow(task)
+			}
+		case TaskStatusRunning:
+			// the owner instance will cancel the handler once it finds the flag
+			if rowsAffected, err = s.dal.UpdateCancelRequested(s.getDB(), id); err == nil && rowsAffected > 0 {
+				s.cancelRunning(id)
+			}
+		default:
+			return fmt.Errorf("%w: task_id[%v], task_status[%v]", ErrTaskNotCancelable, id, task.TaskStatus)
+		}
+		if err != nil {
+			return err
+		} else if rowsAffected > 0 {
+			logger.Infof("[CancelTask] task cancel requested, task_key[%v], task_id[%v], task_status[%v]", task.TaskKey, id, task.TaskStatus)
+			return nil
+		}
+	}
+	return ErrZeroRowsAffected
+}
+
+// Capacity returns how many tasks with the priority can be submitted to the pool, the workers reserved by
+// reservedPoolSize are only available to tasks with positive priority.
+func (s *taskSchedulerImp) Capacity(priority int) int {
+	if priority > 0 {
+		return s.pool.Free()
+	}
+	return s.pool.Free() - s.reservedPoolSize
+}
+
+// CanSchedule returns whether a task with the priority can be submitted to the pool.
+func (s *taskSchedulerImp) CanSchedule(priority int) bool {
+	return s.Capacity(priority) > 0
+}
+
+// KeyCapacity returns how many tasks of the key can be run without exceeding its MaxConcurrency in current instance and
+// its MaxGlobalConcurrency across the cluster, or zero if its RateLimit is reached. For MaxGlobalConcurrency, the row of
+// the key in the rate limit table is locked in tx before the running tasks are counted, so that concurrent claims of
+// the same key are serialized even if none of its tasks is running.
+func (s *taskSchedulerImp) KeyCapacity(tx StoreTx, key TaskKey) (int, error) {
+	return s.keyCapacity(tx, key, 0)
+}
+
+// keyCapacity returns KeyCapacity plus the running tasks to be reclaimed, which are counted by MaxGlobalConcurrency
+// but don't run more tasks across the cluster.
+func (s *taskSchedulerImp) keyCapacity(tx StoreTx, key TaskKey, running int) (int, error) {
+	taskDef, err := s.register.GetDefinition(key)
+	if err != nil {
+		return 0, err
+	}
+	capacity := int64(math.MaxInt32)
+	if limit := taskDef.MaxConcurrency; limit > 0 && !s.dryRun {
+		capacity = minInt64(capacity, int64(limit)-s.runningCount(key))
+	}
+	if limit := taskDef.MaxGlobalConcurrency; limit > 0 && !s.dryRun && capacity > 0 {
+		if _, err := s.dal.LockRateLimitToken(tx, key); err != nil {
+			return 0, err
+		}
+		count, err := s.dal.CountRunningByKeyForUpdate(tx, key)
+		if err != nil {
+			return 0, err
+		}
+		capacity = minInt64(capacity, int64(limit)-count+int64(running))
+	}
+	if capacity <= 0 {
+		return 0, nil
+	}
+	if delay, err := s.limiter.Delay(tx, key); err != nil || delay > 0 {
+		return 0, err
+	}
+	return int(capacity), nil
+}
+
+// CanScheduleKey returns whether a task of the key can be run without exceeding its concurrency and rate limits. See
+// KeyCapacity for more information.
+func (s *taskSchedulerImp) CanScheduleKey(tx StoreTx, key TaskKey) (bool, error) {
+	capacity, err := s.KeyCapacity(tx, key)
+	return capacity > 0, err
+}
+
+// TakeKeyCapacity returns how many of the n tasks of the key can be claimed in tx, i.e. KeyCapacity capped by the rate
+// limit tokens taken for them in tx, so that the tasks claimed are started without taking the tokens again. running is
+// how many of the n tasks are the running ones to be reclaimed.
+func (s *taskSchedulerImp) TakeKeyCapacity(tx StoreTx, key TaskKey, n int, running int) (int, error) {
+	capacity, err := s.keyCapacity(tx, key, running)
+	if err != nil || capacity <= 0 || n <= 0 {
+		return 0, err
+	}
+	return s.limiter.Take(tx, key, int(minInt64(int64(capacity), int64(n))))
+}
+
+// GiveBackKeyCapacity gives back the rate limit tokens taken by TakeKeyCapacity for n tasks of the key not claimed after
+// all. committed tells whether the transaction taking them is committed.
+func (s *taskSchedulerImp) GiveBackKeyCapacity(key TaskKey, n int, committed bool) error {
+	return s.limiter.GiveBack(key, n, committed)
+}
+
+func (s *taskSchedulerImp) scheduleTask(task *Task, canceler *taskCanceler) {
 	logger := s.logger()
 	taskDef, _ := s.register.GetDefinition(task.TaskKey)
-	succeeded := false
+	succeeded, rescheduled := false, false
+	var lastErr error
 	startTime := time.Now()
 	logger.Infof("[scheduleTask] schedule task start, task_key[%v], task_id[%v]", task.TaskKey, task.ID)
 
 	defer func() {
 		var toStatus TaskStatus
 		cost := time.Since(startTime).Round(time.Millisecond)
+		if rescheduled {
+			err := s.rescheduleRunning(task, taskDef)
+			// the task is unmarked even if it's still running in the database, whose lease is no longer renewed so
+			// that it can be reclaimed once the lease expires, or reported by the abnormal task checker
+			s.unmarkRunning(task, canceler)
+			if err != nil {
+				logger.Errorf("[scheduleTask] reschedule running task error, err[%v], task_key[%v], task_id[%v]", err, task.TaskKey, task.ID)
+				return
+			}
+			logger.Warnf("[scheduleTask] schedule task rescheduled for retry, cost[%v], retry times[%v], run_at[%v], task_key[%v], task_id[%v]", cost, task.Extra.Retries, task.RunAt, task.TaskKey, task.ID)
+			return
+		}
 		if succeeded {
 			toStatus = TaskStatusSucceeded
 			logger.Infof("[scheduleTask] schedule task succeeded, cost[%v], task_key[%v], task_id[%v]", cost, task.TaskKey, task.ID)
+		} else if canceler.canceled() {
+			toStatus = TaskStatusCanceled
+			logger.Warnf("[scheduleTask] schedule task canceled, cost[%v], task_key[%v], task_id[%v]", cost, task.TaskKey, task.ID)
 		} else {
 			toStatus = TaskStatusFailed
 			logger.Errorf("[scheduleTask] schedule task failed, cost[%v], task_key[%v], task_id[%v]", cost, task.TaskKey, task.ID)
 		}
-		if err := s.stopRunning(task, taskDef, toStatus); err != nil {
-			logger.Errorf("[scheduleTask] change running task status error, err[%v], task_key[%v], task_id[%v]", err, task.TaskKey, task.ID)
-		}
-		task.TaskStatus = toStatus
-		s.unmarkRunning(task)
+		s.finishRunning(task, taskDef, toStatus, lastErr)
+		s.unmarkRunning(task, canceler)
 	}()
 
+	if taskDef.PersistentRetry {
+		// only one attempt in process, the retry is rescheduled through the database
+		if lastErr = s.attemptTask(taskDef, task, canceler); lastErr == nil {
+			succeeded = true
+		} else if task.Extra.Retries < taskDef.RetryTimes && !canceler.canceled() {
+			rescheduled = true
+		}
+		return
+	}
+
 	for times := 0; times <= taskDef.RetryTimes; times++ {
 		if times > 0 {
-			time.Sleep(taskDef.retryInterval(times))
+			if !canceler.wait(taskDef.retryInterval(times)) {
+				// canceled during the retry interval
+				break
+			}
 			logger.Warnf("[scheduleTask] start retry, current retry times[%v], task_key[%v], task_id[%v]", times, task.TaskKey, task.ID)
 		}
-		if err := s.executeTask(taskDef, task); err == nil {
+		if lastErr = s.attemptTask(taskDef, task, canceler); lastErr == nil {
 			succeeded = true
 			break
+		} else if canceler.canceled() {
+			break
+		} else if times < taskDef.RetryTimes {
+			// record the failed attempt in time in case of the process exits during retry
+			if err := s.updateRunningExtra(task); err != nil {
+				logger.Errorf("[scheduleTask] update running task extra error, err[%v], task_key[%v], task_id[%v]", err, task.TaskKey, task.ID)
+			}
 		}
 	}
 }
 
-func (s *taskSchedulerImp) executeTask(taskDef *TaskDefinition, task *Task) (err error) {
+func (s *taskSchedulerImp) attemptTask(taskDef *TaskDefinition, task *Task, canceler *taskCanceler) error {
+	attempt := TaskAttempt{Attempt: task.Extra.Attempts + 1, Instance: s.instanceID, StartedAt: time.Now()}
+	err := s.executeTask(taskDef, task, canceler)
+	attempt.FinishedAt = time.Now()
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	task.Extra.addAttempt(attempt)
+	return err
+}
+
+func (s *taskSchedulerImp) executeTask(taskDef *TaskDefinition, task *Task, canceler *taskCanceler) (err error) {
 	logger := s.logger()
 
 	startTime := time.Now()
@@ -236,7 +705,13 @@ func (s *taskSchedulerImp) executeTask(taskDef *TaskDefinition, task *Task) (err
 		err = fmt.Errorf("disassemble task error: %w", tempErr)
 		return
 	}
-	if tempErr := taskDef.Handler(ctxIn, argument); tempErr != nil {
+	// the handler can abort cooperatively once the task manager is stopped or the task is canceled, the values of the
+	// unmarshaled context are still available
+	ctxIn, cancel := withCancelSignal(ctxIn, s.done())
+	defer cancel()
+	ctxIn, cancelTask := withCancelSignal(ctxIn, canceler.done())
+	defer cancelTask()
+	if tempErr := s.handleTask(ctxIn, taskDef, argument); tempErr != nil {
 		err = fmt.Errorf("handle failed: %w", tempErr)
 		return
 	}
@@ -244,41 +719,371 @@ func (s *taskSchedulerImp) executeTask(taskDef *TaskDefinition, task *Task) (err
 	return nil
 }
 
+// handleTask calls the task handler with a deadline if the timeout is set. A handler that doesn't return in time is
+// abandoned to release the pool worker, and it's up to the handler itself to abort once its context is done. Note that
+// the abandoned handler may still be running when the task is retried or finished.
+func (s *taskSchedulerImp) handleTask(ctx context.Context, taskDef *TaskDefinition, arg interface{}) error {
+	timeout := taskDef.timeout(s.taskTimeout)
+	if timeout <= 0 {
+		return taskDef.Handler(ctx, arg)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errCh <- fmt.Errorf("panic: %v\n%s", r, string(debug.Stack()))
+			}
+		}()
+		errCh <- taskDef.Handler(ctx, arg)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%w: %v, err: %v", ErrTaskTimeout, timeout, err)
+		}
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%w: %v", ErrTaskTimeout, timeout)
+	}
+}
+
+// FailTask fails the running task leased by current instance without running it, e.g. the one whose lease expired
+// and max reclaim times exceeded. It's handled the same as the one failed by its handler.
+func (s *taskSchedulerImp) FailTask(task *Task, err error) {
+	taskDef, defErr := s.register.GetDefinition(task.TaskKey)
+	if defErr != nil {
+		s.logger().Errorf("[FailTask] get task definition error, err[%v], task_key[%v], task_id[%v]", defErr, task.TaskKey, task.ID)
+		return
+	}
+	s.finishRunning(task, taskDef, TaskStatusFailed, err)
+}
+
+// finishRunning changes the running task to the final status, and then calls OnFailed if failed and advances its
+// workflow.
+func (s *taskSchedulerImp) finishRunning(task *Task, taskDef *TaskDefinition, toStatus TaskStatus, err error) {
+	if stopErr := s.stopRunning(task, taskDef, toStatus); stopErr != nil {
+		s.logger().Errorf("[finishRunning] change running task status error, err[%v], task_key[%v], task_id[%v]", stopErr, task.TaskKey, task.ID)
+	}
+	task.TaskStatus = toStatus
+	if toStatus == TaskStatusFailed && taskDef.OnFailed != nil {
+		s.onFailed(taskDef, task, err)
+	}
+	s.AdvanceWorkflow(task)
+}
+
 func (s *taskSchedulerImp) stopRunning(task *Task, taskDef *TaskDefinition, toStatus TaskStatus) error {
+	// a rerun of the task should have a full retry budget
+	task.Extra.Retries = 0
+	if toStatus == TaskStatusCanceled {
+		canceledAt := time.Now()
+		task.Extra.CanceledAt = &canceledAt
+	}
 	if !s.dryRun {
 		if taskDef.CleanSucceeded && toStatus == TaskStatusSucceeded {
-			if rowsAffected, err := s.dal.DeleteByIDAndStatus(s.getDB(), task.ID, task.TaskStatus); err != nil {
+			return s.cleanSucceeded(task)
+		} else if toStatus == TaskStatusFailed && s.deadLetterTable != "" && !taskDef.looped() &&
+			task.WorkflowID == nil {
+			// the tasks in a workflow are kept in the task table, so that the workflow can be advanced and queried
+			return s.moveToDeadLetter(task)
+		} else {
+			if rowsAffected, err := s.dal.UpdateRunningByLeaseOwner(s.getDB(), task.ID, task.LeaseOwner, toStatus, task.Extra); err != nil {
 				return err
 			} else if rowsAffected == 0 {
 				return ErrZeroRowsAffected
 			}
-		} else {
-			if rowsAffected, err := s.dal.UpdateStatusByIDs(s.getDB(), []uint64{task.ID}, task.TaskStatus, toStatus); err != nil {
+		}
+	}
+	return nil
+}
+
+// moveToDeadLetter marks the running task failed and moves it to the dead letter table along with its attempt history.
+func (s *taskSchedulerImp) moveToDeadLetter(task *Task) error {
+	return s.dal.Transaction(s.getDB(), func(tx StoreTx) error {
+		if rowsAffected, err := s.dal.UpdateRunningByLeaseOwner(tx, task.ID, task.LeaseOwner, TaskStatusFailed, task.Extra); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return ErrZeroRowsAffected
+		}
+		failedTask, err := s.dal.GetForUpdate(tx, task.ID)
+		if err != nil {
+			return err
+		} else if failedTask == nil {
+			return ErrTaskNotFound
+		}
+		if err := s.dal.CreateDeadLetter(tx, failedTask); err != nil {
+			return err
+		}
+		if rowsAffected, err := s.dal.DeleteByIDAndStatus(tx, task.ID, TaskStatusFailed); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return ErrZeroRowsAffected
+		}
+		return nil
+	})
+}
+
+// cleanSucceeded marks the running task succeeded and deletes it, which is archived first if the archiver is enabled.
+func (s *taskSchedulerImp) cleanSucceeded(task *Task) error {
+	return s.dal.Transaction(s.getDB(), func(tx StoreTx) error {
+		if rowsAffected, err := s.dal.UpdateRunningByLeaseOwner(tx, task.ID, task.LeaseOwner, TaskStatusSucceeded, task.Extra); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return ErrZeroRowsAffected
+		}
+		if s.archiver.Enabled() {
+			succeededTask, err := s.dal.GetForUpdate(tx, task.ID)
+			if err != nil {
+				return err
+			} else if succeededTask == nil {
+				return ErrTaskNotFound
+			}
+			if err := s.archiver.Archive(tx, []Task{*succeededTask}); err != nil {
 				return err
-			} else if rowsAffected == 0 {
-				return ErrZeroRowsAffected
 			}
 		}
+		if rowsAffected, err := s.dal.DeleteByIDAndStatus(tx, task.ID, TaskStatusSucceeded); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return ErrZeroRowsAffected
+		}
+		return nil
+	})
+}
+
+func (s *taskSchedulerImp) onFailed(taskDef *TaskDefinition, task *Task, err error) {
+	defer panicHandler()
+	ctxIn, argument, tempErr := s.assembler.DisassembleTask(taskDef, task)
+	if tempErr != nil {
+		s.logger().Errorf("[onFailed] disassemble task error, err[%v], task_key[%v], task_id[%v]", tempErr, task.TaskKey, task.ID)
+		ctxIn = s.context
+	}
+	taskDef.OnFailed(ctxIn, argument, err)
+}
+
+// AdvanceWorkflow is called once a task in a workflow finished. The pending tasks of the workflow are promoted to
+// 'initialized' once all their parents succeeded, or terminated once any of their parents failed or was canceled.
+func (s *taskSchedulerImp) AdvanceWorkflow(task *Task) {
+	logger := s.logger()
+	if task.WorkflowID == nil || s.dryRun {
+		return
+	}
+	if err := s.advanceWorkflow(*task.WorkflowID, task); err != nil {
+		logger.Errorf("[AdvanceWorkflow] advance workflow failed, err[%v], workflow_id[%v]", err, *task.WorkflowID)
+	}
+}
+
+// AdvanceWorkflowByID advances the pending tasks of a workflow with the statuses in the database only, which resumes
+// the workflow if the process exited before it was advanced.
+func (s *taskSchedulerImp) AdvanceWorkflowByID(workflowID uint64) error {
+	if s.dryRun {
+		return nil
+	}
+	return s.advanceWorkflow(workflowID, nil)
+}
+
+func (s *taskSchedulerImp) advanceWorkflow(workflowID uint64, finished *Task) error {
+	logger := s.logger()
+	tasks, err := s.dal.GetSliceByWorkflowID(s.getDB(), workflowID)
+	if err != nil {
+		return err
+	}
+	statusMap := make(map[uint64]TaskStatus, len(tasks))
+	for _, t := range tasks {
+		statusMap[t.ID] = t.TaskStatus
+	}
+	if finished != nil {
+		// the finished task may have been cleaned
+		statusMap[finished.ID] = finished.TaskStatus
+	}
+	sagaFailed, sagaSucceeded := sagaStatus(tasks, statusMap)
+
+	// the parents are created before their children, so the termination is propagated downstream in one pass
+	for _, t := range tasks {
+		if t.TaskStatus != TaskStatusPending {
+			continue
+		}
+		if t.Extra.GroupCompletion {
+			if err := s.completeGroup(t, tasks, statusMap); err != nil {
+				return err
+			}
+			continue
+		}
+		if t.Extra.Compensates != 0 {
+			// a compensating task is needed only if its forward step succeeded and a later one failed
+			status, ok := statusMap[t.Extra.Compensates]
+			if !sagaFailed && !sagaSucceeded {
+				continue
+			} else if sagaSucceeded || (ok && status != TaskStatusSucceeded) {
+				if _, err := s.dal.DeleteByIDAndStatus(s.getDB(), t.ID, TaskStatusPending); err != nil {
+					return err
+				}
+				logger.Infof("[advanceWorkflow] compensating task not needed and deleted, task_key[%v], task_id[%v]", t.TaskKey, t.ID)
+				delete(statusMap, t.ID)
+				continue
+			}
+		}
+
+		toStatus, ready := TaskStatusUnKnown, true
+		for _, parentID := range t.DependsOn {
+			// a parent missing in the table was cleaned after succeeded
+			switch status, ok := statusMap[parentID]; {
+			case !ok || status == TaskStatusSucceeded:
+			case status == TaskStatusFailed || status == TaskStatusCanceled:
+				toStatus, t.Extra.Upstream = status, parentID
+			default:
+				ready = false
+			}
+			if toStatus != TaskStatusUnKnown {
+				break
+			}
+		}
+		if toStatus == TaskStatusUnKnown && !ready {
+			continue
+		} else if toStatus == TaskStatusUnKnown {
+			toStatus = TaskStatusInitialized
+		} else if toStatus == TaskStatusCanceled {
+			canceledAt := time.Now()
+			t.Extra.CanceledAt = &canceledAt
+		}
+		if rowsAffected, err := s.dal.UpdateStatusAndExtraByID(s.getDB(), t.ID, TaskStatusPending, toStatus, t.Extra); err != nil {
+			return err
+		} else if rowsAffected > 0 {
+			logger.Infof("[advanceWorkflow] pending task changed to %v, upstream[%v], task_key[%v], task_id[%v]", toStatus, t.Extra.Upstream, t.TaskKey, t.ID)
+		}
+		statusMap[t.ID] = toStatus
+	}
+	return nil
+}
+
+// completeGroup promotes the completion task of a group to 'initialized' with the aggregated result once all the
+// members finished.
+func (s *taskSchedulerImp) completeGroup(task Task, tasks []Task, statusMap map[uint64]TaskStatus) error {
+	logger := s.logger()
+	var result GroupResult
+	if err := json.Unmarshal(task.Argument, &result); err != nil {
+		return err
+	}
+	if result.aggregate(task.ID, tasks, statusMap) > 0 {
+		return nil
+	}
+	result.GroupID = *task.WorkflowID
+	argument, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, err := s.dal.UpdateStatusAndArgumentByID(s.getDB(), task.ID, TaskStatusPending, TaskStatusInitialized, argument); err != nil {
+		return err
+	} else if rowsAffected > 0 {
+		logger.Infof("[completeGroup] group completion task changed to initialized, result[%+v], task_key[%v], task_id[%v]", result, task.TaskKey, task.ID)
+	}
+	return nil
+}
+
+func (s *taskSchedulerImp) rescheduleRunning(task *Task, taskDef *TaskDefinition) error {
+	task.Extra.Retries++
+	task.RunAt = time.Now().Add(taskDef.retryInterval(task.Extra.Retries))
+	if !s.dryRun {
+		if rowsAffected, err := s.dal.UpdateRunningToRetry(s.getDB(), task.ID, task.LeaseOwner, task.RunAt, task.Extra); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return ErrZeroRowsAffected
+		}
+		task.TaskStatus = TaskStatusInitialized
+	} else {
+		go func() {
+			time.Sleep(time.Until(task.RunAt))
+			s.GoScheduleTask(task)
+		}()
+	}
+	return nil
+}
+
+func (s *taskSchedulerImp) updateRunningExtra(task *Task) error {
+	if !s.dryRun {
+		if rowsAffected, err := s.dal.UpdateRunningByLeaseOwner(s.getDB(), task.ID, task.LeaseOwner, TaskStatusRunning, task.Extra); err != nil {
+			return err
+		} else if rowsAffected == 0 {
+			return ErrZeroRowsAffected
+		}
 	}
 	return nil
 }
 
-func (s *taskSchedulerImp) createInitializedTask(tx *gorm.DB, task *Task) error {
+func (s *taskSchedulerImp) createPendingTask(tx StoreTx, task *Task) error {
+	task.TaskStatus = TaskStatusPending
+	return s.dal.Create(tx, task)
+}
+
+func (s *taskSchedulerImp) createInitializedTask(tx StoreTx, task *Task) error {
 	task.TaskStatus = TaskStatusInitialized
 	return s.dal.Create(tx, task)
 }
 
-func (s *taskSchedulerImp) createRunningTask(tx *gorm.DB, task *Task) error {
+func (s *taskSchedulerImp) createRunningTask(tx StoreTx, task *Task) error {
 	task.TaskStatus = TaskStatusRunning
+	task.LeaseOwner, task.LeaseExpireAt = s.newLease()
 	return s.dal.Create(tx, task)
 }
 
-func (s *taskSchedulerImp) markRunning(task *Task) {
-	s.runningMap.Store(task.ID, nil)
+// markRunning marks the task as running in current instance, false is returned if the MaxConcurrency of the task is
+// reached.
+func (s *taskSchedulerImp) markRunning(task *Task) (*taskCanceler, bool) {
+	limit := int64(0)
+	if taskDef, err := s.register.GetDefinition(task.TaskKey); err == nil && !s.dryRun {
+		limit = int64(taskDef.MaxConcurrency)
+	}
+	counter := s.runningCounter(task.TaskKey)
+	for {
+		n := atomic.LoadInt64(counter)
+		if limit > 0 && n >= limit {
+			return nil, false
+		}
+		if atomic.CompareAndSwapInt64(counter, n, n+1) {
+			break
+		}
+	}
+	canceler := newTaskCanceler()
+	s.runningMu.Lock()
+	s.runningMap.Store(task.ID, canceler)
+	s.runningMu.Unlock()
+	return canceler, true
 }
 
-func (s *taskSchedulerImp) unmarkRunning(task *Task) {
-	s.runningMap.Delete(task.ID)
+// unmarkRunning unmarks the task marked with the canceler, which is kept if the task is marked again by another
+// execution in the meantime.
+func (s *taskSchedulerImp) unmarkRunning(task *Task, canceler *taskCanceler) {
+	s.runningMu.Lock()
+	if value, ok := s.runningMap.Load(task.ID); ok && value.(*taskCanceler) == canceler {
+		s.runningMap.Delete(task.ID)
+	}
+	s.runningMu.Unlock()
+	atomic.AddInt64(s.runningCounter(task.TaskKey), -1)
+	s.finishSignal.notify()
+}
+
+func (s *taskSchedulerImp) runningCounter(key TaskKey) *int64 {
+	value, _ := s.keyRunningMap.LoadOrStore(key, new(int64))
+	return value.(*int64)
+}
+
+func (s *taskSchedulerImp) runningCount(key TaskKey) int64 {
+	return atomic.LoadInt64(s.runningCounter(key))
+}
+
+// cancelRunning cancels the task running in current instance, false is returned if the task is not found.
+func (s *taskSchedulerImp) cancelRunning(id uint64) bool {
+	value, ok := s.runningMap.Load(id)
+	if !ok {
+		return false
+	}
+	value.(*taskCanceler).cancel()
+	return true
 }
 
 func (s *taskSchedulerImp) runningTaskIDs() []uint64 {
@@ -289,3 +1094,46 @@ func (s *taskSchedulerImp) runningTaskIDs() []uint64 {
 	})
 	return res
 }
+
+func isDelayedTask(task *Task) bool {
+	return task.RunAt.After(time.Now())
+}
+
+// taskCanceler is used to cancel a task running in current instance.
+type taskCanceler struct {
+	ch   chan struct{}
+	once sync.Once
+}
+
+func newTaskCanceler() *taskCanceler {
+	return &taskCanceler{ch: make(chan struct{})}
+}
+
+func (c *taskCanceler) cancel() {
+	c.once.Do(func() { close(c.ch) })
+}
+
+func (c *taskCanceler) done() <-chan struct{} {
+	return c.ch
+}
+
+func (c *taskCanceler) canceled() bool {
+	select {
+	case <-c.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for the duration, false is returned if canceled during waiting.
+func (c *taskCanceler) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.ch:
+		return false
+	}
+}
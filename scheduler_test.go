@@ -2,6 +2,7 @@ package gta
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -18,7 +19,8 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 		tdal := &taskDALImp{options: tc}
 		tass := &taskAssemblerImp{options: tc}
 		pool, _ := ants.NewPool(tc.poolSize, ants.WithLogger(tc.logger()), ants.WithNonblocking(true))
-		tsch := &taskSchedulerImp{options: tc, register: tr, dal: tdal, assembler: tass, pool: pool}
+		tsch := &taskSchedulerImp{options: tc, register: tr, dal: tdal, assembler: tass, pool: pool,
+			limiter: &taskRateLimiterImp{options: tc, register: tr, dal: tdal}}
 		_ = tr.Register("t1", TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) { return nil }})
 		_ = tr.Register("t2", TaskDefinition{Handler: func(ctx context.Context, arg interface{}) (err error) { return ErrUnexpected }})
 
@@ -28,10 +30,10 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 					convey.Convey("not full pool", func() {
 						db := tc.getDB().Set(transactionKey, &sync.Map{})
 						err := db.Transaction(func(tx *gorm.DB) error {
-							if err := tsch.CreateTask(tx, context.TODO(), "t1", nil); err != nil {
+							if _, err := tsch.CreateTask(tx, context.TODO(), "t1", nil, RunOptions{}); err != nil {
 								return err
 							}
-							if err := tsch.CreateTask(tx, context.TODO(), "t2", nil); err != nil {
+							if _, err := tsch.CreateTask(tx, context.TODO(), "t2", nil, RunOptions{}); err != nil {
 								return err
 							}
 							return nil
@@ -39,16 +41,16 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 						convey.So(err, convey.ShouldBeNil)
 						convey.So(tsch.runningTaskIDs(), convey.ShouldHaveLength, 0)
 						m, _ := db.Get(transactionKey)
-						t1, ok1 := m.(*sync.Map).Load(uint64(1))
+						t1, ok1 := m.(*sync.Map).Load(uint64(10001))
 						convey.So(ok1, convey.ShouldBeTrue)
 						convey.So(t1.(*Task).TaskKey, convey.ShouldEqual, "t1")
-						t2, ok2 := m.(*sync.Map).Load(uint64(2))
+						t2, ok2 := m.(*sync.Map).Load(uint64(10002))
 						convey.So(ok2, convey.ShouldBeTrue)
 						convey.So(t2.(*Task).TaskKey, convey.ShouldEqual, "t2")
-						task1, _ := tdal.Get(tc.getDB(), 1)
+						task1, _ := tdal.Get(tc.getDB(), 10001)
 						convey.So(task1.TaskKey, convey.ShouldEqual, "t1")
 						convey.So(task1.TaskStatus, convey.ShouldEqual, TaskStatusRunning)
-						task2, _ := tdal.Get(tc.getDB(), 2)
+						task2, _ := tdal.Get(tc.getDB(), 10002)
 						convey.So(task2.TaskKey, convey.ShouldEqual, "t2")
 						convey.So(task2.TaskStatus, convey.ShouldEqual, TaskStatusRunning)
 					})
@@ -58,10 +60,10 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 						tsch.pool = pool
 						db := tc.getDB().Set(transactionKey, &sync.Map{})
 						err := db.Transaction(func(tx *gorm.DB) error {
-							if err := tsch.CreateTask(tx, context.TODO(), "t1", nil); err != nil {
+							if _, err := tsch.CreateTask(tx, context.TODO(), "t1", nil, RunOptions{}); err != nil {
 								return err
 							}
-							if err := tsch.CreateTask(tx, context.TODO(), "t2", nil); err != nil {
+							if _, err := tsch.CreateTask(tx, context.TODO(), "t2", nil, RunOptions{}); err != nil {
 								return err
 							}
 							return nil
@@ -69,14 +71,14 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 						convey.So(err, convey.ShouldBeNil)
 						convey.So(tsch.runningTaskIDs(), convey.ShouldHaveLength, 0)
 						m, _ := db.Get(transactionKey)
-						_, ok1 := m.(*sync.Map).Load(uint64(1))
+						_, ok1 := m.(*sync.Map).Load(uint64(10001))
 						convey.So(ok1, convey.ShouldBeFalse)
-						_, ok2 := m.(*sync.Map).Load(uint64(2))
+						_, ok2 := m.(*sync.Map).Load(uint64(10002))
 						convey.So(ok2, convey.ShouldBeFalse)
-						task1, _ := tdal.Get(tc.getDB(), 1)
+						task1, _ := tdal.Get(tc.getDB(), 10001)
 						convey.So(task1.TaskKey, convey.ShouldEqual, "t1")
 						convey.So(task1.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
-						task2, _ := tdal.Get(tc.getDB(), 2)
+						task2, _ := tdal.Get(tc.getDB(), 10002)
 						convey.So(task2.TaskKey, convey.ShouldEqual, "t2")
 						convey.So(task2.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
 					})
@@ -84,19 +86,19 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 				convey.Convey("transaction failed", func() {
 					db := tc.getDB().Set(transactionKey, &sync.Map{})
 					err := db.Transaction(func(tx *gorm.DB) error {
-						if err := tsch.CreateTask(tx, context.TODO(), "t1", nil); err != nil {
+						if _, err := tsch.CreateTask(tx, context.TODO(), "t1", nil, RunOptions{}); err != nil {
 							return err
 						}
-						if err := tsch.CreateTask(tx, context.TODO(), "t2", nil); err != nil {
+						if _, err := tsch.CreateTask(tx, context.TODO(), "t2", nil, RunOptions{}); err != nil {
 							return err
 						}
 						return ErrUnexpected
 					})
 					convey.So(err, convey.ShouldNotBeNil)
 					convey.So(tsch.runningTaskIDs(), convey.ShouldHaveLength, 0)
-					task1, _ := tdal.Get(tc.getDB(), 1)
+					task1, _ := tdal.Get(tc.getDB(), 10001)
 					convey.So(task1, convey.ShouldBeNil)
-					task2, _ := tdal.Get(tc.getDB(), 2)
+					task2, _ := tdal.Get(tc.getDB(), 10002)
 					convey.So(task2, convey.ShouldBeNil)
 				})
 			})
@@ -104,10 +106,10 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 				convey.Convey("transaction succeeded", func() {
 					db := tc.getDB()
 					err := db.Transaction(func(tx *gorm.DB) error {
-						if err := tsch.CreateTask(tx, context.TODO(), "t1", nil); err != nil {
+						if _, err := tsch.CreateTask(tx, context.TODO(), "t1", nil, RunOptions{}); err != nil {
 							return err
 						}
-						if err := tsch.CreateTask(tx, context.TODO(), "t2", nil); err != nil {
+						if _, err := tsch.CreateTask(tx, context.TODO(), "t2", nil, RunOptions{}); err != nil {
 							return err
 						}
 						return nil
@@ -116,20 +118,20 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 					convey.So(tsch.runningTaskIDs(), convey.ShouldHaveLength, 0)
 					_, ok := db.Get(transactionKey)
 					convey.So(ok, convey.ShouldBeFalse)
-					task1, _ := tdal.Get(tc.getDB(), 1)
+					task1, _ := tdal.Get(tc.getDB(), 10001)
 					convey.So(task1.TaskKey, convey.ShouldEqual, "t1")
 					convey.So(task1.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
-					task2, _ := tdal.Get(tc.getDB(), 2)
+					task2, _ := tdal.Get(tc.getDB(), 10002)
 					convey.So(task2.TaskKey, convey.ShouldEqual, "t2")
 					convey.So(task2.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
 				})
 				convey.Convey("transaction failed", func() {
 					db := tc.getDB()
 					err := db.Transaction(func(tx *gorm.DB) error {
-						if err := tsch.CreateTask(tx, context.TODO(), "t1", nil); err != nil {
+						if _, err := tsch.CreateTask(tx, context.TODO(), "t1", nil, RunOptions{}); err != nil {
 							return err
 						}
-						if err := tsch.CreateTask(tx, context.TODO(), "t2", nil); err != nil {
+						if _, err := tsch.CreateTask(tx, context.TODO(), "t2", nil, RunOptions{}); err != nil {
 							return err
 						}
 						return ErrUnexpected
@@ -138,9 +140,9 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 					convey.So(ok, convey.ShouldBeFalse)
 					convey.So(err, convey.ShouldNotBeNil)
 					convey.So(tsch.runningTaskIDs(), convey.ShouldHaveLength, 0)
-					task1, _ := tdal.Get(tc.getDB(), 1)
+					task1, _ := tdal.Get(tc.getDB(), 10001)
 					convey.So(task1, convey.ShouldBeNil)
-					task2, _ := tdal.Get(tc.getDB(), 2)
+					task2, _ := tdal.Get(tc.getDB(), 10002)
 					convey.So(task2, convey.ShouldBeNil)
 				})
 			})
@@ -149,24 +151,51 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 		convey.Convey("ctx cancelled", func() {
 			tc.cancel()
 
-			err := tsch.CreateTask(tc.getDB(), context.TODO(), "t1", nil)
+			_, err := tsch.CreateTask(tc.getDB(), context.TODO(), "t1", nil, RunOptions{})
 			convey.So(err, convey.ShouldBeNil)
 			convey.So(tsch.runningTaskIDs(), convey.ShouldHaveLength, 0)
-			task1, _ := tdal.Get(tc.getDB(), 1)
+			task1, _ := tdal.Get(tc.getDB(), 10001)
 			convey.So(task1.TaskKey, convey.ShouldEqual, "t1")
 			convey.So(task1.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
 		})
 
+		convey.Convey("duplicated by concurrent creation", func() {
+			dedupKey := "event_1"
+			_ = tdal.Create(tc.getDB(), &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized, DedupKey: &dedupKey})
+			id, err := tsch.handleCreateErr(&Task{TaskKey: "t1", DedupKey: &dedupKey}, ErrUnexpected)
+			convey.So(errors.Is(err, ErrDuplicateTask), convey.ShouldBeTrue)
+			convey.So(id, convey.ShouldEqual, 10001)
+			_, err = tsch.handleCreateErr(&Task{TaskKey: "t2", DedupKey: &dedupKey}, ErrUnexpected)
+			convey.So(err, convey.ShouldEqual, ErrUnexpected)
+		})
+
+		convey.Convey("duplicated by concurrent creation in transaction", func() {
+			dedupKey := "event_1"
+			// the task created by the other one is invisible to the transaction, e.g. in its snapshot
+			tsch.dal = &testSnapshotStore{Store: tdal, db: tc.getDB()}
+			var id, otherID uint64
+			err := tc.getDB().Transaction(func(tx *gorm.DB) (err error) {
+				// committed by the other one after the transaction began
+				if otherID, err = tsch.CreateTask(tc.getDB(), context.TODO(), "t1", nil, RunOptions{DedupKey: dedupKey}); err != nil {
+					return err
+				}
+				id, err = tsch.CreateTask(tx, context.TODO(), "t1", nil, RunOptions{DedupKey: dedupKey})
+				return err
+			})
+			convey.So(errors.Is(err, ErrDuplicateTask), convey.ShouldBeTrue)
+			convey.So(id, convey.ShouldEqual, otherID)
+		})
+
 		convey.Convey("dry run mode", func() {
 			tc.dryRun = true
 
 			convey.Convey("built in transaction", func() {
 				db := tc.getDB().Set(transactionKey, &sync.Map{})
 				err := db.Transaction(func(tx *gorm.DB) error {
-					if err := tsch.CreateTask(tx, context.TODO(), "t1", nil); err != nil {
+					if _, err := tsch.CreateTask(tx, context.TODO(), "t1", nil, RunOptions{}); err != nil {
 						return err
 					}
-					if err := tsch.CreateTask(tx, context.TODO(), "t2", nil); err != nil {
+					if _, err := tsch.CreateTask(tx, context.TODO(), "t2", nil, RunOptions{}); err != nil {
 						return err
 					}
 					return nil
@@ -181,18 +210,18 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 					return true
 				})
 				convey.So(count, convey.ShouldEqual, 2)
-				task1, _ := tdal.Get(tc.getDB(), 1)
+				task1, _ := tdal.Get(tc.getDB(), 10001)
 				convey.So(task1, convey.ShouldBeNil)
-				task2, _ := tdal.Get(tc.getDB(), 2)
+				task2, _ := tdal.Get(tc.getDB(), 10002)
 				convey.So(task2, convey.ShouldBeNil)
 			})
 			convey.Convey("non built in transaction", func() {
 				db := tc.getDB()
 				err := db.Transaction(func(tx *gorm.DB) error {
-					if err := tsch.CreateTask(tx, context.TODO(), "t1", nil); err != nil {
+					if _, err := tsch.CreateTask(tx, context.TODO(), "t1", nil, RunOptions{}); err != nil {
 						return err
 					}
-					if err := tsch.CreateTask(tx, context.TODO(), "t2", nil); err != nil {
+					if _, err := tsch.CreateTask(tx, context.TODO(), "t2", nil, RunOptions{}); err != nil {
 						return err
 					}
 					return nil
@@ -201,9 +230,9 @@ func Test_taskSchedulerImp_CreateTask(t *testing.T) {
 				convey.So(tsch.runningTaskIDs(), convey.ShouldHaveLength, 0)
 				_, ok := db.Get(transactionKey)
 				convey.So(ok, convey.ShouldBeFalse)
-				task1, _ := tdal.Get(tc.getDB(), 1)
+				task1, _ := tdal.Get(tc.getDB(), 10001)
 				convey.So(task1, convey.ShouldBeNil)
-				task2, _ := tdal.Get(tc.getDB(), 2)
+				task2, _ := tdal.Get(tc.getDB(), 10002)
 				convey.So(task2, convey.ShouldBeNil)
 			})
 		})
@@ -221,7 +250,8 @@ func Test_taskSchedulerImp_GoScheduleTask(t *testing.T) {
 		tdal := &taskDALImp{options: tc}
 		tass := &taskAssemblerImp{options: tc}
 		pool, _ := ants.NewPool(tc.poolSize, ants.WithLogger(tc.logger()), ants.WithNonblocking(true))
-		tsch := &taskSchedulerImp{options: tc, register: tr, dal: tdal, assembler: tass, pool: pool}
+		tsch := &taskSchedulerImp{options: tc, register: tr, dal: tdal, assembler: tass, pool: pool,
+			limiter: &taskRateLimiterImp{options: tc, register: tr, dal: tdal}}
 		var t1Run int64
 		_ = tr.Register("t1", TaskDefinition{Handler: testCountHandler(&t1Run)})
 
@@ -238,6 +268,29 @@ func Test_taskSchedulerImp_GoScheduleTask(t *testing.T) {
 			convey.So(t1Run, convey.ShouldEqual, 1)
 		})
 
+		convey.Convey("reschedule", func() {
+			_ = tr.Register("t2", TaskDefinition{
+				Handler:         func(ctx context.Context, arg interface{}) (err error) { return ErrUnexpected },
+				RetryTimes:      1,
+				PersistentRetry: true,
+			})
+			convey.Convey("succeeded", func() {
+				_ = tdal.Create(tc.getDB(), &Task{ID: 10001, TaskKey: "t2", TaskStatus: TaskStatusRunning})
+				tsch.GoScheduleTask(&Task{ID: 10001, TaskKey: "t2", TaskStatus: TaskStatusRunning})
+				time.Sleep(time.Second)
+				convey.So(tsch.runningTaskIDs(), convey.ShouldBeEmpty)
+				task, _ := tdal.Get(tc.getDB(), 10001)
+				convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
+			})
+			convey.Convey("failed", func() {
+				// the task is unmarked and left to the lease expiration even if it's not changed in the database
+				tsch.GoScheduleTask(&Task{ID: 10001, TaskKey: "t2", TaskStatus: TaskStatusRunning})
+				time.Sleep(time.Second)
+				convey.So(tsch.runningTaskIDs(), convey.ShouldBeEmpty)
+				convey.So(tsch.runningCount("t2"), convey.ShouldEqual, 0)
+			})
+		})
+
 		convey.Convey("error", func() {
 			pool.Release()
 			tsch.GoScheduleTask(&Task{ID: 10001, TaskKey: "t1", TaskStatus: TaskStatusRunning})
@@ -246,3 +299,48 @@ func Test_taskSchedulerImp_GoScheduleTask(t *testing.T) {
 		})
 	})
 }
+
+func Test_taskSchedulerImp_CanSchedule(t *testing.T) {
+	convey.Convey("Test_taskSchedulerImp_CanSchedule", t, func() {
+		tc, _ := newOptions(testDB("Test_taskSchedulerImp_CanSchedule"), "tasks", WithPoolSize(2),
+			WithReservedPoolSize(1))
+		pool, _ := ants.NewPool(tc.poolSize, ants.WithNonblocking(true))
+		defer pool.Release()
+		tsch := &taskSchedulerImp{options: tc, pool: pool}
+		convey.So(tsch.CanSchedule(0), convey.ShouldBeTrue)
+		convey.So(tsch.CanSchedule(1), convey.ShouldBeTrue)
+
+		_ = pool.Submit(func() { time.Sleep(time.Hour) })
+		convey.So(tsch.CanSchedule(0), convey.ShouldBeFalse)
+		convey.So(tsch.CanSchedule(1), convey.ShouldBeTrue)
+
+		_ = pool.Submit(func() { time.Sleep(time.Hour) })
+		convey.So(tsch.CanSchedule(1), convey.ShouldBeFalse)
+	})
+}
+
+func Test_taskCanceler(t *testing.T) {
+	convey.Convey("Test_taskCanceler", t, func() {
+		c := newTaskCanceler()
+		convey.So(c.canceled(), convey.ShouldBeFalse)
+		convey.So(c.wait(time.Millisecond), convey.ShouldBeTrue)
+		c.cancel()
+		c.cancel()
+		convey.So(c.canceled(), convey.ShouldBeTrue)
+		convey.So(c.wait(time.Hour), convey.ShouldBeFalse)
+	})
+}
+
+// testSnapshotStore hides the tasks with dedup keys from the transactions, as if they were committed after the
+// snapshots of the transactions were taken.
+type testSnapshotStore struct {
+	Store
+	db *gorm.DB
+}
+
+func (s *testSnapshotStore) GetByDedupKey(tx StoreTx, key TaskKey, dedupKey string) (*Task, error) {
+	if tx != StoreTx(s.db) {
+		return nil, nil
+	}
+	return s.Store.GetByDedupKey(tx, key, dedupKey)
+}
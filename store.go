@@ -0,0 +1,88 @@
+package gta
+
+import (
+	"time"
+)
+
+// StoreTx is the handle passed to the methods of a Store, which is either the db passed to NewTaskManager or a
+// transaction started by Store.Transaction. It's opaque to the task manager, e.g. it's a *gorm.DB for the builtin
+// store, and a store not relying on gorm can use its own transaction type and ignore the db.
+type StoreTx interface{}
+
+// Store is the storage of the tasks, the dead letters, the archived tasks and the global rate limit tokens. Every
+// method takes the db or the transaction started by Transaction as its first argument. The conditional updates and
+// deletes return the number of rows affected, and the lookups return nil without error if nothing is found.
+type Store interface {
+	// Transaction runs fc in a transaction started from db, which is committed if fc returns nil, or rolled back
+	// otherwise. If db is already a transaction of the store, fc runs in it.
+	Transaction(db StoreTx, fc func(tx StoreTx) error) error
+	// SupportsSkipLocked returns whether the rows locked by other transactions can be skipped when selected for update.
+	SupportsSkipLocked(db StoreTx) bool
+
+	Create(tx StoreTx, task *Task) error
+	CreateInBatches(tx StoreTx, tasks []*Task, batchSize int) error
+	CreateDeadLetter(tx StoreTx, task *Task) error
+	CreateArchives(tx StoreTx, tasks []Task) error
+
+	Get(tx StoreTx, id uint64) (*Task, error)
+	GetForUpdate(tx StoreTx, id uint64) (*Task, error)
+	GetInitializedSlice(tx StoreTx, sensitiveKeys []TaskKey, offset time.Duration, insensitiveKeys []TaskKey,
+		minPriority int, limit int) ([]Task, error)
+	// GetInitializedSliceForUpdate is only used if SupportsSkipLocked returns true, so that the initialized tasks are
+	// selected and claimed in one transaction.
+	GetInitializedSliceForUpdate(tx StoreTx, sensitiveKeys []TaskKey, offset time.Duration, insensitiveKeys []TaskKey,
+		minPriority int, limit int) ([]Task, error)
+	// GetSliceByOffsetsAndStatus returns the tasks of the status whose later one of updated_at and run_at is between
+	// startOffset and endOffset ago.
+	GetSliceByOffsetsAndStatus(tx StoreTx, startOffset, endOffset time.Duration, status TaskStatus) ([]Task, error)
+	GetSliceByOffsetAndStatusesForUpdate(tx StoreTx, offset time.Duration, statuses []TaskStatus,
+		excludeKeys []TaskKey, limit int) ([]Task, error)
+	GetSliceExcludeSucceeded(tx StoreTx, excludeKeys []TaskKey, limit, offset int) ([]Task, error)
+	// GetLeaseExpiredSlice returns the running tasks whose lease expired, in the order their leases expired.
+	GetLeaseExpiredSlice(tx StoreTx, keys []TaskKey, minPriority int, limit int) ([]Task, error)
+	GetByDedupKey(tx StoreTx, key TaskKey, dedupKey string) (*Task, error)
+	GetCancelRequestedIDs(tx StoreTx, ids []uint64) ([]uint64, error)
+	GetDeadLetter(tx StoreTx, id uint64) (*Task, error)
+	GetSliceByWorkflowID(tx StoreTx, workflowID uint64) ([]Task, error)
+	GetPendingWorkflowIDs(tx StoreTx, offset time.Duration) ([]uint64, error)
+	GetDeadLetterSlice(tx StoreTx, limit, offset int) ([]Task, error)
+	GetArchiveSlice(tx StoreTx, limit, offset int) ([]Task, error)
+	// CountRunningByKeyForUpdate counts the running tasks of the key with a locking read, so that the tasks claimed by
+	// the transactions committed before are counted.
+	CountRunningByKeyForUpdate(tx StoreTx, key TaskKey) (int64, error)
+	GetRateLimitToken(tx StoreTx, key TaskKey) (*RateLimitToken, error)
+	// LockRateLimitToken locks the token of the key in tx, which is created with zero tokens refilled at the zero
+	// time, i.e. a full bucket, if not exists. The transactions locking the token of the same key are serialized, even
+	// the ones changing nothing else of it.
+	LockRateLimitToken(tx StoreTx, key TaskKey) (*RateLimitToken, error)
+	UpdateRateLimitToken(tx StoreTx, token *RateLimitToken) (int64, error)
+
+	Update(tx StoreTx, task *Task) (int64, error)
+	// UpdateStatusByIDs, UpdateRunningToRetry and UpdateRunningToInitializedByLeaseOwner reset cancel_requested, so
+	// that a cancellation requested for the previous run doesn't cancel the next one.
+	UpdateStatusByIDs(tx StoreTx, taskIDs []uint64, ori TaskStatus, new TaskStatus) (int64, error)
+	UpdateStatusAndExtraByID(tx StoreTx, id uint64, ori TaskStatus, new TaskStatus, extra TaskExtra) (int64, error)
+	UpdateStatusAndArgumentByID(tx StoreTx, id uint64, ori TaskStatus, new TaskStatus, argument []byte) (int64, error)
+	// UpdateRunningByLeaseOwner, UpdateRunningToRetry and UpdateRunningToInitializedByLeaseOwner only update the tasks
+	// running with the lease owner, so that an instance whose lease expired cannot overwrite the tasks reclaimed by
+	// another one.
+	UpdateRunningByLeaseOwner(tx StoreTx, id uint64, leaseOwner string, new TaskStatus, extra TaskExtra) (int64, error)
+	UpdateRunningToRetry(tx StoreTx, id uint64, leaseOwner string, runAt time.Time, extra TaskExtra) (int64, error)
+	// UpdateRunningToInitializedByLeaseOwner changes the tasks back to initialized and clears their leases.
+	UpdateRunningToInitializedByLeaseOwner(tx StoreTx, ids []uint64, leaseOwner string) (int64, error)
+	UpdateInitializedToRunningByIDs(tx StoreTx, ids []uint64, leaseOwner string, leaseExpireAt *time.Time) ([]uint64,
+		error)
+	UpdateLeaseExpired(tx StoreTx, oriLeaseOwner string, task *Task) (int64, error)
+	UpdateLeaseByIDs(tx StoreTx, ids []uint64, leaseOwner string, leaseExpireAt time.Time) (int64, error)
+	UpdateDedupKeyToNull(tx StoreTx, id uint64) (int64, error)
+	UpdateCancelRequested(tx StoreTx, id uint64) (int64, error)
+	UpdateWorkflowID(tx StoreTx, id uint64, workflowID uint64) (int64, error)
+
+	// DeleteByOffsetAndStatuses deletes at most limit tasks whose IDs are greater than afterID, and returns the largest
+	// ID of the range deleted, 0 if no more tasks remain after it.
+	DeleteByOffsetAndStatuses(tx StoreTx, offset time.Duration, statuses []TaskStatus, excludeKeys []TaskKey,
+		afterID uint64, limit int) (uint64, int64, error)
+	DeleteByIDAndStatus(tx StoreTx, id uint64, status TaskStatus) (int64, error)
+	DeleteByIDsAndStatuses(tx StoreTx, ids []uint64, statuses []TaskStatus) (int64, error)
+	DeleteDeadLetterByID(tx StoreTx, id uint64) (int64, error)
+}
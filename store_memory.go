@@ -0,0 +1,953 @@
+package gta
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryStore is a Store keeping everything in memory, which makes it possible to run the tasks without a database,
+// e.g. in the unit tests of the handlers. A transaction keeps the records it writes to itself until commit, and reads
+// the ones committed by the others in the meantime as well. It fails with ErrStoreConflict on commit if any record it
+// wrote or locked is written by another transaction committed after it was first read. Only the transactions started
+// by Transaction are tracked, and the operations with other handles are committed at once.
+type MemoryStore struct {
+	mu       sync.Mutex
+	state    *memoryState
+	versions map[memoryKey]uint64
+	// sequence of the latest commit
+	seq    uint64
+	lastID uint64
+}
+
+// NewMemoryStore creates an empty MemoryStore. The store should be shared by the task managers to simulate multiple
+// instances.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		state: &memoryState{
+			tasks:       make(map[uint64]Task),
+			deadLetters: make(map[uint64]Task),
+			archives:    make(map[uint64]Task),
+			tokens:      make(map[TaskKey]RateLimitToken),
+		},
+		versions: make(map[memoryKey]uint64),
+		// the IDs generated start above the ones of the periodic and builtin tasks
+		lastID: 10000,
+	}
+}
+
+type memoryTable int
+
+const (
+	memoryTableTasks memoryTable = iota
+	memoryTableDeadLetters
+	memoryTableArchives
+	memoryTableRateLimitTokens
+)
+
+// memoryKey identifies a record of the MemoryStore.
+type memoryKey struct {
+	table memoryTable
+	id    uint64
+	key   TaskKey
+}
+
+type memoryState struct {
+	tasks       map[uint64]Task
+	deadLetters map[uint64]Task
+	archives    map[uint64]Task
+	tokens      map[TaskKey]RateLimitToken
+}
+
+// rows returns the records of the table of tasks.
+func (s *memoryState) rows(table memoryTable) map[uint64]Task {
+	switch table {
+	case memoryTableDeadLetters:
+		return s.deadLetters
+	case memoryTableArchives:
+		return s.archives
+	default:
+		return s.tasks
+	}
+}
+
+// memoryTx is a transaction of the MemoryStore.
+type memoryTx struct {
+	store *MemoryStore
+	// records written by the transaction, the deleted ones are kept as empty records
+	writes map[memoryKey]memoryRecord
+	// versions of the records written or locked by the transaction when they were first read
+	versions map[memoryKey]uint64
+}
+
+// memoryRecord is a task or a rate limit token written by a transaction, which is deleted if both are nil.
+type memoryRecord struct {
+	task  *Task
+	token *RateLimitToken
+}
+
+func (s *MemoryStore) Transaction(db StoreTx, fc func(tx StoreTx) error) error {
+	if t, ok := db.(*memoryTx); ok && t.store == s {
+		// the nested transaction is merged into the outer one
+		return fc(t)
+	}
+	t := &memoryTx{store: s, writes: make(map[memoryKey]memoryRecord), versions: make(map[memoryKey]uint64)}
+	// nothing is written to the store if fc fails or panics
+	if err := fc(t); err != nil {
+		return err
+	}
+	return s.commit(t)
+}
+
+// SupportsSkipLocked returns false, since there are no locks in the MemoryStore.
+func (s *MemoryStore) SupportsSkipLocked(tx StoreTx) bool {
+	return false
+}
+
+func (s *MemoryStore) commit(t *memoryTx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, version := range t.versions {
+		if s.versions[k] != version {
+			// first committer wins
+			return ErrStoreConflict
+		}
+	}
+	dedupKeys := make(map[taskDedupKey]struct{})
+	for k, record := range t.writes {
+		if k.table == memoryTableTasks && record.task != nil && record.task.DedupKey != nil {
+			dedupKeys[taskDedupKey{key: record.task.TaskKey, dedupKey: *record.task.DedupKey}] = struct{}{}
+		}
+	}
+	if len(dedupKeys) > 0 {
+		// the tasks with the same dedup key may be created by the transactions committed in the meantime
+		for id, task := range s.state.tasks {
+			if _, ok := t.writes[memoryKey{table: memoryTableTasks, id: id}]; ok || task.DedupKey == nil {
+				continue
+			}
+			if _, ok := dedupKeys[taskDedupKey{key: task.TaskKey, dedupKey: *task.DedupKey}]; ok {
+				return fmt.Errorf("%w: dedup_key[%v]", ErrStoreDuplicateKey, *task.DedupKey)
+			}
+		}
+	}
+
+	s.seq++
+	for k, record := range t.writes {
+		s.versions[k] = s.seq
+		if k.table == memoryTableRateLimitTokens {
+			if record.token != nil {
+				s.state.tokens[k.key] = *record.token
+			} else {
+				delete(s.state.tokens, k.key)
+			}
+			continue
+		}
+		if rows := s.state.rows(k.table); record.task != nil {
+			rows[k.id] = *record.task
+		} else {
+			delete(rows, k.id)
+		}
+	}
+	return nil
+}
+
+// memoryView is the records seen by an operation, i.e. the ones committed overlaid with the ones written by the
+// transaction if any. The records are never modified in place, so they can be shared by the store and the
+// transactions.
+type memoryView struct {
+	store *MemoryStore
+	tx    *memoryTx
+	// records written without a transaction, which are committed at once
+	written []memoryKey
+}
+
+// exec runs fc on the view of the transaction carried by tx, or on the store directly, in which case the records
+// written are committed at once.
+func (s *MemoryStore) exec(tx StoreTx, fc func(v *memoryView) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := &memoryView{store: s}
+	if t, ok := tx.(*memoryTx); ok && t.store == s {
+		v.tx = t
+		return fc(v)
+	}
+	err := fc(v)
+	if len(v.written) > 0 {
+		s.seq++
+		for _, k := range v.written {
+			s.versions[k] = s.seq
+		}
+	}
+	return err
+}
+
+func (v *memoryView) task(table memoryTable, id uint64) (Task, bool) {
+	if v.tx != nil {
+		if record, ok := v.tx.writes[memoryKey{table: table, id: id}]; ok {
+			if record.task == nil {
+				return Task{}, false
+			}
+			return *record.task, true
+		}
+	}
+	task, ok := v.store.state.rows(table)[id]
+	return task, ok
+}
+
+// tasks returns the records of the table in no particular order.
+func (v *memoryView) tasks(table memoryTable) []Task {
+	rows := v.store.state.rows(table)
+	res := make([]Task, 0, len(rows))
+	for id, task := range rows {
+		if v.tx != nil {
+			if _, ok := v.tx.writes[memoryKey{table: table, id: id}]; ok {
+				continue
+			}
+		}
+		res = append(res, task)
+	}
+	if v.tx != nil {
+		for k, record := range v.tx.writes {
+			if k.table == table && record.task != nil {
+				res = append(res, *record.task)
+			}
+		}
+	}
+	return res
+}
+
+// lock makes the transaction conflict with the others writing the record after it's read.
+func (v *memoryView) lock(k memoryKey) {
+	if v.tx == nil {
+		return
+	}
+	if _, ok := v.tx.versions[k]; !ok {
+		v.tx.versions[k] = v.store.versions[k]
+	}
+}
+
+// write writes the record, which is deleted if both of the task and the token are nil.
+func (v *memoryView) write(k memoryKey, record memoryRecord) {
+	if v.tx != nil {
+		v.lock(k)
+		v.tx.writes[k] = record
+		return
+	}
+	switch {
+	case record.token != nil:
+		v.store.state.tokens[k.key] = *record.token
+	case record.task != nil:
+		v.store.state.rows(k.table)[k.id] = *record.task
+	case k.table == memoryTableRateLimitTokens:
+		delete(v.store.state.tokens, k.key)
+	default:
+		delete(v.store.state.rows(k.table), k.id)
+	}
+	v.written = append(v.written, k)
+}
+
+func (v *memoryView) putTask(table memoryTable, task Task) {
+	v.write(memoryKey{table: table, id: task.ID}, memoryRecord{task: &task})
+}
+
+func (v *memoryView) removeTask(table memoryTable, id uint64) {
+	v.write(memoryKey{table: table, id: id}, memoryRecord{})
+}
+
+func (v *memoryView) token(key TaskKey) (RateLimitToken, bool) {
+	if v.tx != nil {
+		if record, ok := v.tx.writes[memoryKey{table: memoryTableRateLimitTokens, key: key}]; ok {
+			if record.token == nil {
+				return RateLimitToken{}, false
+			}
+			return *record.token, true
+		}
+	}
+	token, ok := v.store.state.tokens[key]
+	return token, ok
+}
+
+func (v *memoryView) putToken(token RateLimitToken) {
+	v.write(memoryKey{table: memoryTableRateLimitTokens, key: token.TaskKey}, memoryRecord{token: &token})
+}
+
+func (v *memoryView) getByDedupKey(key TaskKey, dedupKey string) *Task {
+	for _, task := range v.tasks(memoryTableTasks) {
+		if task.TaskKey == key && task.DedupKey != nil && *task.DedupKey == dedupKey {
+			return &task
+		}
+	}
+	return nil
+}
+
+// assignID assigns an auto increment ID to the task if it has none.
+func (s *MemoryStore) assignID(task *Task) {
+	if task.ID == 0 {
+		task.ID = atomic.AddUint64(&s.lastID, 1)
+		return
+	}
+	for {
+		lastID := atomic.LoadUint64(&s.lastID)
+		if task.ID <= lastID || atomic.CompareAndSwapUint64(&s.lastID, lastID, task.ID) {
+			return
+		}
+	}
+}
+
+func (s *MemoryStore) insert(tx StoreTx, table memoryTable, tasks []*Task) error {
+	return s.exec(tx, func(v *memoryView) error {
+		// check the primary key and the unique key before inserting anything
+		ids := make(map[uint64]struct{}, len(tasks))
+		dedupKeys := make(map[taskDedupKey]struct{})
+		for _, task := range tasks {
+			if task.ID != 0 {
+				if _, ok := v.task(table, task.ID); ok {
+					return fmt.Errorf("%w: id[%v]", ErrStoreDuplicateKey, task.ID)
+				} else if _, ok := ids[task.ID]; ok {
+					return fmt.Errorf("%w: id[%v]", ErrStoreDuplicateKey, task.ID)
+				}
+				ids[task.ID] = struct{}{}
+			}
+			if table == memoryTableTasks && task.DedupKey != nil {
+				k := taskDedupKey{key: task.TaskKey, dedupKey: *task.DedupKey}
+				if _, ok := dedupKeys[k]; ok || v.getByDedupKey(task.TaskKey, *task.DedupKey) != nil {
+					return fmt.Errorf("%w: dedup_key[%v]", ErrStoreDuplicateKey, *task.DedupKey)
+				}
+				dedupKeys[k] = struct{}{}
+			}
+		}
+
+		timeNow := time.Now()
+		for _, task := range tasks {
+			s.assignID(task)
+			if task.CreatedAt.IsZero() {
+				task.CreatedAt = timeNow
+			}
+			if task.UpdatedAt.IsZero() {
+				task.UpdatedAt = timeNow
+			}
+			v.putTask(table, copyTask(*task))
+		}
+		return nil
+	})
+}
+
+func (s *MemoryStore) Create(tx StoreTx, task *Task) error {
+	return s.insert(tx, memoryTableTasks, []*Task{task})
+}
+
+func (s *MemoryStore) CreateInBatches(tx StoreTx, tasks []*Task, batchSize int) error {
+	return s.insert(tx, memoryTableTasks, tasks)
+}
+
+func (s *MemoryStore) CreateDeadLetter(tx StoreTx, task *Task) error {
+	return s.insert(tx, memoryTableDeadLetters, []*Task{task})
+}
+
+func (s *MemoryStore) CreateArchives(tx StoreTx, tasks []Task) error {
+	ptrs := make([]*Task, 0, len(tasks))
+	for i := range tasks {
+		ptrs = append(ptrs, &tasks[i])
+	}
+	return s.insert(tx, memoryTableArchives, ptrs)
+}
+
+func (s *MemoryStore) get(tx StoreTx, table memoryTable, id uint64, forUpdate bool) (res *Task, err error) {
+	err = s.exec(tx, func(v *memoryView) error {
+		if forUpdate {
+			v.lock(memoryKey{table: table, id: id})
+		}
+		if task, ok := v.task(table, id); ok {
+			task = copyTask(task)
+			res = &task
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *MemoryStore) Get(tx StoreTx, id uint64) (*Task, error) {
+	return s.get(tx, memoryTableTasks, id, false)
+}
+
+func (s *MemoryStore) GetForUpdate(tx StoreTx, id uint64) (*Task, error) {
+	return s.get(tx, memoryTableTasks, id, true)
+}
+
+func (s *MemoryStore) GetDeadLetter(tx StoreTx, id uint64) (*Task, error) {
+	return s.get(tx, memoryTableDeadLetters, id, false)
+}
+
+// query returns the copies of the tasks matched in order of their IDs.
+func (s *MemoryStore) query(tx StoreTx, table memoryTable, match func(v *memoryView) func(task *Task) bool) (
+	res []Task, err error) {
+	err = s.exec(tx, func(v *memoryView) error {
+		f := match(v)
+		for _, task := range v.tasks(table) {
+			if f(&task) {
+				res = append(res, copyTask(task))
+			}
+		}
+		return nil
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, err
+}
+
+func (s *MemoryStore) GetInitializedSlice(tx StoreTx, sensitiveKeys []TaskKey, offset time.Duration,
+	insensitiveKeys []TaskKey, minPriority int, limit int) ([]Task, error) {
+	timeNow := time.Now()
+	sensitiveSet, insensitiveSet := newTaskKeySet(sensitiveKeys), newTaskKeySet(insensitiveKeys)
+	res, err := s.query(tx, memoryTableTasks, func(v *memoryView) func(task *Task) bool {
+		// only the first unfinished task of an ordering key can be claimed, and only when no task of the key is running
+		blocked, firstIDs := make(map[string]bool), make(map[string]uint64)
+		for _, task := range v.tasks(memoryTableTasks) {
+			if task.OrderingKey == nil {
+				continue
+			} else if task.TaskStatus == TaskStatusRunning {
+				blocked[*task.OrderingKey] = true
+			} else if id, ok := firstIDs[*task.OrderingKey]; task.TaskStatus == TaskStatusInitialized &&
+				(!ok || task.ID < id) {
+				firstIDs[*task.OrderingKey] = task.ID
+			}
+		}
+		return func(task *Task) bool {
+			if task.TaskStatus != TaskStatusInitialized || task.RunAt.After(timeNow) || task.Priority < minPriority {
+				return false
+			} else if task.OrderingKey != nil && (blocked[*task.OrderingKey] || firstIDs[*task.OrderingKey] != task.ID) {
+				return false
+			} else if len(sensitiveSet)+len(insensitiveSet) == 0 || insensitiveSet.has(task.TaskKey) {
+				return true
+			}
+			return sensitiveSet.has(task.TaskKey) &&
+				(!task.UpdatedAt.Before(timeNow.Add(-offset)) || !task.RunAt.Before(timeNow.Add(-offset)))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// higher priority first, then the earlier one
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Priority != res[j].Priority {
+			return res[i].Priority > res[j].Priority
+		}
+		return res[i].RunAt.Before(res[j].RunAt)
+	})
+	return paginate(res, limit, 0), nil
+}
+
+// GetInitializedSliceForUpdate is the same as GetInitializedSlice, the conflicts are detected on commit instead.
+func (s *MemoryStore) GetInitializedSliceForUpdate(tx StoreTx, sensitiveKeys []TaskKey, offset time.Duration,
+	insensitiveKeys []TaskKey, minPriority int, limit int) ([]Task, error) {
+	return s.GetInitializedSlice(tx, sensitiveKeys, offset, insensitiveKeys, minPriority, limit)
+}
+
+func (s *MemoryStore) GetSliceByOffsetsAndStatus(tx StoreTx, startOffset, endOffset time.Duration,
+	status TaskStatus) ([]Task, error) {
+	timeNow := time.Now()
+	start, end := timeNow.Add(-startOffset), timeNow.Add(-endOffset)
+	return s.query(tx, memoryTableTasks, func(v *memoryView) func(task *Task) bool {
+		return func(task *Task) bool {
+			since := task.UpdatedAt
+			if task.RunAt.After(since) {
+				since = task.RunAt
+			}
+			return task.TaskStatus == status && !since.Before(start) && !since.After(end)
+		}
+	})
+}
+
+func (s *MemoryStore) GetSliceByOffsetAndStatusesForUpdate(tx StoreTx, offset time.Duration, statuses []TaskStatus,
+	excludeKeys []TaskKey, limit int) ([]Task, error) {
+	deadline, excludeSet, statusSet := time.Now().Add(-offset), newTaskKeySet(excludeKeys), newStatusSet(statuses)
+	res, err := s.query(tx, memoryTableTasks, func(v *memoryView) func(task *Task) bool {
+		return func(task *Task) bool {
+			return statusSet.has(task.TaskStatus) && task.UpdatedAt.Before(deadline) && !excludeSet.has(task.TaskKey)
+		}
+	})
+	// the tasks are deleted afterwards in the same transaction, which conflicts with the others writing them
+	return paginate(res, limit, 0), err
+}
+
+func (s *MemoryStore) GetSliceExcludeSucceeded(tx StoreTx, excludeKeys []TaskKey, limit, offset int) ([]Task,
+	error) {
+	excludeSet := newTaskKeySet(excludeKeys)
+	res, err := s.query(tx, memoryTableTasks, func(v *memoryView) func(task *Task) bool {
+		return func(task *Task) bool {
+			return task.TaskStatus != TaskStatusSucceeded && !excludeSet.has(task.TaskKey)
+		}
+	})
+	return paginate(res, limit, offset), err
+}
+
+func (s *MemoryStore) GetLeaseExpiredSlice(tx StoreTx, keys []TaskKey, minPriority int, limit int) ([]Task,
+	error) {
+	timeNow := time.Now()
+	keySet := newTaskKeySet(keys)
+	res, err := s.query(tx, memoryTableTasks, func(v *memoryView) func(task *Task) bool {
+		return func(task *Task) bool {
+			return task.TaskStatus == TaskStatusRunning && task.LeaseExpireAt != nil &&
+				task.LeaseExpireAt.Before(timeNow) && task.Priority >= minPriority &&
+				(len(keySet) == 0 || keySet.has(task.TaskKey))
+		}
+	})
+	sort.SliceStable(res, func(i, j int) bool { return res[i].LeaseExpireAt.Before(*res[j].LeaseExpireAt) })
+	return paginate(res, limit, 0), err
+}
+
+func (s *MemoryStore) GetByDedupKey(tx StoreTx, key TaskKey, dedupKey string) (res *Task, err error) {
+	err = s.exec(tx, func(v *memoryView) error {
+		if task := v.getByDedupKey(key, dedupKey); task != nil {
+			copied := copyTask(*task)
+			res = &copied
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *MemoryStore) GetCancelRequestedIDs(tx StoreTx, ids []uint64) ([]uint64, error) {
+	idSet := newIDSet(ids)
+	res, err := s.query(tx, memoryTableTasks, func(v *memoryView) func(task *Task) bool {
+		return func(task *Task) bool {
+			return idSet.has(task.ID) && task.TaskStatus == TaskStatusRunning && task.CancelRequested
+		}
+	})
+	return taskIDsOf(res), err
+}
+
+func (s *MemoryStore) GetDeadLetterSlice(tx StoreTx, limit, offset int) ([]Task, error) {
+	res, err := s.query(tx, memoryTableDeadLetters, func(v *memoryView) func(task *Task) bool {
+		return func(task *Task) bool { return true }
+	})
+	return paginate(res, limit, offset), err
+}
+
+func (s *MemoryStore) GetArchiveSlice(tx StoreTx, limit, offset int) ([]Task, error) {
+	res, err := s.query(tx, memoryTableArchives, func(v *memoryView) func(task *Task) bool {
+		return func(task *Task) bool { return true }
+	})
+	return paginate(res, limit, offset), err
+}
+
+func (s *MemoryStore) GetSliceByWorkflowID(tx StoreTx, workflowID uint64) ([]Task, error) {
+	return s.query(tx, memoryTableTasks, func(v *memoryView) func(task *Task) bool {
+		return func(task *Task) bool { return task.WorkflowID != nil && *task.WorkflowID == workflowID }
+	})
+}
+
+func (s *MemoryStore) GetPendingWorkflowIDs(tx StoreTx, offset time.Duration) ([]uint64, error) {
+	deadline := time.Now().Add(-offset)
+	tasks, err := s.query(tx, memoryTableTasks, func(v *memoryView) func(task *Task) bool {
+		return func(task *Task) bool {
+			return task.TaskStatus == TaskStatusPending && !task.UpdatedAt.After(deadline) && task.WorkflowID != nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	var res []uint64
+	workflowIDs := make(map[uint64]struct{})
+	for _, task := range tasks {
+		if _, ok := workflowIDs[*task.WorkflowID]; !ok {
+			workflowIDs[*task.WorkflowID] = struct{}{}
+			res = append(res, *task.WorkflowID)
+		}
+	}
+	return res, nil
+}
+
+func (s *MemoryStore) CountRunningByKeyForUpdate(tx StoreTx, key TaskKey) (int64, error) {
+	res, err := s.query(tx, memoryTableTasks, func(v *memoryView) func(task *Task) bool {
+		return func(task *Task) bool { return task.TaskKey == key && task.TaskStatus == TaskStatusRunning }
+	})
+	return int64(len(res)), err
+}
+
+func (s *MemoryStore) GetRateLimitToken(tx StoreTx, key TaskKey) (res *RateLimitToken, err error) {
+	err = s.exec(tx, func(v *memoryView) error {
+		if token, ok := v.token(key); ok {
+			res = &token
+		}
+		return nil
+	})
+	return res, err
+}
+
+// LockRateLimitToken writes the token back as it is, so that the transactions locking the same token conflict with
+// each other, and only the first committer wins.
+func (s *MemoryStore) LockRateLimitToken(tx StoreTx, key TaskKey) (res *RateLimitToken, err error) {
+	err = s.exec(tx, func(v *memoryView) error {
+		token, ok := v.token(key)
+		if !ok {
+			token = RateLimitToken{TaskKey: key}
+		}
+		if v.tx != nil || !ok {
+			v.putToken(token)
+		}
+		res = &token
+		return nil
+	})
+	return res, err
+}
+
+func (s *MemoryStore) UpdateRateLimitToken(tx StoreTx, token *RateLimitToken) (rowsAffected int64, err error) {
+	err = s.exec(tx, func(v *memoryView) error {
+		if _, ok := v.token(token.TaskKey); ok {
+			v.putToken(*token)
+			rowsAffected = 1
+		}
+		return nil
+	})
+	return rowsAffected, err
+}
+
+// update applies mutate to the copies of the tasks matched, and returns the number of them.
+func (s *MemoryStore) update(tx StoreTx, match func(task *Task) bool, mutate func(task *Task)) (rowsAffected int64,
+	err error) {
+	err = s.exec(tx, func(v *memoryView) error {
+		for _, task := range v.tasks(memoryTableTasks) {
+			if !match(&task) {
+				continue
+			}
+			task = copyTask(task)
+			mutate(&task)
+			v.putTask(memoryTableTasks, task)
+			rowsAffected++
+		}
+		return nil
+	})
+	return rowsAffected, err
+}
+
+func (s *MemoryStore) Update(tx StoreTx, task *Task) (rowsAffected int64, err error) {
+	// only the non-zero fields are updated, which is the same as gorm
+	updated := copyTask(*task)
+	err = s.exec(tx, func(v *memoryView) error {
+		ori, ok := v.task(memoryTableTasks, updated.ID)
+		if !ok {
+			return nil
+		}
+		res := copyTask(ori)
+		dst, src := reflect.ValueOf(&res).Elem(), reflect.ValueOf(updated)
+		for i := 0; i < src.NumField(); i++ {
+			if !src.Field(i).IsZero() {
+				dst.Field(i).Set(src.Field(i))
+			}
+		}
+		if res.DedupKey != nil {
+			if existing := v.getByDedupKey(res.TaskKey, *res.DedupKey); existing != nil && existing.ID != res.ID {
+				return fmt.Errorf("%w: dedup_key[%v]", ErrStoreDuplicateKey, *res.DedupKey)
+			}
+		}
+		res.UpdatedAt = time.Now()
+		v.putTask(memoryTableTasks, res)
+		rowsAffected = 1
+		return nil
+	})
+	return rowsAffected, err
+}
+
+func (s *MemoryStore) UpdateStatusByIDs(tx StoreTx, ids []uint64, oriStatus TaskStatus, newStatus TaskStatus) (int64,
+	error) {
+	idSet, timeNow := newIDSet(ids), time.Now()
+	return s.update(tx, func(task *Task) bool {
+		return idSet.has(task.ID) && task.TaskStatus == oriStatus
+	}, func(task *Task) {
+		task.TaskStatus, task.CancelRequested, task.UpdatedAt = newStatus, false, timeNow
+	})
+}
+
+func (s *MemoryStore) UpdateStatusAndExtraByID(tx StoreTx, id uint64, oriStatus TaskStatus, newStatus TaskStatus,
+	extra TaskExtra) (int64, error) {
+	timeNow := time.Now()
+	return s.update(tx, func(task *Task) bool {
+		return task.ID == id && task.TaskStatus == oriStatus
+	}, func(task *Task) {
+		task.TaskStatus, task.Extra, task.UpdatedAt = newStatus, copyExtra(extra), timeNow
+	})
+}
+
+func (s *MemoryStore) UpdateStatusAndArgumentByID(tx StoreTx, id uint64, oriStatus TaskStatus,
+	newStatus TaskStatus, argument []byte) (int64, error) {
+	timeNow := time.Now()
+	return s.update(tx, func(task *Task) bool {
+		return task.ID == id && task.TaskStatus == oriStatus
+	}, func(task *Task) {
+		task.TaskStatus, task.Argument, task.UpdatedAt = newStatus, copyBytes(argument), timeNow
+	})
+}
+
+func (s *MemoryStore) UpdateRunningByLeaseOwner(tx StoreTx, id uint64, leaseOwner string, newStatus TaskStatus,
+	extra TaskExtra) (int64, error) {
+	timeNow := time.Now()
+	return s.update(tx, func(task *Task) bool {
+		return task.ID == id && task.TaskStatus == TaskStatusRunning && task.LeaseOwner == leaseOwner
+	}, func(task *Task) {
+		task.TaskStatus, task.Extra, task.UpdatedAt = newStatus, copyExtra(extra), timeNow
+	})
+}
+
+func (s *MemoryStore) UpdateRunningToRetry(tx StoreTx, id uint64, leaseOwner string, runAt time.Time,
+	extra TaskExtra) (int64, error) {
+	timeNow := time.Now()
+	return s.update(tx, func(task *Task) bool {
+		return task.ID == id && task.TaskStatus == TaskStatusRunning && task.LeaseOwner == leaseOwner
+	}, func(task *Task) {
+		task.TaskStatus, task.RunAt, task.Extra = TaskStatusInitialized, runAt, copyExtra(extra)
+		task.CancelRequested, task.UpdatedAt = false, timeNow
+	})
+}
+
+func (s *MemoryStore) UpdateRunningToInitializedByLeaseOwner(tx StoreTx, ids []uint64, leaseOwner string) (int64,
+	error) {
+	idSet, timeNow := newIDSet(ids), time.Now()
+	return s.update(tx, func(task *Task) bool {
+		return idSet.has(task.ID) && task.TaskStatus == TaskStatusRunning && task.LeaseOwner == leaseOwner
+	}, func(task *Task) {
+		task.TaskStatus, task.LeaseOwner, task.LeaseExpireAt = TaskStatusInitialized, "", nil
+		task.CancelRequested, task.UpdatedAt = false, timeNow
+	})
+}
+
+// UpdateInitializedToRunningByIDs claims the tasks, ErrZeroRowsAffected is returned and nothing is updated if any of
+// the tasks is not initialized.
+func (s *MemoryStore) UpdateInitializedToRunningByIDs(tx StoreTx, ids []uint64, leaseOwner string,
+	leaseExpireAt *time.Time) (claimedIDs []uint64, err error) {
+	err = s.exec(tx, func(v *memoryView) error {
+		for _, id := range ids {
+			if task, ok := v.task(memoryTableTasks, id); !ok || task.TaskStatus != TaskStatusInitialized {
+				return ErrZeroRowsAffected
+			}
+		}
+		timeNow := time.Now()
+		for _, id := range ids {
+			task, _ := v.task(memoryTableTasks, id)
+			task = copyTask(task)
+			task.TaskStatus, task.LeaseOwner, task.LeaseExpireAt = TaskStatusRunning, leaseOwner, copyTime(leaseExpireAt)
+			task.CancelRequested, task.UpdatedAt = false, timeNow
+			v.putTask(memoryTableTasks, task)
+		}
+		claimedIDs = ids
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimedIDs, nil
+}
+
+func (s *MemoryStore) UpdateLeaseExpired(tx StoreTx, oriLeaseOwner string, task *Task) (int64, error) {
+	timeNow := time.Now()
+	updated := copyTask(*task)
+	return s.update(tx, func(t *Task) bool {
+		return t.ID == updated.ID && t.TaskStatus == TaskStatusRunning && t.LeaseOwner == oriLeaseOwner &&
+			t.LeaseExpireAt != nil && t.LeaseExpireAt.Before(timeNow)
+	}, func(t *Task) {
+		t.TaskStatus, t.LeaseOwner, t.LeaseExpireAt = updated.TaskStatus, updated.LeaseOwner, updated.LeaseExpireAt
+		t.Extra, t.UpdatedAt = updated.Extra, timeNow
+	})
+}
+
+func (s *MemoryStore) UpdateLeaseByIDs(tx StoreTx, ids []uint64, leaseOwner string, leaseExpireAt time.Time) (int64,
+	error) {
+	idSet := newIDSet(ids)
+	// updated_at is not touched, so that a running task can still be detected as abnormal by its running timeout
+	return s.update(tx, func(task *Task) bool {
+		return idSet.has(task.ID) && task.TaskStatus == TaskStatusRunning && task.LeaseOwner == leaseOwner
+	}, func(task *Task) {
+		task.LeaseExpireAt = copyTime(&leaseExpireAt)
+	})
+}
+
+func (s *MemoryStore) UpdateDedupKeyToNull(tx StoreTx, id uint64) (int64, error) {
+	return s.update(tx, func(task *Task) bool { return task.ID == id }, func(task *Task) { task.DedupKey = nil })
+}
+
+func (s *MemoryStore) UpdateCancelRequested(tx StoreTx, id uint64) (int64, error) {
+	timeNow := time.Now()
+	return s.update(tx, func(task *Task) bool {
+		return task.ID == id && task.TaskStatus == TaskStatusRunning
+	}, func(task *Task) {
+		task.CancelRequested, task.UpdatedAt = true, timeNow
+	})
+}
+
+func (s *MemoryStore) UpdateWorkflowID(tx StoreTx, id uint64, workflowID uint64) (int64, error) {
+	return s.update(tx, func(task *Task) bool { return task.ID == id }, func(task *Task) {
+		task.WorkflowID = &workflowID
+	})
+}
+
+// delete deletes the records matched in the table, and returns the number of them.
+func (s *MemoryStore) delete(tx StoreTx, table memoryTable, match func(task *Task) bool) (rowsAffected int64,
+	err error) {
+	err = s.exec(tx, func(v *memoryView) error {
+		for _, task := range v.tasks(table) {
+			if match(&task) {
+				v.removeTask(table, task.ID)
+				rowsAffected++
+			}
+		}
+		return nil
+	})
+	return rowsAffected, err
+}
+
+func (s *MemoryStore) DeleteByOffsetAndStatuses(tx StoreTx, offset time.Duration, statuses []TaskStatus,
+	excludeKeys []TaskKey, afterID uint64, limit int) (uint64, int64, error) {
+	deadline, excludeSet, statusSet := time.Now().Add(-offset), newTaskKeySet(excludeKeys), newStatusSet(statuses)
+	match := func(task *Task) bool {
+		return task.ID > afterID && statusSet.has(task.TaskStatus) && task.UpdatedAt.Before(deadline) &&
+			!excludeSet.has(task.TaskKey)
+	}
+	var lastID uint64
+	tasks, err := s.query(tx, memoryTableTasks, func(v *memoryView) func(task *Task) bool { return match })
+	if err != nil {
+		return 0, 0, err
+	} else if len(tasks) >= limit {
+		lastID = tasks[limit-1].ID
+	}
+	rowsAffected, err := s.delete(tx, memoryTableTasks, func(task *Task) bool {
+		return match(task) && (lastID == 0 || task.ID <= lastID)
+	})
+	return lastID, rowsAffected, err
+}
+
+func (s *MemoryStore) DeleteByIDAndStatus(tx StoreTx, id uint64, status TaskStatus) (int64, error) {
+	return s.delete(tx, memoryTableTasks, func(task *Task) bool { return task.ID == id && task.TaskStatus == status })
+}
+
+func (s *MemoryStore) DeleteByIDsAndStatuses(tx StoreTx, ids []uint64, statuses []TaskStatus) (int64, error) {
+	idSet, statusSet := newIDSet(ids), newStatusSet(statuses)
+	return s.delete(tx, memoryTableTasks, func(task *Task) bool {
+		return statusSet.has(task.TaskStatus) && idSet.has(task.ID)
+	})
+}
+
+func (s *MemoryStore) DeleteDeadLetterByID(tx StoreTx, id uint64) (int64, error) {
+	return s.delete(tx, memoryTableDeadLetters, func(task *Task) bool { return task.ID == id })
+}
+
+type taskDedupKey struct {
+	key      TaskKey
+	dedupKey string
+}
+
+type taskKeySet map[TaskKey]struct{}
+
+func newTaskKeySet(keys []TaskKey) taskKeySet {
+	res := make(taskKeySet, len(keys))
+	for _, key := range keys {
+		res[key] = struct{}{}
+	}
+	return res
+}
+
+func (s taskKeySet) has(key TaskKey) bool {
+	_, ok := s[key]
+	return ok
+}
+
+type idSet map[uint64]struct{}
+
+func newIDSet(ids []uint64) idSet {
+	res := make(idSet, len(ids))
+	for _, id := range ids {
+		res[id] = struct{}{}
+	}
+	return res
+}
+
+func (s idSet) has(id uint64) bool {
+	_, ok := s[id]
+	return ok
+}
+
+type statusSet map[TaskStatus]struct{}
+
+func newStatusSet(statuses []TaskStatus) statusSet {
+	res := make(statusSet, len(statuses))
+	for _, status := range statuses {
+		res[status] = struct{}{}
+	}
+	return res
+}
+
+func (s statusSet) has(status TaskStatus) bool {
+	_, ok := s[status]
+	return ok
+}
+
+// paginate works like LIMIT and OFFSET, which are ignored if not positive.
+func paginate(tasks []Task, limit, offset int) []Task {
+	if offset > 0 {
+		if offset >= len(tasks) {
+			return nil
+		}
+		tasks = tasks[offset:]
+	}
+	if limit > 0 && limit < len(tasks) {
+		tasks = tasks[:limit]
+	}
+	return tasks
+}
+
+func taskIDsOf(tasks []Task) []uint64 {
+	res := make([]uint64, 0, len(tasks))
+	for _, task := range tasks {
+		res = append(res, task.ID)
+	}
+	return res
+}
+
+// copyTask returns a deep copy of the task, so that the one in the store is never shared with the callers.
+func copyTask(task Task) Task {
+	task.Context, task.Argument = copyBytes(task.Context), copyBytes(task.Argument)
+	task.Extra = copyExtra(task.Extra)
+	task.LeaseExpireAt = copyTime(task.LeaseExpireAt)
+	if task.DedupKey != nil {
+		dedupKey := *task.DedupKey
+		task.DedupKey = &dedupKey
+	}
+	if task.OrderingKey != nil {
+		orderingKey := *task.OrderingKey
+		task.OrderingKey = &orderingKey
+	}
+	if task.WorkflowID != nil {
+		workflowID := *task.WorkflowID
+		task.WorkflowID = &workflowID
+	}
+	if task.DependsOn != nil {
+		task.DependsOn = append(TaskIDs{}, task.DependsOn...)
+	}
+	return task
+}
+
+func copyExtra(extra TaskExtra) TaskExtra {
+	extra.CanceledAt = copyTime(extra.CanceledAt)
+	if extra.AttemptRecords != nil {
+		extra.AttemptRecords = append([]TaskAttempt{}, extra.AttemptRecords...)
+	}
+	return extra
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	res := *t
+	return &res
+}
@@ -0,0 +1,188 @@
+package gta
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemoryStore(t *testing.T) {
+	convey.Convey("TestMemoryStore", t, func() {
+		store, db := NewMemoryStore(), StoreTx(nil)
+
+		convey.Convey("create and get", func() {
+			task := &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized, Argument: []byte("arg")}
+			convey.So(store.Create(db, task), convey.ShouldBeNil)
+			convey.So(task.ID, convey.ShouldEqual, 10001)
+			convey.So(task.CreatedAt.IsZero(), convey.ShouldBeFalse)
+
+			res, err := store.Get(db, task.ID)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(res.Argument, convey.ShouldResemble, []byte("arg"))
+			// the task in the store is not shared with the callers
+			res.Argument[0] = 'A'
+			res, _ = store.Get(db, task.ID)
+			convey.So(res.Argument, convey.ShouldResemble, []byte("arg"))
+
+			convey.So(store.Create(db, &Task{ID: 20000, TaskKey: "t1"}), convey.ShouldBeNil)
+			convey.So(errors.Is(store.Create(db, &Task{ID: 20000, TaskKey: "t1"}), ErrStoreDuplicateKey), convey.ShouldBeTrue)
+			next := &Task{TaskKey: "t1"}
+			convey.So(store.Create(db, next), convey.ShouldBeNil)
+			convey.So(next.ID, convey.ShouldEqual, 20001)
+
+			res, err = store.Get(db, 1000)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(res, convey.ShouldBeNil)
+		})
+
+		convey.Convey("dedup key", func() {
+			dedupKey := "d1"
+			convey.So(store.Create(db, &Task{TaskKey: "t1", DedupKey: &dedupKey}), convey.ShouldBeNil)
+			convey.So(errors.Is(store.Create(db, &Task{TaskKey: "t1", DedupKey: &dedupKey}), ErrStoreDuplicateKey), convey.ShouldBeTrue)
+			convey.So(store.Create(db, &Task{TaskKey: "t2", DedupKey: &dedupKey}), convey.ShouldBeNil)
+			task, err := store.GetByDedupKey(db, "t1", dedupKey)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(task.ID, convey.ShouldEqual, 10001)
+			_, _ = store.UpdateDedupKeyToNull(db, task.ID)
+			convey.So(store.Create(db, &Task{TaskKey: "t1", DedupKey: &dedupKey}), convey.ShouldBeNil)
+		})
+
+		convey.Convey("transaction", func() {
+			convey.Convey("rollback", func() {
+				err := store.Transaction(db, func(tx StoreTx) error {
+					_ = store.Create(tx, &Task{TaskKey: "t1"})
+					// visible inside the transaction only
+					task, _ := store.Get(tx, 10001)
+					convey.So(task, convey.ShouldNotBeNil)
+					task, _ = store.Get(db, 10001)
+					convey.So(task, convey.ShouldBeNil)
+					return ErrUnexpected
+				})
+				convey.So(err, convey.ShouldEqual, ErrUnexpected)
+				task, _ := store.Get(db, 10001)
+				convey.So(task, convey.ShouldBeNil)
+			})
+
+			convey.Convey("commit", func() {
+				err := store.Transaction(db, func(tx StoreTx) error {
+					return store.Create(tx, &Task{TaskKey: "t1"})
+				})
+				convey.So(err, convey.ShouldBeNil)
+				task, _ := store.Get(db, 10001)
+				convey.So(task, convey.ShouldNotBeNil)
+			})
+
+			convey.Convey("conflict", func() {
+				_ = store.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized})
+				err := store.Transaction(db, func(tx StoreTx) error {
+					if _, err := store.GetForUpdate(tx, 10001); err != nil {
+						return err
+					}
+					// committed by another one in the meantime
+					_, _ = store.UpdateStatusByIDs(db, []uint64{10001}, TaskStatusInitialized, TaskStatusRunning)
+					_, err := store.UpdateStatusByIDs(tx, []uint64{10001}, TaskStatusInitialized, TaskStatusCanceled)
+					return err
+				})
+				convey.So(err, convey.ShouldEqual, ErrStoreConflict)
+				task, _ := store.Get(db, 10001)
+				convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusRunning)
+			})
+
+			convey.Convey("duplicate dedup key on commit", func() {
+				dedupKey := "d1"
+				err := store.Transaction(db, func(tx StoreTx) error {
+					if err := store.Create(tx, &Task{TaskKey: "t1", DedupKey: &dedupKey}); err != nil {
+						return err
+					}
+					return store.Create(db, &Task{TaskKey: "t1", DedupKey: &dedupKey})
+				})
+				convey.So(errors.Is(err, ErrStoreDuplicateKey), convey.ShouldBeTrue)
+			})
+
+			convey.Convey("read committed", func() {
+				_ = store.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized})
+				err := store.Transaction(db, func(tx StoreTx) error {
+					if _, err := store.UpdateStatusByIDs(tx, []uint64{10001}, TaskStatusInitialized, TaskStatusRunning); err != nil {
+						return err
+					}
+					// committed by another one in the meantime, which doesn't conflict with the records written
+					_ = store.Create(db, &Task{TaskKey: "t2", TaskStatus: TaskStatusInitialized})
+					tasks, err := store.GetInitializedSlice(tx, nil, 0, nil, math.MinInt32, 0)
+					convey.So(err, convey.ShouldBeNil)
+					convey.So(taskIDsOf(tasks), convey.ShouldResemble, []uint64{10002})
+					return nil
+				})
+				convey.So(err, convey.ShouldBeNil)
+				task, _ := store.Get(db, 10001)
+				convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusRunning)
+			})
+		})
+
+		convey.Convey("archive", func() {
+			_ = store.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusSucceeded, UpdatedAt: time.Now().Add(-time.Hour)})
+			_ = store.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusFailed, UpdatedAt: time.Now().Add(-time.Hour)})
+			_ = store.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusSucceeded})
+			tasks, err := store.GetSliceByOffsetAndStatusesForUpdate(db, time.Minute, []TaskStatus{TaskStatusSucceeded},
+				nil, 10)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(taskIDsOf(tasks), convey.ShouldResemble, []uint64{10001})
+			convey.So(store.CreateArchives(db, tasks), convey.ShouldBeNil)
+			rowsAffected, err := store.DeleteByIDsAndStatuses(db, []uint64{10001, 10002}, []TaskStatus{TaskStatusSucceeded})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(rowsAffected, convey.ShouldEqual, 1)
+			archived, err := store.GetArchiveSlice(db, 10, 0)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(taskIDsOf(archived), convey.ShouldResemble, []uint64{10001})
+			task, _ := store.Get(db, 10001)
+			convey.So(task, convey.ShouldBeNil)
+		})
+
+		convey.Convey("clean up in batches", func() {
+			for i := 0; i < 3; i++ {
+				_ = store.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusSucceeded, UpdatedAt: time.Now().Add(-time.Hour)})
+			}
+			_ = store.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusFailed, UpdatedAt: time.Now().Add(-time.Hour)})
+			statuses := []TaskStatus{TaskStatusSucceeded}
+			lastID, rowsAffected, err := store.DeleteByOffsetAndStatuses(db, time.Minute, statuses, nil, 0, 2)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(lastID, convey.ShouldEqual, 10002)
+			convey.So(rowsAffected, convey.ShouldEqual, 2)
+			lastID, rowsAffected, err = store.DeleteByOffsetAndStatuses(db, time.Minute, statuses, nil, lastID, 2)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(lastID, convey.ShouldEqual, 0)
+			convey.So(rowsAffected, convey.ShouldEqual, 1)
+			task, _ := store.Get(db, 10004)
+			convey.So(task, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("claim", func() {
+			orderingKey := "o1"
+			_ = store.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized, RunAt: time.Now()})
+			_ = store.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized, RunAt: time.Now(), Priority: 1})
+			_ = store.Create(db, &Task{TaskKey: "t1", TaskStatus: TaskStatusInitialized, RunAt: time.Now().Add(time.Hour)})
+			_ = store.Create(db, &Task{TaskKey: "t2", TaskStatus: TaskStatusInitialized, RunAt: time.Now(), OrderingKey: &orderingKey})
+			_ = store.Create(db, &Task{TaskKey: "t2", TaskStatus: TaskStatusInitialized, RunAt: time.Now(), OrderingKey: &orderingKey})
+
+			tasks, err := store.GetInitializedSlice(db, nil, time.Minute, []TaskKey{"t1", "t2"}, math.MinInt32, 10)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(taskIDsOf(tasks), convey.ShouldResemble, []uint64{10002, 10001, 10004})
+
+			ids, err := store.UpdateInitializedToRunningByIDs(db, []uint64{10002, 10004}, "i1", nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(ids, convey.ShouldResemble, []uint64{10002, 10004})
+			_, err = store.UpdateInitializedToRunningByIDs(db, []uint64{10001, 10002}, "i1", nil)
+			convey.So(err, convey.ShouldEqual, ErrZeroRowsAffected)
+			task, _ := store.Get(db, 10001)
+			convey.So(task.TaskStatus, convey.ShouldEqual, TaskStatusInitialized)
+
+			// the next task of the ordering key waits for the running one
+			tasks, _ = store.GetInitializedSlice(db, nil, time.Minute, []TaskKey{"t1", "t2"}, math.MinInt32, 10)
+			convey.So(taskIDsOf(tasks), convey.ShouldResemble, []uint64{10001})
+			count, _ := store.CountRunningByKeyForUpdate(db, "t1")
+			convey.So(count, convey.ShouldEqual, 1)
+		})
+	})
+}
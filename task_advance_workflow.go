@@ -0,0 +1,46 @@
+package gta
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+const (
+	taskAdvanceWorkflow   TaskKey = "builtin:advance_workflow"
+	taskAdvanceWorkflowID uint64  = 9998
+)
+
+type advanceWorkflowReq struct {
+	PendingTimeout time.Duration `json:"pending_timeout"`
+}
+
+func registerAdvanceWorkflowTask(tm *TaskManager) {
+	tm.Register(taskAdvanceWorkflow, TaskDefinition{
+		Handler:      advanceWorkflowHandler(tm),
+		ArgType:      reflect.TypeOf(advanceWorkflowReq{}),
+		builtin:      true,
+		taskID:       taskAdvanceWorkflowID,
+		argument:     advanceWorkflowReq{PendingTimeout: tm.scanInterval},
+		loopInterval: tm.scanInterval * 15,
+	})
+}
+
+// advanceWorkflowHandler advances the workflows with pending tasks, in case the process exited after a task in the
+// workflow finished but before the workflow was advanced.
+func advanceWorkflowHandler(tm *TaskManager) TaskHandler {
+	return func(ctx context.Context, arg interface{}) (err error) {
+		logger := tm.logger()
+		pendingTimeout := arg.(advanceWorkflowReq).PendingTimeout
+		workflowIDs, err := tm.tdal.GetPendingWorkflowIDs(tm.getDB(), pendingTimeout)
+		if err != nil {
+			return err
+		}
+		for _, id := range workflowIDs {
+			if err := tm.tsch.AdvanceWorkflowByID(id); err != nil {
+				logger.Errorf("[advanceWorkflowHandler] advance workflow failed, err[%v], workflow_id[%v]", err, id)
+			}
+		}
+		return nil
+	}
+}
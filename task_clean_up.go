@@ -13,29 +13,55 @@ const (
 
 type cleanUpReq struct {
 	StorageTimeout time.Duration `json:"storage_timeout"`
+	// failed tasks are kept if zero
+	FailedStorageTimeout time.Duration `json:"failed_storage_timeout"`
+	// canceled tasks are kept if false
+	CleanCanceled bool `json:"clean_canceled"`
 }
 
 func registerCleanUpTask(tm *TaskManager) {
+	loopInterval := tm.storageTimeout / 2
+	if tm.failedStorageTimeout > 0 && tm.failedStorageTimeout < tm.storageTimeout {
+		loopInterval = tm.failedStorageTimeout / 2
+	}
+	req := cleanUpReq{
+		StorageTimeout:       tm.storageTimeout,
+		FailedStorageTimeout: tm.failedStorageTimeout,
+		CleanCanceled:        tm.cleanCanceled,
+	}
 	tm.Register(taskCleanUp, TaskDefinition{
 		Handler:      cleanUpHandler(tm),
 		ArgType:      reflect.TypeOf(cleanUpReq{}),
 		builtin:      true,
 		taskID:       taskCleanUpID,
-		argument:     cleanUpReq{StorageTimeout: tm.storageTimeout},
-		loopInterval: tm.storageTimeout / 2,
+		argument:     req,
+		loopInterval: loopInterval,
 	})
 }
 
 func cleanUpHandler(tm *TaskManager) TaskHandler {
 	return func(ctx context.Context, arg interface{}) (err error) {
 		logger := tm.logger()
-		storageTimeout := arg.(cleanUpReq).StorageTimeout
-		rowsAffected, err := tm.tdal.DeleteSucceededByOffset(tm.getDB(), storageTimeout, tm.tr.GetBuiltInKeys())
+		req := arg.(cleanUpReq)
+		statuses := []TaskStatus{TaskStatusSucceeded}
+		if req.CleanCanceled {
+			statuses = append(statuses, TaskStatusCanceled)
+		}
+		rowsAffected, err := tm.tarc.CleanUp(req.StorageTimeout, statuses, tm.tr.GetBuiltInKeys())
+		if rowsAffected > 0 {
+			logger.Infof("[cleanUpHandler] task cleaned, storage timeout[%v], len[%v]", req.StorageTimeout, rowsAffected)
+		}
 		if err != nil {
 			return err
-		} else if rowsAffected > 0 {
-			logger.Infof("[cleanUpHandler] task cleaned, storage timeout[%v], len[%v]", storageTimeout, rowsAffected)
 		}
-		return nil
+		if req.FailedStorageTimeout > 0 {
+			rowsAffected, err = tm.tarc.CleanUp(req.FailedStorageTimeout, []TaskStatus{TaskStatusFailed},
+				tm.tr.GetBuiltInKeys())
+			if rowsAffected > 0 {
+				logger.Infof("[cleanUpHandler] failed task cleaned, storage timeout[%v], len[%v]",
+					req.FailedStorageTimeout, rowsAffected)
+			}
+		}
+		return err
 	}
 }
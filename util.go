@@ -24,12 +24,40 @@ func randomInterval(interval time.Duration) time.Duration {
 	return interval + time.Duration(randomIntervalFactor*rand.Float64()*float64(interval))
 }
 
+// signal is a non-blocking notification channel, the notifications sent before being received are merged into one.
+type signal chan struct{}
+
+func newSignal() signal {
+	return make(signal, 1)
+}
+
+// notify never blocks, and it does nothing on a nil signal.
+func (s signal) notify() {
+	select {
+	case s <- struct{}{}:
+	default:
+	}
+}
+
 func panicHandler() {
 	if r := recover(); r != nil {
 		logrus.Errorf("panic: %v\n%s", r, string(debug.Stack()))
 	}
 }
 
+// withCancelSignal returns a copy of ctx which is also canceled once the done channel is closed.
+func withCancelSignal(ctx context.Context, done <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 func minInt64(i ...int64) int64 {
 	min := int64(math.MaxInt64)
 	for _, a := range i {
@@ -43,7 +71,7 @@ func minInt64(i ...int64) int64 {
 func testDB(dbName string) *gorm.DB {
 	dbName = dbName + fmt.Sprintf("_%d.db", rand.Int())
 	db, _ := gorm.Open(sqlite.Open(dbName), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
-	_ = db.Migrator().AutoMigrate(&Task{})
+	_ = Migrate(db, "tasks")
 	return db
 }
 
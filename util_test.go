@@ -1,6 +1,7 @@
 package gta
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -20,3 +21,31 @@ func Test_randomInterval(t *testing.T) {
 		convey.So(interval, convey.ShouldBeLessThan, time.Duration(float64(time.Second)*(1+randomIntervalFactor)))
 	})
 }
+
+func Test_withCancelSignal(t *testing.T) {
+	convey.Convey("Test_withCancelSignal", t, func() {
+		done := make(chan struct{})
+		ctx, cancel := withCancelSignal(context.Background(), done)
+		defer cancel()
+		convey.So(ctx.Err(), convey.ShouldBeNil)
+		close(done)
+		<-ctx.Done()
+		convey.So(ctx.Err(), convey.ShouldEqual, context.Canceled)
+	})
+}
+
+func Test_signal(t *testing.T) {
+	convey.Convey("Test_signal", t, func() {
+		s := newSignal()
+		s.notify()
+		s.notify()
+		<-s
+		select {
+		case <-s:
+			t.Fatal("notifications should be merged")
+		default:
+		}
+		var nilSignal signal
+		convey.So(func() { nilSignal.notify() }, convey.ShouldNotPanic)
+	})
+}
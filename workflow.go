@@ -0,0 +1,98 @@
+package gta
+
+import (
+	"fmt"
+)
+
+// Workflow is a set of tasks with dependencies, i.e. a DAG, which is created in one transaction. A task in the workflow
+// is 'pending' until all its parents succeeded, and it's terminated as well once any of its parents failed or was
+// canceled.
+type Workflow struct {
+	nodes []workflowNode
+	err   error
+}
+
+// WorkflowNode is a reference to a task added to the workflow, which can be used as a parent of the tasks added later.
+type WorkflowNode int
+
+type workflowNode struct {
+	key     TaskKey
+	arg     interface{}
+	parents []WorkflowNode
+	// for compensating tasks in a saga only
+	compensating bool
+	compensates  WorkflowNode
+	// for the completion task in a group only
+	groupCompletion bool
+}
+
+// WorkflowInfo is the overall information of a workflow.
+type WorkflowInfo struct {
+	// ID of the workflow, which is the ID of its first task
+	ID uint64
+	// overall status of the workflow, 'running' if any task is running or the workflow is partially finished,
+	// otherwise 'initialized' if no task is finished, or 'failed', 'canceled' and 'succeeded' in sequence once all the
+	// tasks are finished
+	Status TaskStatus
+	// tasks of the workflow in the order of creation, excluding the ones cleaned
+	Tasks []Task
+}
+
+// NewWorkflow creates an empty workflow.
+func NewWorkflow() *Workflow {
+	return &Workflow{}
+}
+
+// Add adds a task to the workflow, which runs after all the parents succeeded, or right after the workflow is created
+// if no parent is provided. Parents must be added before, so there won't be any cycle.
+func (w *Workflow) Add(key TaskKey, arg interface{}, parents ...WorkflowNode) WorkflowNode {
+	node := WorkflowNode(len(w.nodes))
+	for _, parent := range parents {
+		if parent < 0 || parent >= node {
+			if w.err == nil {
+				w.err = fmt.Errorf("%w: parent[%v] of node[%v] not found", ErrWorkflowInvalid, parent, node)
+			}
+		}
+	}
+	w.nodes = append(w.nodes, workflowNode{key: key, arg: arg, parents: parents})
+	return node
+}
+
+// addCompensation adds a compensating task of the forward node to the workflow, see Saga for more information.
+func (w *Workflow) addCompensation(key TaskKey, arg interface{}, forward WorkflowNode,
+	parents ...WorkflowNode) WorkflowNode {
+	node := w.Add(key, arg, parents...)
+	w.nodes[node].compensating, w.nodes[node].compensates = true, forward
+	return node
+}
+
+func (w *Workflow) verify() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.nodes) == 0 {
+		return fmt.Errorf("%w: empty workflow", ErrWorkflowInvalid)
+	}
+	return nil
+}
+
+// workflowStatus returns the overall status of the tasks in a workflow.
+func workflowStatus(tasks []Task) TaskStatus {
+	countMap := make(map[TaskStatus]int)
+	for _, t := range tasks {
+		countMap[t.TaskStatus]++
+	}
+	unfinished := countMap[TaskStatusPending] + countMap[TaskStatusInitialized]
+	switch {
+	case countMap[TaskStatusRunning] > 0 || (unfinished > 0 && unfinished < len(tasks)):
+		return TaskStatusRunning
+	case unfinished > 0:
+		return TaskStatusInitialized
+	case countMap[TaskStatusFailed] > 0:
+		return TaskStatusFailed
+	case countMap[TaskStatusCanceled] > 0:
+		return TaskStatusCanceled
+	default:
+		return TaskStatusSucceeded
+	}
+}
@@ -0,0 +1,42 @@
+package gta
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestWorkflow(t *testing.T) {
+	convey.Convey("TestWorkflow", t, func() {
+		convey.Convey("verify", func() {
+			wf := NewWorkflow()
+			convey.So(errors.Is(wf.verify(), ErrWorkflowInvalid), convey.ShouldBeTrue)
+			a := wf.Add("t1", nil)
+			b := wf.Add("t1", nil, a)
+			convey.So(wf.verify(), convey.ShouldBeNil)
+			convey.So(b, convey.ShouldEqual, 1)
+			wf.Add("t1", nil, b, 3)
+			convey.So(errors.Is(wf.verify(), ErrWorkflowInvalid), convey.ShouldBeTrue)
+			wf = NewWorkflow()
+			wf.Add("t1", nil, -1)
+			convey.So(errors.Is(wf.verify(), ErrWorkflowInvalid), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("workflowStatus", func() {
+			tasks := func(statuses ...TaskStatus) []Task {
+				res := make([]Task, 0, len(statuses))
+				for _, status := range statuses {
+					res = append(res, Task{TaskStatus: status})
+				}
+				return res
+			}
+			convey.So(workflowStatus(tasks(TaskStatusInitialized, TaskStatusPending)), convey.ShouldEqual, TaskStatusInitialized)
+			convey.So(workflowStatus(tasks(TaskStatusRunning, TaskStatusPending)), convey.ShouldEqual, TaskStatusRunning)
+			convey.So(workflowStatus(tasks(TaskStatusSucceeded, TaskStatusPending)), convey.ShouldEqual, TaskStatusRunning)
+			convey.So(workflowStatus(tasks(TaskStatusSucceeded, TaskStatusCanceled, TaskStatusFailed)), convey.ShouldEqual, TaskStatusFailed)
+			convey.So(workflowStatus(tasks(TaskStatusSucceeded, TaskStatusCanceled)), convey.ShouldEqual, TaskStatusCanceled)
+			convey.So(workflowStatus(tasks(TaskStatusSucceeded, TaskStatusSucceeded)), convey.ShouldEqual, TaskStatusSucceeded)
+		})
+	})
+}